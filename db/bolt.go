@@ -3,55 +3,139 @@ package db
 
 import (
 	"bytes"
-	"encoding/gob"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
 )
 
 const defaultBucketName = "default"
 
+//BoltMode shapes the writes of a Bolt session like the mgo modes shape the Mongo ones
+type BoltMode int
+
+const (
+	//BoltDefault commits every write in its own transaction
+	BoltDefault BoltMode = iota
+	//BoltReadOnly rejects all writes with ErrReadOnly
+	BoltReadOnly
+	//BoltBatch combines writes of concurrent goroutines into one transaction with bolt.DB.Batch
+	BoltBatch
+	//BoltStrict syncs every write to the disk even if the db was opened with db.WithNoSync
+	BoltStrict
+)
+
+//ErrReadOnly is returned by the writes of a BoltReadOnly session
+var ErrReadOnly = errors.New("Failed to write, the session is read-only")
+
+//Bolt struct wraps *bolt.DB
 type Bolt struct {
+	boltConfig
 	db     *bolt.DB
-	dir    string //to be deleted on Close()
-	bucket []byte
-	key    []byte
+	dir    string //to be deleted on Close(), empty for a persistent db
+	copied bool   //Close of a copy doesn't close the db
+	mode   BoltMode
 }
 
+//boltConfig is shared by the copies, transactions and collections of a db
+type boltConfig struct {
+	codec  Codec
+	keys   keyEncoding
+	create bool //missing buckets are created by the writes and read as empty ones
+}
+
+//Connect opens the db. Resources are `boltDBName string, buckets ...string` or the options:
+//db.WithDSN(boltDBName) for an ephemeral db in the temp directory removed on Close,
+//db.WithPath(path) for a persistent db file kept on Close, db.WithBuckets, db.WithCollections, db.WithAutoCreate,
+//db.WithFileMode, db.WithBoltOptions, db.WithNoSync and db.WithCodec.
 func (b *Bolt) Connect(resources ...interface{}) (err error) {
-	//reading db filename
-	boltDBName, ok := resources[0].(string)
-	if !ok {
-		return errors.New("Unexpected resources set, want `boltDBName string`")
+	return b.connect(0, resources...)
+}
+
+//ConnectContext is Connect giving up at the ctx deadline if the db file is locked by another process
+func (b *Bolt) ConnectContext(ctx context.Context, resources ...interface{}) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
 	}
+	return b.connect(timeout, resources...)
+}
 
-	//making directory with the prefix = boltDBName
-	b.dir, err = ioutil.TempDir("", boltDBName)
+//connect opens the db, a non-zero timeout limits the wait for the file lock
+func (b *Bolt) connect(timeout time.Duration, resources ...interface{}) (err error) {
+	//reading db filename, buckets and settings
+	o, err := connectOptions(resources)
+	if err != nil {
+		return err
+	}
+	opts := &bolt.Options{}
+	if o.Bolt != nil {
+		*opts = *o.Bolt
+	}
+	if timeout > 0 && (opts.Timeout == 0 || timeout < opts.Timeout) {
+		opts.Timeout = timeout
+	}
+	fileMode := o.FileMode
+	if fileMode == 0 {
+		fileMode = 0644
+	}
+
+	path, err := b.prepare(o, opts.ReadOnly)
 	if err != nil {
 		return err
 	}
 
 	//opening the file
-	b.db, err = bolt.Open(fmt.Sprintf("%s/%s", b.dir, boltDBName), 0644, nil)
+	b.db, err = bolt.Open(path, fileMode, opts)
 	if err != nil {
+		if b.dir != "" {
+			os.RemoveAll(b.dir)
+		}
 		return err
 	}
+	b.db.NoSync = o.NoSync
+	b.create = o.AutoCreate
+
+	if opts.ReadOnly {
+		if len(o.Buckets) > 0 || len(o.Collections) > 0 {
+			b.Close()
+			return errors.New("Failed to set up buckets, the db is opened read-only")
+		}
+		err = b.db.View(b.readMeta(o))
+		if err != nil {
+			b.Close()
+			return err
+		}
+		return nil
+	}
 
 	//setting up the buckets (if any received @ resources)
 	err = b.db.Update(func(tx *bolt.Tx) error {
-		for i := 1; i < len(resources); i++ {
-			bucketName, ok := resources[i].(string)
-			if !ok {
-				continue
-			}
+		for _, bucketName := range o.Buckets {
 			_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
 			if err != nil {
 				return err
 			}
 		}
+		for database, collections := range o.Collections {
+			for _, collection := range collections {
+				_, err := createBucket(tx, [][]byte{[]byte(database), []byte(collection)})
+				if err != nil {
+					return err
+				}
+			}
+		}
 
 		//setting up the default bucket
 		_, err := tx.CreateBucketIfNotExists([]byte(defaultBucketName))
@@ -59,63 +143,263 @@ func (b *Bolt) Connect(resources ...interface{}) (err error) {
 			return err
 		}
 
-		return nil
+		//reading the codec and the key format of the db or storing the ones of a new db
+		return b.readMeta(o)(tx)
 	})
 	if err != nil {
+		b.Close()
 		return fmt.Errorf("Failed to set up buckets, %v", err)
 	}
 
 	return nil
 }
 
-func (b *Bolt) Copy() Handler                                             { return b }
-func (b *Bolt) CopyWithSettings(settings ...interface{}) (Handler, error) { return b, nil }
-func (b *Bolt) Close() {
-	b.db.Close()
-	os.RemoveAll(b.dir)
+//readMeta returns the function reading the codec and the key format of the db
+func (b *Bolt) readMeta(o *Options) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) (err error) {
+		b.keys, err = keyFormat(tx)
+		if err != nil {
+			return err
+		}
+		b.codec, err = codecOf(tx, o.Codec)
+		return err
+	}
 }
 
-func (b *Bolt) ExecOn(resources ...interface{}) Querier {
-	if resources == nil {
-		b.bucket = []byte(defaultBucketName)
-		return b
+//prepare returns the path of the db file, making the temp directory for an ephemeral db
+//or the parent directories of a persistent one
+func (b *Bolt) prepare(o *Options, readOnly bool) (path string, err error) {
+	b.dir = ""
+	if o.Path != "" {
+		if !readOnly {
+			err := os.MkdirAll(filepath.Dir(o.Path), 0755)
+			if err != nil {
+				return "", err
+			}
+		}
+		return o.Path, nil
+	}
+
+	if o.DSN == "" {
+		return "", errors.New("Unexpected resources set, want db.WithPath(path), a non-empty db.WithDSN(boltDBName) or `boltDBName string`")
 	}
-	bucketName, ok := resources[0].(string)
-	if !ok {
-		b.bucket = []byte(defaultBucketName)
-		return b
+	boltDBName := o.DSN
+
+	//making directory with the prefix = boltDBName
+	b.dir, err = ioutil.TempDir("", boltDBName)
+	if err != nil {
+		return "", err
 	}
-	b.bucket = []byte(bucketName)
-	return b
+	return fmt.Sprintf("%s/%s", b.dir, boltDBName), nil
 }
 
-func (b *Bolt) Insert(docs ...interface{}) error {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
+//Copy returns a handler sharing the db and the mode, closing the copy leaves the db open
+func (b *Bolt) Copy() Handler {
+	return &Bolt{db: b.db, copied: true, mode: b.mode, boltConfig: b.boltConfig}
+}
 
-	err := enc.Encode(docs[0])
+//CopyWithSettings returns a copy working in the mode given as db.WithBoltMode(mode) or `mode db.BoltMode`,
+//without settings the copy keeps the mode. The mgo settings db.WithMode, db.WithRefresh and `mode int, refresh bool`
+//are errors, BoltDB has no consistency modes.
+func (b *Bolt) CopyWithSettings(settings ...interface{}) (Handler, error) {
+	o, ok, err := applyOptions(settings)
 	if err != nil {
-		return fmt.Errorf("Failed to encode to []byte")
+		return nil, err
+	}
+	mode := b.mode
+	switch {
+	case ok:
+		if o.modeSet || o.Refresh {
+			return nil, errors.New("Unexpected settings, db.WithMode and db.WithRefresh are for Mongo, want db.WithBoltMode(mode)")
+		}
+		if o.boltModeSet {
+			mode = o.BoltMode
+		}
+	case len(settings) > 0:
+		m, isMode := settings[0].(BoltMode)
+		if !isMode || len(settings) > 1 {
+			return nil, fmt.Errorf("Unexpected settings set, want db.WithBoltMode(mode) or `mode db.BoltMode`, got %d value(s) starting with `%T`", len(settings), settings[0])
+		}
+		err := WithBoltMode(m)(o)
+		if err != nil {
+			return nil, err
+		}
+		mode = m
+	}
+	return &Bolt{db: b.db, copied: true, mode: mode, boltConfig: b.boltConfig}, nil
+}
+
+//Close closes the db, an ephemeral db file is removed; Close of a copy does nothing
+func (b *Bolt) Close() {
+	if b.copied {
+		return
+	}
+	b.db.Close()
+	if b.dir != "" { //ephemeral db
+		os.RemoveAll(b.dir)
 	}
-	key, err := ioutil.ReadAll(&buf)
+}
+
+//ExecOn returns the collection working with the bucket: `bucket` names a top-level bucket, "default" if skipped,
+//`database, collection` like for Mongo names the collection bucket nested in the database bucket.
+//Missing buckets are errors unless the db is opened with db.WithAutoCreate.
+//Collections and queries keep their own state, so they can be used by concurrent goroutines.
+func (b *Bolt) ExecOn(resources ...interface{}) Querier {
+	return &BoltCollection{db: b.db, bucket: bucketOf(resources), mode: b.mode, boltConfig: b.boltConfig}
+}
+
+//WithTransaction runs fn in one read-write transaction, the writes made through tx are committed if fn returns nil.
+//fn has to return the errors of the writes, a failed write may leave its changes otherwise.
+//A BoltReadOnly session gives ErrReadOnly, a BoltStrict one syncs the commit to the disk.
+func (b *Bolt) WithTransaction(fn func(tx Tx) error) error {
+	if b.mode == BoltReadOnly {
+		return ErrReadOnly
+	}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return fn(&BoltTx{db: b.db, tx: tx, boltConfig: b.boltConfig})
+	})
 	if err != nil {
 		return err
 	}
 
-	err = enc.Encode(docs[1])
-	if err != nil {
-		return fmt.Errorf("Failed to encode to []byte, got `%T` as a value", key)
+	if b.mode == BoltStrict && b.db.NoSync {
+		return b.db.Sync()
 	}
-	value, err := ioutil.ReadAll(&buf)
+	return nil
+}
+
+//RebuildIndexes recreates the entries of the indexes of the top-level buckets,
+//of all indexed buckets including the nested collection ones if none are given.
+//The entries are kept up to date by the writes of the package, a rebuild is needed after the records
+//were changed bypassing it, e.g. by bolt directly or by other tools. Indexes of the removed buckets are dropped.
+//A unique index fails the rebuild with a duplicate key error if the records have equal values.
+func (b *Bolt) RebuildIndexes(buckets ...string) error {
+	if b.mode == BoltReadOnly {
+		return ErrReadOnly
+	}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(indexesBucketName))
+		var paths [][][]byte
+		for _, name := range buckets {
+			paths = append(paths, [][]byte{[]byte(name)})
+		}
+		if len(buckets) == 0 && meta != nil {
+			var stale [][]byte
+			err := meta.ForEach(func(k, v []byte) error {
+				path := pathOf(append([]byte(nil), k...))
+				if bucketAt(tx, path) == nil {
+					stale = append(stale, append([]byte(nil), k...))
+					return nil
+				}
+				paths = append(paths, path)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, name := range stale {
+				err := meta.DeleteBucket(name)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, path := range paths {
+			bkt, err := openBucket(tx, path, b.boltConfig)
+			if err != nil {
+				return fmt.Errorf("Failed to rebuild the indexes of `%s`, %v", nsOf(path), err)
+			}
+			err = bkt.rebuildIndexes()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	err = b.db.Update(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket(b.bucket)
-		if bkt == nil {
-			return errors.New("No bucket")
+	if b.mode == BoltStrict && b.db.NoSync {
+		return b.db.Sync()
+	}
+	return nil
+}
+
+//BoltTx gives the collections working inside a transaction of WithTransaction
+type BoltTx struct {
+	boltConfig
+	db *bolt.DB
+	tx *bolt.Tx
+}
+
+//ExecOn returns the collection working with the bucket inside the transaction
+func (t *BoltTx) ExecOn(resources ...interface{}) Querier {
+	return &BoltCollection{db: t.db, bucket: bucketOf(resources), tx: t.tx, boltConfig: t.boltConfig}
+}
+
+//bucketOf returns the path of the bucket given to ExecOn: a top-level bucket, "default" if skipped,
+//or a collection bucket nested in a database bucket, an empty database name gives a top-level bucket
+func bucketOf(resources []interface{}) [][]byte {
+	if len(resources) == 2 {
+		database, _ := resources[0].(string)
+		collection, ok := resources[1].(string)
+		if !ok || collection == "" {
+			collection = defaultBucketName
+		}
+		if database == "" {
+			return [][]byte{[]byte(collection)}
+		}
+		return [][]byte{[]byte(database), []byte(collection)}
+	}
+	if len(resources) > 0 {
+		if name, ok := resources[0].(string); ok {
+			return [][]byte{[]byte(name)}
 		}
+	}
+	return [][]byte{[]byte(defaultBucketName)}
+}
+
+//BoltCollection works with the records of one bucket
+type BoltCollection struct {
+	boltConfig
+	db     *bolt.DB
+	bucket [][]byte //path of the bucket
+	mode   BoltMode
+	tx     *bolt.Tx //transaction of WithTransaction, nil if every call has its own one
+}
+
+//Insert stores new records in one transaction, so either all of them are stored or none.
+//Like MongoCollection.Insert it takes documents (bson.M, bson.D, maps or structs) stored under their `_id`:
+//a missing or zero `_id` is generated as a bson.ObjectId, a bucket sequence number for an integer `_id` field,
+//and written back into the documents passed by pointer and into maps. A stored `_id` gives a duplicate key error (mgo.IsDup).
+//Two arguments whose first one isn't a document (a map or a struct with an `_id` field) are `key, value`:
+//the value is put under the key replacing the stored one.
+func (bc *BoltCollection) Insert(docs ...interface{}) error {
+	return bc.InsertContext(context.Background(), docs...)
+}
+
+//InsertContext is Insert failing with the ctx error if ctx is done
+func (bc *BoltCollection) InsertContext(ctx context.Context, docs ...interface{}) error {
+	if len(docs) == 0 {
+		return errors.New("Unexpected docs set, want documents or `key, value interface{}`")
+	}
+	if len(docs) != 2 || isDocument(docs[0]) {
+		return bc.insertDocs(ctx, docs)
+	}
+
+	key, err := bc.keys.encode(docs[0])
+	if err != nil {
+		return fmt.Errorf("Failed to encode key to []byte, %v", err)
+	}
+
+	value, err := encodeValue(bc.codec, docs[1])
+	if err != nil {
+		return fmt.Errorf("Failed to encode to []byte, got `%T` as a value, %v", docs[1], err)
+	}
+
+	err = bc.update(ctx, func(bkt *boltBucket) error {
 		err := bkt.Put(key, value)
 		if err != nil {
 			return err
@@ -129,78 +413,1045 @@ func (b *Bolt) Insert(docs ...interface{}) error {
 
 	return nil
 }
-func (b *Bolt) Remove(selector interface{}) error {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
 
-	err := enc.Encode(selector)
+//insertDocs stores the documents under their `_id`, the generated ones are written back after the commit
+func (bc *BoltCollection) insertDocs(ctx context.Context, docs []interface{}) error {
+	var ids []*docID
+	err := bc.update(ctx, func(bkt *boltBucket) error {
+		ids = ids[:0] //a batch may be retried
+		for _, d := range docs {
+			id, err := idOf(d)
+			if err != nil {
+				return err
+			}
+			err = id.generate(bkt)
+			if err != nil {
+				return err
+			}
+			key, err := bc.keys.encode(id.value)
+			if err != nil {
+				return fmt.Errorf("Failed to encode `_id` to []byte, %v", err)
+			}
+			if bkt.Get(key) != nil {
+				return dupError(bkt.ns(), "_id_", id.value)
+			}
+			value, err := encodeValue(bkt.codec, id.doc())
+			if err != nil {
+				return fmt.Errorf("Failed to encode to []byte, got `%T` as a value, %v", d, err)
+			}
+			err = bkt.putByID(key, value)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("Failed to encode selector to []byte")
+		return err
 	}
-	key := buf.Bytes()
 
-	err = b.db.Update(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket(b.bucket)
-		if bkt == nil {
-			return errors.New("No bucket")
+	for _, id := range ids {
+		id.writeBack()
+	}
+	return nil
+}
+
+//Remove deletes the first record matching the selector, returns ErrNotFound if nothing matched
+func (bc *BoltCollection) Remove(selector interface{}) error {
+	return bc.RemoveContext(context.Background(), selector)
+}
+
+//RemoveContext is Remove failing with the ctx error if ctx is done, the changes are rolled back then
+func (bc *BoltCollection) RemoveContext(ctx context.Context, selector interface{}) error {
+	return bc.update(ctx, func(bkt *boltBucket) error {
+		keys, err := bc.keysOf(ctx, bkt, selector)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return ErrNotFound
 		}
-		err := bkt.Delete(key)
+		return bkt.Delete(keys[0])
+	})
+}
+
+//RemoveAll deletes records matching the selector, nil selector removes the whole bucket content
+func (bc *BoltCollection) RemoveAll(selector interface{}) (num int, err error) {
+	return bc.RemoveAllContext(context.Background(), selector)
+}
+
+//RemoveAllContext is RemoveAll failing with the ctx error if ctx is done, the changes are rolled back then
+func (bc *BoltCollection) RemoveAllContext(ctx context.Context, selector interface{}) (num int, err error) {
+	err = bc.update(ctx, func(bkt *boltBucket) error {
+		keys, err := bc.keysOf(ctx, bkt, selector)
 		if err != nil {
 			return err
 		}
+		for _, key := range keys {
+			err := bkt.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		num = len(keys)
 		return nil
 	})
+	if err != nil {
+		return 0, err
+	}
+	return num, nil
+}
+
+//Update modifies the first record matching the selector, returns ErrNotFound if nothing matched.
+//The update is either a replacement value or a document of update operators like {"$set": ...}.
+func (bc *BoltCollection) Update(selector interface{}, update interface{}) error {
+	return bc.UpdateContext(context.Background(), selector, update)
+}
 
+//UpdateContext is Update failing with the ctx error if ctx is done, the changes are rolled back then
+func (bc *BoltCollection) UpdateContext(ctx context.Context, selector interface{}, update interface{}) error {
+	upd, err := newBoltUpdater(bc.codec, update)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return bc.update(ctx, func(bkt *boltBucket) error {
+		keys, err := bc.keysOf(ctx, bkt, selector)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return ErrNotFound
+		}
+		return upd.apply(bkt, keys[0])
+	})
+}
+
+//UpdateAll modifies records matching the selector, nil selector updates the whole bucket content
+func (bc *BoltCollection) UpdateAll(selector interface{}, update interface{}) (num int, err error) {
+	return bc.UpdateAllContext(context.Background(), selector, update)
+}
+
+//UpdateAllContext is UpdateAll failing with the ctx error if ctx is done, the changes are rolled back then
+func (bc *BoltCollection) UpdateAllContext(ctx context.Context, selector interface{}, update interface{}) (num int, err error) {
+	upd, err := newBoltUpdater(bc.codec, update)
+	if err != nil {
+		return 0, err
+	}
+
+	err = bc.update(ctx, func(bkt *boltBucket) error {
+		keys, err := bc.keysOf(ctx, bkt, selector)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			err := upd.apply(bkt, key)
+			if err != nil {
+				return err
+			}
+		}
+		num = len(keys)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return num, nil
+}
+
+//Upsert modifies the first record matching the selector or inserts a new one.
+//A selector document has to hold an `_id` value to be used as the key of the new record,
+//with update operators the new record is built from the selector's equality conditions.
+//Like MongoCollection.Upsert it returns the number of updated records, so an insert gives 0.
+func (bc *BoltCollection) Upsert(selector interface{}, update interface{}) (num int, err error) {
+	return bc.UpsertContext(context.Background(), selector, update)
+}
+
+//UpsertContext is Upsert failing with the ctx error if ctx is done, the changes are rolled back then
+func (bc *BoltCollection) UpsertContext(ctx context.Context, selector interface{}, update interface{}) (num int, err error) {
+	upd, err := newBoltUpdater(bc.codec, update)
+	if err != nil {
+		return 0, err
+	}
+
+	err = bc.update(ctx, func(bkt *boltBucket) error {
+		num = 0
+		keys, err := bc.keysOf(ctx, bkt, selector)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			num = 1
+			return upd.apply(bkt, keys[0])
+		}
+
+		key, err := bc.upsertKey(selector)
+		if err != nil {
+			return err
+		}
+		return upd.insert(bkt, key, selector)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return num, nil
 }
-func (b *Bolt) RemoveAll(selector interface{}) (num int, err error)   { return 0, nil }
-func (b *Bolt) Update(selector interface{}, update interface{}) error { return nil }
-func (b *Bolt) UpdateAll(selector interface{}, update interface{}) (num int, err error) {
-	return 0, nil
+
+//Find sets the query for the Refiner methods.
+//Selector documents (bson.M, bson.D, map[string]interface{}) are matched against the stored values,
+//db.KeyRange and db.KeyPrefix select the records by a range of keys sought with a cursor,
+//any other query is a key, nil query selects the whole bucket.
+func (bc *BoltCollection) Find(query interface{}) Refiner {
+	filter, err := parseQuery(query, bc.keys)
+	return &BoltQuery{coll: bc, boltFilter: filter, err: err}
 }
-func (b *Bolt) Upsert(selector interface{}, update interface{}) (num int, err error) {
-	return 0, nil
+
+//Pipe runs the aggregation pipeline in-process over the records of the bucket read by One, All or Iter,
+//records which aren't documents are skipped
+func (bc *BoltCollection) Pipe(pipeline interface{}) Piper {
+	return &pipe{pipeline: pipeline, source: func() ([]bson.M, error) {
+		var docs []bson.M
+		err := (&BoltQuery{coll: bc}).forEach(context.Background(), func(data []byte) error {
+			var value interface{}
+			err := decodeValue(bc.codec, data, &value)
+			if err != nil {
+				return err
+			}
+			if doc, ok := docOf(value); ok {
+				docs = append(docs, doc)
+			}
+			return nil
+		})
+		return docs, err
+	}}
 }
-func (b *Bolt) Find(query interface{}) Refiner {
-	if query != nil {
-		var buf bytes.Buffer
-		enc := gob.NewEncoder(&buf)
-		enc.Encode(query)
-		b.key = buf.Bytes()
+
+//EnsureIndex creates a secondary index of the bucket unless it exists, its entries are updated by every write.
+//A unique index makes the writes giving an indexed value of another record fail with a duplicate key error (mgo.IsDup),
+//it can't be created if the records already have equal values. Records which aren't documents aren't indexed.
+//The ttl is kept, but the records don't expire.
+func (bc *BoltCollection) EnsureIndex(keys []string, unique, sparse bool, ttl time.Duration) error {
+	idx, err := newIndex(keys, unique, sparse, ttl)
+	if err != nil {
+		return err
 	}
-	return b
+	return bc.update(context.Background(), func(bkt *boltBucket) error {
+		return bkt.ensureIndex(idx)
+	})
 }
 
-func (b *Bolt) One(result interface{}) error {
-	var buf bytes.Buffer
-	dec := gob.NewDecoder(&buf)
+//DropIndex removes the index made by EnsureIndex with the same keys
+func (bc *BoltCollection) DropIndex(keys ...string) error {
+	name, err := indexName(keys)
+	if err != nil {
+		return err
+	}
+	return bc.update(context.Background(), func(bkt *boltBucket) error {
+		coll := indexesOf(bkt.Tx(), bkt.indexKey())
+		if coll == nil || coll.Bucket([]byte(name)) == nil {
+			return fmt.Errorf("index not found with name [%s]", name)
+		}
+		return coll.DeleteBucket([]byte(name))
+	})
+}
 
-	err := b.db.View(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket(b.bucket)
-		if bkt == nil {
-			return errors.New("No bucket")
+//Indexes returns the `_id_` index and the indexes made by EnsureIndex sorted by name
+func (bc *BoltCollection) Indexes() (indexes []mgo.Index, err error) {
+	view := bc.db.View
+	if bc.tx != nil {
+		view = func(fn func(tx *bolt.Tx) error) error { return fn(bc.tx) }
+	}
+	err = view(func(tx *bolt.Tx) error {
+		bkt, err := openBucket(tx, bc.bucket, bc.boltConfig)
+		if err == errNoBucket && bc.create { //a missing bucket has no indexes
+			return nil
 		}
-		_, err := buf.Write(bkt.Get(b.key))
 		if err != nil {
 			return err
 		}
+		indexes = append(indexes, idIndex())
+		for _, idx := range bkt.indexes {
+			indexes = append(indexes, idx.Index)
+		}
 		return nil
 	})
 	if err != nil {
+		return nil, err
+	}
+	sortIndexes(indexes)
+	return indexes, nil
+}
+
+//BoltQuery refines the records matching the query
+type BoltQuery struct {
+	boltFilter
+	coll   *BoltCollection
+	err    error
+	refine refinement
+}
+
+//Sort orders the records by the document fields, "-field" sorts in the descending order
+func (bq *BoltQuery) Sort(fields ...string) Refiner {
+	bq.refine.setSort(fields)
+	return bq
+}
+
+//Limit restricts the number of records, zero means no limit
+func (bq *BoltQuery) Limit(n int) Refiner {
+	bq.refine.setLimit(n)
+	return bq
+}
+
+//Skip skips the first n records
+func (bq *BoltQuery) Skip(n int) Refiner {
+	bq.refine.setSkip(n)
+	return bq
+}
+
+//Select keeps only the fields of the projection like bson.M{"name": 1} or removes them like bson.M{"name": 0},
+//the projected documents are converted to the result by the bson rules
+func (bq *BoltQuery) Select(projection interface{}) Refiner {
+	bq.refine.setProjection(projection)
+	return bq
+}
+
+//One decodes the first record matching the query into result,
+//returns ErrNotFound if there is nothing to decode
+func (bq *BoltQuery) One(result interface{}) error {
+	return bq.OneContext(context.Background(), result)
+}
+
+//OneContext is One failing with the ctx error if ctx is done
+func (bq *BoltQuery) OneContext(ctx context.Context, result interface{}) error {
+	if bq.refine.active() {
+		found := false
+		err := bq.refined(ctx, reflect.TypeOf(result), func(value interface{}) error {
+			found = true
+			err := assign(value, result)
+			if err != nil {
+				return err
+			}
+			return errStop
+		})
+		if err != nil && err != errStop {
+			return err
+		}
+		if !found {
+			return ErrNotFound
+		}
+		return nil
+	}
+
+	var data []byte
+
+	err := bq.forEach(ctx, func(v []byte) error {
+		data = append(data, v...)
+		return errStop
+	})
+	if err != nil && err != errStop {
 		return err
 	}
+	if data == nil {
+		return ErrNotFound
+	}
 
-	err = dec.Decode(result)
+	err = decodeValue(bq.coll.codec, data, result)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
-func (b *Bolt) All(results interface{}) error                 { return nil }
-func (b *Bolt) Distinct(key string, result interface{}) error { return nil }
-func (b *Bolt) Count() (num int, err error)                   { return 0, nil }
+
+//All decodes every record matching the query into the slice pointed by results
+func (bq *BoltQuery) All(results interface{}) error {
+	return bq.AllContext(context.Background(), results)
+}
+
+//AllContext is All failing with the ctx error if ctx is done
+func (bq *BoltQuery) AllContext(ctx context.Context, results interface{}) error {
+	resultv := reflect.ValueOf(results)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("Unexpected results type, want a pointer to a slice, got `%T`", results)
+	}
+	slicev := resultv.Elem().Slice(0, 0)
+	elemt := slicev.Type().Elem()
+
+	appendDecoded := func(data []byte) error {
+		elemp := reflect.New(elemt)
+		err := decodeValue(bq.coll.codec, data, elemp.Interface())
+		if err != nil {
+			return err
+		}
+		slicev = reflect.Append(slicev, elemp.Elem())
+		return nil
+	}
+
+	var err error
+	if bq.refine.active() {
+		err = bq.refined(ctx, elemt, func(value interface{}) error {
+			elemp := reflect.New(elemt)
+			err := assign(value, elemp.Interface())
+			if err != nil {
+				return err
+			}
+			slicev = reflect.Append(slicev, elemp.Elem())
+			return nil
+		})
+	} else {
+		err = bq.forEach(ctx, appendDecoded)
+	}
+	if err != nil {
+		return err
+	}
+
+	resultv.Elem().Set(slicev)
+	return nil
+}
+
+//Distinct writes the unique values of the field named by key into the slice pointed by result.
+//The key may be a dotted path, field names follow the bson rules just like in Mongo.
+//Like in mgo Sort, Skip, Limit and Select don't affect it.
+func (bq *BoltQuery) Distinct(key string, result interface{}) error {
+	return bq.DistinctContext(context.Background(), key, result)
+}
+
+//DistinctContext is Distinct failing with the ctx error if ctx is done
+func (bq *BoltQuery) DistinctContext(ctx context.Context, key string, result interface{}) error {
+	var values []interface{}
+
+	err := bq.forEach(ctx, func(data []byte) error {
+		var value interface{}
+		err := decodeValue(bq.coll.codec, data, &value)
+		if err != nil {
+			return err
+		}
+		doc, ok := docOf(value)
+		if !ok {
+			return nil
+		}
+		for _, v := range lookup(doc, key) {
+			values = appendUnique(values, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return unmarshalValues(values, result)
+}
+
+//Count returns the number of records matching the query
+func (bq *BoltQuery) Count() (num int, err error) {
+	return bq.CountContext(context.Background())
+}
+
+//CountContext is Count failing with the ctx error if ctx is done
+func (bq *BoltQuery) CountContext(ctx context.Context) (num int, err error) {
+	if bq.refine.err != nil {
+		return 0, bq.refine.err
+	}
+	err = bq.forEach(ctx, func(data []byte) error {
+		num++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return bq.refine.count(num), nil
+}
+
+//refined calls fn for the values matching the query sorted, skipped and limited by the refinement,
+//with Select the values are the projected documents. The type of the result is registered to decode the values.
+func (bq *BoltQuery) refined(ctx context.Context, resultType reflect.Type, fn func(value interface{}) error) error {
+	if bq.refine.err != nil {
+		return bq.refine.err
+	}
+	if resultType != nil {
+		err := registerType(resultType)
+		if err != nil {
+			return err
+		}
+	}
+
+	var values []interface{}
+	var docs []bson.M
+	err := bq.forEach(ctx, func(data []byte) error {
+		var value interface{}
+		err := decodeValue(bq.coll.codec, data, &value)
+		if err != nil {
+			return err
+		}
+		doc, ok := docOf(value)
+		if !ok { //not a document, it has no fields to sort by
+			doc = bson.M{}
+		}
+		values = append(values, value)
+		docs = append(docs, doc)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, i := range bq.refine.order(docs) {
+		value := values[i]
+		if bq.refine.projection != nil {
+			value, err = bq.refine.project(docs[i])
+			if err != nil {
+				return err
+			}
+		}
+		err := fn(value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Iter returns an iterator over the records matching the query.
+//It reads the records one by one with a cursor inside a read-only transaction held until the records end
+//or Close is called, so the iterator has to be closed and the goroutine shouldn't write to the db meanwhile.
+//With Sort, Skip, Limit or Select the records are loaded into memory on the first Next.
+func (bq *BoltQuery) Iter() Iterator {
+	it := &BoltIter{query: bq}
+	if bq.err != nil {
+		it.err = bq.err
+		return it
+	}
+	if bq.refine.active() {
+		return it
+	}
+
+	it.tx = bq.coll.tx
+	if it.tx == nil {
+		it.tx, it.err = bq.coll.db.Begin(false)
+		if it.err != nil {
+			return it
+		}
+		it.own = true
+	}
+	bkt, err := openBucket(it.tx, bq.coll.bucket, bq.coll.boltConfig)
+	if err != nil {
+		if err != errNoBucket || !bq.coll.create { //a missing bucket has no records
+			it.err = err
+		}
+		it.release()
+		return it
+	}
+	if bq.key == nil && bq.selector != nil {
+		it.keys, it.indexed = bkt.candidates(bq.selector)
+	}
+	it.span = bkt.narrow(bq.boltFilter).span
+	it.cursor = bkt.Cursor()
+	return it
+}
+
+//BoltIter iterates over the records with a bolt.Cursor
+type BoltIter struct {
+	query   *BoltQuery
+	tx      *bolt.Tx
+	own     bool //the transaction is rolled back on Close, it's not one of WithTransaction
+	cursor  *bolt.Cursor
+	span    *keySpan //span of the query left by the bucket
+	started bool
+	keys    [][]byte //keys of the records found with an index
+	indexed bool
+	values  *sliceIter //refined values
+	err     error
+}
+
+//Next decodes the next record matching the query into result, it returns false at the end or on error
+func (it *BoltIter) Next(result interface{}) bool {
+	if it.err != nil {
+		return false
+	}
+	if t := reflect.TypeOf(result); t != nil {
+		it.err = registerType(t)
+		if it.err != nil {
+			return false
+		}
+	}
+
+	if it.query.refine.active() {
+		if it.values == nil {
+			it.values = &sliceIter{}
+			it.err = it.query.refined(context.Background(), reflect.TypeOf(result), func(value interface{}) error {
+				it.values.values = append(it.values.values, value)
+				return nil
+			})
+		}
+		if it.err != nil || !it.values.Next(result) {
+			if it.err == nil {
+				it.err = it.values.Err()
+			}
+			return false
+		}
+		return true
+	}
+
+	for it.cursor != nil {
+		k, v := it.step()
+		if k == nil {
+			it.release()
+			return false
+		}
+		if v == nil { //nested bucket
+			continue
+		}
+		if it.query.selector != nil {
+			ok, err := matchValue(it.query.coll.codec, v, it.query.selector)
+			if err != nil {
+				it.err = err
+				it.release()
+				return false
+			}
+			if !ok {
+				continue
+			}
+		}
+		it.err = decodeValue(it.query.coll.codec, v, result)
+		if it.err != nil {
+			it.release()
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+//step moves the cursor to the next record, a key query gives the record stored under the key only,
+//a query using an index gives the records found with it and a span gives its records in its order
+func (it *BoltIter) step() (k, v []byte) {
+	if it.indexed {
+		for len(it.keys) > 0 {
+			key := it.keys[0]
+			it.keys = it.keys[1:]
+			k, v = it.cursor.Seek(key)
+			if bytes.Equal(k, key) {
+				return k, v
+			}
+		}
+		return nil, nil
+	}
+
+	key, span := it.query.key, it.span
+	if it.started {
+		switch {
+		case key != nil:
+			return nil, nil
+		case span != nil:
+			return span.next(it.cursor)
+		}
+		return it.cursor.Next()
+	}
+
+	it.started = true
+	if key != nil {
+		k, v = it.cursor.Seek(key)
+		if !bytes.Equal(k, key) {
+			return nil, nil
+		}
+		return k, v
+	}
+	if span != nil {
+		return span.first(it.cursor)
+	}
+	return it.cursor.First()
+}
+
+//Err returns the error of the iteration
+func (it *BoltIter) Err() error {
+	return it.err
+}
+
+//Close ends the read-only transaction of the iterator and returns the error of the iteration
+func (it *BoltIter) Close() error {
+	it.release()
+	return it.err
+}
+
+func (it *BoltIter) release() {
+	if it.own && it.tx != nil {
+		it.tx.Rollback()
+	}
+	it.tx, it.cursor = nil, nil
+}
+
+//forEach calls fn for every value matching the query inside a read-only transaction
+func (bq *BoltQuery) forEach(ctx context.Context, fn func(data []byte) error) error {
+	if bq.err != nil {
+		return bq.err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	view := bq.coll.db.View
+	if bq.coll.tx != nil { //reading inside WithTransaction sees its writes
+		view = func(fn func(tx *bolt.Tx) error) error { return fn(bq.coll.tx) }
+	}
+	return view(func(tx *bolt.Tx) error {
+		bkt, err := openBucket(tx, bq.coll.bucket, bq.coll.boltConfig)
+		if err == errNoBucket && bq.coll.create { //a missing bucket has no records
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return scan(ctx, bkt, bq.boltFilter, func(k, v []byte) error {
+			return fn(v)
+		})
+	})
+}
+
+//update calls fn with the bucket inside a read-write transaction, so fn's writes and their index entries are applied atomically.
+//A missing bucket is created if the db is opened with db.WithAutoCreate.
+//The transaction is rolled back if ctx is done before it's committed.
+//In the BoltBatch mode fn may be called more than once, so it has to be idempotent.
+func (bc *BoltCollection) update(ctx context.Context, fn func(bkt *boltBucket) error) error {
+	if bc.mode == BoltReadOnly {
+		return ErrReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	apply := func(tx *bolt.Tx) error {
+		bkt, err := openBucket(tx, bc.bucket, bc.boltConfig)
+		if err == errNoBucket && bc.create {
+			_, err = createBucket(tx, bc.bucket)
+			if err != nil {
+				return err
+			}
+			bkt, err = openBucket(tx, bc.bucket, bc.boltConfig)
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(bkt)
+		if err != nil {
+			return err
+		}
+		return ctx.Err()
+	}
+	if bc.tx != nil { //committed by WithTransaction
+		return apply(bc.tx)
+	}
+
+	commit := bc.db.Update
+	if bc.mode == BoltBatch {
+		commit = bc.db.Batch
+	}
+	err := commit(apply)
+	if err != nil {
+		return err
+	}
+
+	if bc.mode == BoltStrict && bc.db.NoSync {
+		return bc.db.Sync()
+	}
+	return nil
+}
+
+//errStop breaks the scan loop without an error
+var errStop = errors.New("stop")
+
+//boltFilter selects the records of a query: the one stored under the key, the ones of the span of keys
+//or the ones matching the selector, whose `_id` condition may narrow the span. Nothing set selects every record.
+type boltFilter struct {
+	key      []byte
+	span     *keySpan
+	byID     bool //the span is of the `_id` conditions of the selector
+	selector bson.M
+}
+
+//parseQuery splits a query into a key encoded by keys, a span of keys and a selector document, nil query gives none
+func parseQuery(query interface{}, keys keyEncoding) (f boltFilter, err error) {
+	if query == nil {
+		return f, nil
+	}
+	if span, ok, err := spanOf(query, keys); ok {
+		f.span = span
+		return f, err
+	}
+	if selector, ok := selectorOf(query); ok {
+		f.selector = selector
+		f.span = idSpan(selector, keys)
+		f.byID = f.span != nil
+		return f, nil
+	}
+	f.key, err = keys.encode(query)
+	if err != nil {
+		return f, fmt.Errorf("Failed to encode selector to []byte, %v", err)
+	}
+	return f, nil
+}
+
+//scan calls fn for the record stored under the key or for every record of the span matching the selector
+//in the order of the keys. The records are looked up by an index of a selector field if there is one,
+//otherwise the span is sought with a cursor. Without all of them every record of the bucket is passed to fn.
+//The scan stops with the ctx error as soon as ctx is done.
+func scan(ctx context.Context, bkt *boltBucket, f boltFilter, fn func(k, v []byte) error) error {
+	f = bkt.narrow(f)
+	key, selector := f.key, f.selector
+	if key != nil {
+		v := bkt.Get(key)
+		if v == nil {
+			return nil
+		}
+		return fn(key, v)
+	}
+
+	if keys, ok := bkt.candidates(selector); ok {
+		for _, k := range keys {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			v := bkt.Get(k)
+			if v == nil {
+				continue
+			}
+			ok, err := matchValue(bkt.codec, v, selector)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			err = fn(k, v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	visit := func(k, v []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if v == nil { //nested bucket
+			return nil
+		}
+		if selector != nil {
+			ok, err := matchValue(bkt.codec, v, selector)
+			if err != nil || !ok {
+				return err
+			}
+		}
+		return fn(k, v)
+	}
+	if f.span == nil {
+		return bkt.ForEach(visit)
+	}
+	c := bkt.Cursor()
+	for k, v := f.span.first(c); k != nil; k, v = f.span.next(c) {
+		err := visit(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//matchValue decodes the stored value and checks it against the selector
+func matchValue(codec Codec, data []byte, selector bson.M) (bool, error) {
+	var value interface{}
+	err := decodeValue(codec, data, &value)
+	if err != nil {
+		return false, err
+	}
+	doc, ok := docOf(value)
+	if !ok { //not a document, it has no fields to match
+		doc = bson.M{}
+	}
+	return match(doc, selector)
+}
+
+//keysOf returns copies of the keys matching the selector, nil selector matches every record of the bucket
+func (bc *BoltCollection) keysOf(ctx context.Context, bkt *boltBucket, selector interface{}) ([][]byte, error) {
+	filter, err := parseQuery(selector, bc.keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][]byte
+	err = scan(ctx, bkt, filter, func(k, v []byte) error {
+		keys = append(keys, append([]byte(nil), k...))
+		return nil
+	})
+	return keys, err
+}
+
+//upsertKey returns the key for a record inserted by Upsert, selector documents give their `_id` value
+func (bc *BoltCollection) upsertKey(selector interface{}) ([]byte, error) {
+	filter, err := parseQuery(selector, bc.keys)
+	if err != nil {
+		return nil, err
+	}
+	query := filter.selector
+	if query == nil {
+		if filter.key == nil {
+			return nil, errors.New("Failed to upsert, want a key or a selector with `_id`")
+		}
+		return filter.key, nil
+	}
+
+	id, ok := query["_id"]
+	if ops, isDoc := id.(bson.M); !ok || (isDoc && isOperators(ops)) {
+		return nil, errors.New("Failed to upsert, want a key or a selector with `_id`")
+	}
+	return bc.keys.encode(id)
+}
+
+//boltUpdater writes either a replacement value or the result of update operators
+type boltUpdater struct {
+	doc   interface{} //the replacement, it gets the `_id` of the record
+	value []byte
+	ops   bson.M
+}
+
+func newBoltUpdater(codec Codec, update interface{}) (*boltUpdater, error) {
+	ops, ok, err := updateOperators(update)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return &boltUpdater{ops: ops}, nil
+	}
+
+	value, err := encodeValue(codec, update)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode to []byte, got `%T` as a value, %v", update, err)
+	}
+	return &boltUpdater{doc: update, value: value}, nil
+}
+
+//apply updates the record stored under the key, the record keeps its type if it holds the result
+//and a replacement keeps its `_id`
+func (u *boltUpdater) apply(bkt *boltBucket, key []byte) error {
+	var value interface{}
+	err := decodeValue(bkt.codec, bkt.Get(key), &value)
+	if err != nil {
+		return err
+	}
+	if u.ops == nil {
+		doc, _ := docOf(value)
+		return u.replace(bkt, key, doc)
+	}
+
+	value, err = updateValue(value, u.ops)
+	if err != nil {
+		return err
+	}
+	data, err := encodeValue(bkt.codec, value)
+	if err != nil {
+		return err
+	}
+	return bkt.Put(key, data)
+}
+
+//insert puts a new record for Upsert, a replacement gets the `_id` of the selector
+func (u *boltUpdater) insert(bkt *boltBucket, key []byte, selector interface{}) error {
+	query, _ := selectorOf(selector)
+	if u.ops == nil {
+		return u.replace(bkt, key, query)
+	}
+
+	doc, err := upsertDoc(query)
+	if err != nil {
+		return err
+	}
+	err = applyUpdate(doc, u.ops)
+	if err != nil {
+		return err
+	}
+	data, err := encodeValue(bkt.codec, doc)
+	if err != nil {
+		return err
+	}
+	return bkt.Put(key, data)
+}
+
+//replace puts the replacement holding the `_id` of the document, if it has one
+func (u *boltUpdater) replace(bkt *boltBucket, key []byte, doc bson.M) error {
+	id, ok := doc["_id"]
+	if ops, isDoc := id.(bson.M); !ok || id == nil || (isDoc && isOperators(ops)) {
+		return bkt.Put(key, u.value)
+	}
+	data, err := encodeValue(bkt.codec, withID(u.doc, id))
+	if err != nil {
+		return err
+	}
+	return bkt.Put(key, data)
+}
+
+//bucketAt returns the bucket at the path, nil if it's missing
+func bucketAt(tx *bolt.Tx, path [][]byte) *bolt.Bucket {
+	bkt := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if bkt == nil {
+			return nil
+		}
+		bkt = bkt.Bucket(name)
+	}
+	return bkt
+}
+
+//createBucket returns the bucket at the path creating the missing ones
+func createBucket(tx *bolt.Tx, path [][]byte) (*bolt.Bucket, error) {
+	bkt, err := tx.CreateBucketIfNotExists(path[0])
+	for _, name := range path[1:] {
+		if err != nil {
+			return nil, err
+		}
+		bkt, err = bkt.CreateBucketIfNotExists(name)
+	}
+	return bkt, err
+}
+
+//pathKey names a bucket by its path: a top-level bucket by its name,
+//a nested one by the names ended with 0x00 0x01 like the strings of composite keys
+func pathKey(path [][]byte) []byte {
+	if len(path) == 1 {
+		return path[0]
+	}
+	var key []byte
+	for _, name := range path {
+		key = appendIndexString(key, string(name))
+	}
+	return key
+}
+
+//pathOf returns the path of the bucket named by pathKey
+func pathOf(key []byte) [][]byte {
+	var path [][]byte
+	var name []byte
+	for i := 0; i < len(key); i++ {
+		if key[i] != 0 || i+1 == len(key) {
+			name = append(name, key[i])
+			continue
+		}
+		i++
+		switch key[i] {
+		case 0xff:
+			name = append(name, 0)
+		case 1:
+			path, name = append(path, name), nil
+		default:
+			return [][]byte{key}
+		}
+	}
+	if len(path) < 2 || name != nil {
+		return [][]byte{key}
+	}
+	return path
+}
+
+//nsOf returns the name of the bucket at the path like Mongo's "database.collection"
+func nsOf(path [][]byte) string {
+	return string(bytes.Join(path, []byte(".")))
+}
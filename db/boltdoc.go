@@ -0,0 +1,212 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+var bsonDType = reflect.TypeOf(bson.D{})
+
+//isDocument reports whether Bolt's Insert takes the value as a document rather than a key:
+//bson.D, a map with string keys or a struct with an `_id` field
+func isDocument(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	switch {
+	case !rv.IsValid():
+		return false
+	case rv.Type() == bsonDType:
+		return true
+	case rv.Kind() == reflect.Map:
+		return rv.Type().Key().Kind() == reflect.String
+	case rv.Kind() == reflect.Struct:
+		return idField(rv.Type()) >= 0
+	}
+	return false
+}
+
+//idField returns the index of the exported struct field named `_id` by its bson tag, -1 if there is none
+func idField(t reflect.Type) int {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath == "" && strings.Split(f.Tag.Get("bson"), ",")[0] == "_id" {
+			return i
+		}
+	}
+	return -1
+}
+
+//docID is the `_id` of a document inserted by Bolt
+type docID struct {
+	src       reflect.Value //the document, settable if it was passed by pointer
+	field     int           //the `_id` field of a struct, -1 if it has none
+	value     interface{}
+	generated bool
+}
+
+//idOf reads the `_id` of the document, nil if it's missing or zero
+func idOf(d interface{}) (*docID, error) {
+	rv := reflect.ValueOf(d)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, fmt.Errorf("Failed to insert nil `%T`, want a document", d)
+		}
+		rv = rv.Elem()
+	}
+
+	id := &docID{src: rv, field: -1}
+	switch {
+	case !rv.IsValid():
+		return nil, fmt.Errorf("Failed to insert nil, want a document")
+	case rv.Type() == bsonDType:
+		for _, e := range rv.Interface().(bson.D) {
+			if e.Name == "_id" {
+				id.value = e.Value
+			}
+		}
+	case rv.Kind() == reflect.Map && rv.Type().Key().Kind() == reflect.String:
+		if v := rv.MapIndex(reflect.ValueOf("_id").Convert(rv.Type().Key())); v.IsValid() {
+			id.value = v.Interface()
+		}
+	case rv.Kind() == reflect.Struct && rv.Type() != timeType:
+		id.field = idField(rv.Type())
+		if id.field >= 0 && !rv.Field(id.field).IsZero() {
+			id.value = rv.Field(id.field).Interface()
+		}
+	default:
+		return nil, fmt.Errorf("Failed to insert `%T`, want a document", d)
+	}
+	return id, nil
+}
+
+//generate sets a missing `_id`: a bucket sequence number for an integer field, a bson.ObjectId
+//or its hex form for a string field otherwise
+func (id *docID) generate(bkt *boltBucket) error {
+	if id.value != nil {
+		return nil
+	}
+	t := id.typ()
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		seq, err := bkt.NextSequence()
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(seq))
+		if v.Int() != int64(seq) {
+			return fmt.Errorf("Failed to generate `_id`, the sequence %d overflows `%s`", seq, t)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		seq, err := bkt.NextSequence()
+		if err != nil {
+			return err
+		}
+		v.SetUint(seq)
+		if v.Uint() != seq {
+			return fmt.Errorf("Failed to generate `_id`, the sequence %d overflows `%s`", seq, t)
+		}
+	case reflect.String:
+		if t == objectIDType {
+			v.SetString(string(bson.NewObjectId()))
+		} else {
+			v.SetString(bson.NewObjectId().Hex())
+		}
+	case reflect.Interface:
+		v.Set(reflect.ValueOf(bson.NewObjectId()))
+	default:
+		return fmt.Errorf("Failed to generate `_id` of type `%s`", t)
+	}
+	id.value, id.generated = v.Interface(), true
+	return nil
+}
+
+//typ returns the type of the `_id` value the document can hold
+func (id *docID) typ() reflect.Type {
+	switch {
+	case id.field >= 0:
+		return id.src.Type().Field(id.field).Type
+	case id.src.Kind() == reflect.Map:
+		return id.src.Type().Elem()
+	}
+	return reflect.TypeOf((*interface{})(nil)).Elem()
+}
+
+//withID returns the replacement document holding the `_id` of the record like Mongo keeps it,
+//values which aren't documents are returned as they are. The document is converted to bson.M
+//if its `_id` can't hold the value.
+func withID(d interface{}, value interface{}) interface{} {
+	id, err := idOf(d)
+	if err != nil || equal(id.value, value) {
+		return d
+	}
+	v := reflect.ValueOf(value)
+	t := id.typ()
+	switch {
+	case id.src.Type() == bsonDType && id.value != nil, id.src.Kind() == reflect.Struct && id.field < 0:
+	case v.Type().AssignableTo(t):
+		id.value, id.generated = value, true
+		return id.doc()
+	case isNumber(v) && isNumber(reflect.New(t).Elem()) && v.Convert(t).Convert(v.Type()).Interface() == value:
+		id.value, id.generated = v.Convert(t).Interface(), true
+		return id.doc()
+	}
+	doc, _ := docOf(d)
+	doc["_id"] = value
+	return doc
+}
+
+//doc returns the document to be stored, a copy holding the generated `_id`
+func (id *docID) doc() interface{} {
+	if !id.generated {
+		return id.src.Interface()
+	}
+	switch {
+	case id.field >= 0:
+		doc := reflect.New(id.src.Type()).Elem()
+		doc.Set(id.src)
+		doc.Field(id.field).Set(reflect.ValueOf(id.value))
+		return doc.Interface()
+	case id.src.Type() == bsonDType:
+		return append(bson.D{{Name: "_id", Value: id.value}}, id.src.Interface().(bson.D)...)
+	case id.src.Kind() == reflect.Map:
+		doc := reflect.MakeMapWithSize(id.src.Type(), id.src.Len()+1)
+		iter := id.src.MapRange()
+		for iter.Next() {
+			doc.SetMapIndex(iter.Key(), iter.Value())
+		}
+		doc.SetMapIndex(id.idKey(), reflect.ValueOf(id.value))
+		return doc.Interface()
+	}
+	return id.src.Interface() //a struct without the `_id` field
+}
+
+//writeBack puts the generated `_id` into the document if it can be changed
+func (id *docID) writeBack() {
+	if !id.generated {
+		return
+	}
+	switch {
+	case id.field >= 0:
+		if id.src.CanSet() {
+			id.src.Field(id.field).Set(reflect.ValueOf(id.value))
+		}
+	case id.src.Type() == bsonDType:
+		if id.src.CanSet() {
+			id.src.Set(reflect.ValueOf(id.doc()))
+		}
+	case id.src.Kind() == reflect.Map:
+		if !id.src.IsNil() {
+			id.src.SetMapIndex(id.idKey(), reflect.ValueOf(id.value))
+		}
+	}
+}
+
+func (id *docID) idKey() reflect.Value {
+	return reflect.ValueOf("_id").Convert(id.src.Type().Key())
+}
@@ -0,0 +1,519 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+//indexesBucketName is the top-level bucket keeping the indexes made by EnsureIndex:
+//a nested bucket per indexed bucket (named by indexKey) holds a bucket per index with the definition under "spec"
+//and the "entries" bucket mapping the encoded index values followed by the record key to the record key
+const indexesBucketName = "$indexes"
+
+var (
+	indexSpecKey    = []byte("spec")
+	indexEntriesKey = []byte("entries")
+)
+
+//boltIndexSpec is the stored definition of an index
+type boltIndexSpec struct {
+	Key         []string      `json:"key"`
+	Unique      bool          `json:"unique,omitempty"`
+	Sparse      bool          `json:"sparse,omitempty"`
+	ExpireAfter time.Duration `json:"expireAfter,omitempty"`
+}
+
+//boltIndex is an index of a bucket with the bucket of its entries
+type boltIndex struct {
+	mgo.Index
+	entries *bolt.Bucket
+}
+
+//boltBucket is a bucket of records whose Put and Delete keep the indexes of the bucket up to date
+//in the same transaction, so a write breaking a unique index fails without changes
+type boltBucket struct {
+	*bolt.Bucket
+	path    [][]byte
+	indexes []*boltIndex
+	codec   Codec
+	keys    keyEncoding
+	idKeyed bool //every record with an `_id` is stored under it, see idKeysBucketName
+}
+
+//errNoBucket is returned for a missing bucket
+var errNoBucket = errors.New("No bucket")
+
+//openBucket returns the bucket at the path with its indexes, the records are decoded with the codec of the config
+func openBucket(tx *bolt.Tx, path [][]byte, cfg boltConfig) (*boltBucket, error) {
+	bkt := bucketAt(tx, path)
+	if bkt == nil {
+		return nil, errNoBucket
+	}
+	b := &boltBucket{Bucket: bkt, path: path, codec: cfg.codec, keys: cfg.keys}
+	err := b.loadIDKeyed()
+	if err != nil {
+		return nil, err
+	}
+
+	coll := indexesOf(tx, b.indexKey())
+	if coll == nil {
+		return b, nil
+	}
+	err = coll.ForEach(func(k, v []byte) error {
+		idx, err := loadIndex(coll.Bucket(k), string(k))
+		if err != nil {
+			return err
+		}
+		b.indexes = append(b.indexes, idx)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+//indexesOf returns the bucket keeping the indexes of the bucket named by the index key, nil if it has none
+func indexesOf(tx *bolt.Tx, key []byte) *bolt.Bucket {
+	meta := tx.Bucket([]byte(indexesBucketName))
+	if meta == nil {
+		return nil
+	}
+	return meta.Bucket(key)
+}
+
+//indexKey names the bucket in the indexes bucket
+func (b *boltBucket) indexKey() []byte {
+	return pathKey(b.path)
+}
+
+//ns returns the name of the bucket for the errors like Mongo's "database.collection"
+func (b *boltBucket) ns() string {
+	return nsOf(b.path)
+}
+
+func loadIndex(bkt *bolt.Bucket, name string) (*boltIndex, error) {
+	if bkt == nil {
+		return nil, fmt.Errorf("Broken index `%s`, want a bucket", name)
+	}
+	var spec boltIndexSpec
+	err := json.Unmarshal(bkt.Get(indexSpecKey), &spec)
+	if err != nil {
+		return nil, fmt.Errorf("Broken index `%s`, %v", name, err)
+	}
+	entries := bkt.Bucket(indexEntriesKey)
+	if entries == nil {
+		return nil, fmt.Errorf("Broken index `%s`, no entries", name)
+	}
+	return &boltIndex{
+		Index: mgo.Index{
+			Key:         spec.Key,
+			Unique:      spec.Unique,
+			Sparse:      spec.Sparse,
+			ExpireAfter: spec.ExpireAfter,
+			Name:        name,
+		},
+		entries: entries,
+	}, nil
+}
+
+//Put stores the record and replaces its index entries
+func (b *boltBucket) Put(key, value []byte) error {
+	return b.put(key, value, false)
+}
+
+//putByID stores the record under its `_id`
+func (b *boltBucket) putByID(key, value []byte) error {
+	return b.put(key, value, true)
+}
+
+func (b *boltBucket) put(key, value []byte, byID bool) error {
+	checkID := b.idKeyed && !byID
+	if len(b.indexes) == 0 && !checkID {
+		return b.Bucket.Put(key, value)
+	}
+
+	doc, err := b.recordDoc(value)
+	if err != nil {
+		return err
+	}
+	if checkID {
+		err := b.checkIDKey(key, doc)
+		if err != nil {
+			return err
+		}
+	}
+	if len(b.indexes) == 0 {
+		return b.Bucket.Put(key, value)
+	}
+	for _, idx := range b.indexes {
+		err := b.checkUnique(idx, doc, key)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.deleteEntries(key)
+	if err != nil {
+		return err
+	}
+	for _, idx := range b.indexes {
+		err := idx.putEntries(doc, key)
+		if err != nil {
+			return err
+		}
+	}
+	return b.Bucket.Put(key, value)
+}
+
+//Delete removes the record with its index entries
+func (b *boltBucket) Delete(key []byte) error {
+	err := b.deleteEntries(key)
+	if err != nil {
+		return err
+	}
+	return b.Bucket.Delete(key)
+}
+
+//checkUnique fails with a duplicate key error if a unique index has the values of the document for another record
+func (b *boltBucket) checkUnique(idx *boltIndex, doc bson.M, key []byte) error {
+	if !idx.Unique || doc == nil {
+		return nil
+	}
+	c := idx.entries.Cursor()
+	for _, entry := range indexEntries(doc, idx.Index) {
+		for k, _ := c.Seek(entry); k != nil && bytes.HasPrefix(k, entry); k, _ = c.Next() {
+			if !bytes.Equal(k[len(entry):], key) {
+				return dupError(b.ns(), idx.Name, indexValues(doc, idx.Index)...)
+			}
+		}
+	}
+	return nil
+}
+
+//deleteEntries removes the index entries of the stored record
+func (b *boltBucket) deleteEntries(key []byte) error {
+	if len(b.indexes) == 0 {
+		return nil
+	}
+	old := b.Bucket.Get(key)
+	if old == nil {
+		return nil
+	}
+	doc, err := b.recordDoc(old)
+	if err != nil || doc == nil {
+		return err
+	}
+	for _, idx := range b.indexes {
+		for _, entry := range indexEntries(doc, idx.Index) {
+			err := idx.entries.Delete(append(entry, key...))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (idx *boltIndex) putEntries(doc bson.M, key []byte) error {
+	if doc == nil {
+		return nil
+	}
+	for _, entry := range indexEntries(doc, idx.Index) {
+		err := idx.entries.Put(append(entry, key...), key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ensureIndex creates the index and its entries for the stored records unless the index exists
+func (b *boltBucket) ensureIndex(index mgo.Index) error {
+	meta, err := b.Tx().CreateBucketIfNotExists([]byte(indexesBucketName))
+	if err != nil {
+		return err
+	}
+	coll, err := meta.CreateBucketIfNotExists(b.indexKey())
+	if err != nil {
+		return err
+	}
+	if existing := coll.Bucket([]byte(index.Name)); existing != nil {
+		idx, err := loadIndex(existing, index.Name)
+		if err != nil {
+			return err
+		}
+		if !sameIndex(idx.Index, index) {
+			return fmt.Errorf("Index with name: %s already exists with different options", index.Name)
+		}
+		return nil
+	}
+
+	spec, err := json.Marshal(boltIndexSpec{Key: index.Key, Unique: index.Unique, Sparse: index.Sparse, ExpireAfter: index.ExpireAfter})
+	if err != nil {
+		return err
+	}
+	bkt, err := coll.CreateBucket([]byte(index.Name))
+	if err != nil {
+		return err
+	}
+	err = bkt.Put(indexSpecKey, spec)
+	if err != nil {
+		return err
+	}
+	entries, err := bkt.CreateBucket(indexEntriesKey)
+	if err != nil {
+		return err
+	}
+
+	idx := &boltIndex{Index: index, entries: entries}
+	err = b.fill(idx)
+	if err != nil {
+		return err
+	}
+	b.indexes = append(b.indexes, idx)
+	return nil
+}
+
+//rebuildIndexes replaces the entries of the indexes with the ones made from the stored records
+func (b *boltBucket) rebuildIndexes() error {
+	coll := indexesOf(b.Tx(), b.indexKey())
+	for _, idx := range b.indexes {
+		bkt := coll.Bucket([]byte(idx.Name))
+		err := bkt.DeleteBucket(indexEntriesKey)
+		if err != nil {
+			return err
+		}
+		idx.entries, err = bkt.CreateBucket(indexEntriesKey)
+		if err != nil {
+			return err
+		}
+		err = b.fill(idx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//fill puts the entries of the stored records to the empty index
+func (b *boltBucket) fill(idx *boltIndex) error {
+	return b.Bucket.ForEach(func(k, v []byte) error {
+		if v == nil { //nested bucket
+			return nil
+		}
+		doc, err := b.recordDoc(v)
+		if err != nil {
+			return err
+		}
+		key := append([]byte(nil), k...)
+		err = b.checkUnique(idx, doc, key)
+		if err != nil {
+			return err
+		}
+		return idx.putEntries(doc, key)
+	})
+}
+
+//recordDoc returns the stored record as a document, nil for the records which aren't documents
+func (b *boltBucket) recordDoc(data []byte) (bson.M, error) {
+	var value interface{}
+	err := decodeValue(b.codec, data, &value)
+	if err != nil {
+		return nil, err
+	}
+	doc, _ := docOf(value)
+	return doc, nil
+}
+
+//candidates returns the sorted keys of the records which may match the selector found with an index,
+//ok is false if no index can be used. The index is chosen by a top-level field of the selector compared by
+//equality, $eq or $in with the first field of the index, or else by a $gt, $gte, $lt or $lte bound.
+//The records still have to be matched against the whole selector.
+func (b *boltBucket) candidates(selector bson.M) (keys [][]byte, ok bool) {
+	var plan *indexScan
+	for field, cond := range selector {
+		if strings.HasPrefix(field, "$") {
+			continue
+		}
+		scan, ok := scanOf(cond)
+		if !ok {
+			continue
+		}
+		for _, idx := range b.indexes {
+			if indexField(idx.Key[0]) != field || (idx.Sparse && scan.null) {
+				continue
+			}
+			if plan == nil || (plan.values == nil && scan.values != nil) {
+				scan.idx = idx
+				plan = scan
+			}
+			break
+		}
+	}
+	if plan == nil {
+		return nil, false
+	}
+
+	seen := map[string]bool{}
+	add := func(key []byte) {
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			keys = append(keys, append([]byte(nil), key...))
+		}
+	}
+	c := plan.idx.entries.Cursor()
+	if plan.values != nil {
+		for _, v := range plan.values {
+			prefix := appendIndexValue(nil, v)
+			for k, key := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, key = c.Next() {
+				add(key)
+			}
+		}
+	} else {
+		k, key := c.Seek([]byte{plan.tag})
+		if plan.lower {
+			k, key = c.Seek(plan.bound)
+		}
+		for ; k != nil && k[0] == plan.tag; k, key = c.Next() {
+			cmp := compareEntry(k, plan.bound)
+			if plan.lower && !plan.inclusive && cmp == 0 {
+				continue
+			}
+			if !plan.lower && (cmp > 0 || (cmp == 0 && !plan.inclusive)) {
+				break
+			}
+			add(key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	return keys, true
+}
+
+//indexScan describes the entries of an index to be read for a selector condition,
+//either the entries of the values or the entries of a type from or up to the bound
+type indexScan struct {
+	idx       *boltIndex
+	values    []interface{}
+	null      bool //the condition matches null, so the records missing the field are needed
+	tag       byte //the first byte of the encoded values of the bound's type
+	bound     []byte
+	lower     bool
+	inclusive bool
+}
+
+//scanOf returns the scan of the index entries for a condition of a field, ok is false if the index can't help
+func scanOf(cond interface{}) (scan *indexScan, ok bool) {
+	ops, isDoc := cond.(bson.M)
+	if !isDoc || !isOperators(ops) {
+		return valuesScan([]interface{}{cond})
+	}
+	if v, ok := ops["$eq"]; ok {
+		return valuesScan([]interface{}{v})
+	}
+	if in, ok := ops["$in"].([]interface{}); ok {
+		return valuesScan(in)
+	}
+
+	for _, op := range []string{"$gte", "$gt", "$lte", "$lt"} {
+		v, ok := ops[op]
+		if !ok {
+			continue
+		}
+		switch v.(type) {
+		case nil, bson.M, []interface{}:
+			return nil, false
+		}
+		bound := appendIndexValue(nil, v)
+		return &indexScan{
+			tag:       bound[0],
+			bound:     bound,
+			lower:     op == "$gte" || op == "$gt",
+			inclusive: op == "$gte" || op == "$lte",
+		}, true
+	}
+	return nil, false
+}
+
+//valuesScan reads the entries of the values, arrays are matched by Mongo as a whole or by elements, so they aren't looked up
+func valuesScan(values []interface{}) (*indexScan, bool) {
+	scan := &indexScan{values: values}
+	for _, v := range values {
+		switch v.(type) {
+		case []interface{}:
+			return nil, false
+		case nil:
+			scan.null = true
+		}
+	}
+	return scan, true
+}
+
+//compareEntry compares the first value of an index entry with an encoded value
+func compareEntry(entry, value []byte) int {
+	if bytes.HasPrefix(entry, value) {
+		return 0
+	}
+	return bytes.Compare(entry, value)
+}
+
+//idKeysBucketName is the bucket nested in the meta bucket listing the buckets (by indexKey) which keep every record
+//having an `_id` under the encoded `_id`, so the `_id` conditions of the selectors are sought by the keys.
+//A bucket is listed by the first write while it's empty and left out once a record is put under another key,
+//e.g. by Insert(key, value) of a document with an `_id`; the other buckets are scanned.
+var idKeysBucketName = []byte("idkeys")
+
+//loadIDKeyed reads whether the bucket is listed as keyed by `_id`, an empty bucket is listed by a write
+func (b *boltBucket) loadIDKeyed() error {
+	tx := b.Tx()
+	meta := tx.Bucket([]byte(metaBucketName))
+	if meta != nil {
+		if ids := meta.Bucket(idKeysBucketName); ids != nil && ids.Get(b.indexKey()) != nil {
+			b.idKeyed = true
+			return nil
+		}
+	}
+	if !tx.Writable() || !b.keys.ordered || bucketHasRecords(b.Bucket) {
+		return nil
+	}
+
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+	if err != nil {
+		return err
+	}
+	ids, err := meta.CreateBucketIfNotExists(idKeysBucketName)
+	if err != nil {
+		return err
+	}
+	b.idKeyed = true
+	return ids.Put(b.indexKey(), []byte{1})
+}
+
+//checkIDKey leaves the bucket out of the ones keyed by `_id` if the record has an `_id` stored under another key
+func (b *boltBucket) checkIDKey(key []byte, doc bson.M) error {
+	id, ok := doc["_id"]
+	if !ok || id == nil {
+		return nil
+	}
+	if enc, err := b.keys.encode(id); err == nil && bytes.Equal(enc, key) {
+		return nil
+	}
+	b.idKeyed = false
+	return b.Tx().Bucket([]byte(metaBucketName)).Bucket(idKeysBucketName).Delete(b.indexKey())
+}
+
+//narrow drops the span of the `_id` conditions of the filter unless the bucket is keyed by `_id`
+func (b *boltBucket) narrow(f boltFilter) boltFilter {
+	if f.byID && !b.idKeyed {
+		f.span, f.byID = nil, false
+	}
+	return f
+}
@@ -0,0 +1,363 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/globalsign/mgo/bson"
+)
+
+//Codec marshals the values of the Bolt records, it's chosen on Connect with db.WithCodec
+type Codec interface {
+	//Name is stored in the db, so the file opened later is read with the same codec
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	//Unmarshal decodes data into the value pointed by v. Records are read into an interface{} value,
+	//which has to be a document (a struct, a map or bson.M) for the documents to be matched by the selectors.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+//GobCodec stores the values with encoding/gob along with their Go types, it's the default codec.
+//Documents are also stored in bson, so a process which hasn't registered their Go type yet
+//matches them by the selectors and reads them into interface{} values as bson.M.
+type GobCodec struct{}
+
+//gobRecord is a record of GobCodec: the value encoded as an interface value and the bson form of a document
+type gobRecord struct {
+	Value []byte
+	Doc   []byte
+}
+
+//Name returns "gob"
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+//Marshal encodes v as an interface value, so a record can be decoded without knowing its type,
+//along with the bson form of a document
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.IsValid() {
+		err := registerType(rv.Type())
+		if err != nil {
+			return nil, err
+		}
+		err = register(rv)
+		if err != nil {
+			return nil, err
+		}
+	}
+	value, err := encode(&v)
+	if err != nil {
+		return nil, err
+	}
+	rec := gobRecord{Value: value}
+	if _, isDoc := docOf(v); isDoc {
+		rec.Doc, err = bson.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return encode(&rec)
+}
+
+//Unmarshal decodes the value written by Marshal into the value pointed by v. A document of a Go type
+//unknown to gob is read from its bson form. Records written before the bson form was kept are plain interface values.
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	var rec gobRecord
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec)
+	if err != nil || rec.Value == nil {
+		rec = gobRecord{Value: data}
+	}
+
+	var value interface{}
+	err = gob.NewDecoder(bytes.NewReader(rec.Value)).Decode(&value)
+	if err != nil {
+		if rec.Doc == nil {
+			return err
+		}
+		doc := bson.M{}
+		if bson.Unmarshal(rec.Doc, doc) != nil {
+			return err
+		}
+		value = doc
+	}
+	return assign(value, v)
+}
+
+//JSONCodec stores the values as Mongo extended JSON readable by other tools.
+//Documents are written with their bson field names, so bson tags are kept.
+//Numbers are read back as float64 except int64 values, which are stored as {"$numberLong": ...}.
+type JSONCodec struct{}
+
+//Name returns "json"
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+//Marshal encodes v with bson.MarshalJSON, documents are converted to bson.M first
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	if doc, ok := docOf(v); ok {
+		v = doc
+	}
+	data, err := bson.MarshalJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(data, []byte("\n")), nil
+}
+
+//Unmarshal decodes the JSON with bson.UnmarshalJSON, objects are read as bson.M
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	var value interface{}
+	err := bson.UnmarshalJSON(data, &value)
+	if err != nil {
+		return err
+	}
+	if m, ok := value.(map[string]interface{}); ok {
+		if doc, ok := docOf(m); ok {
+			value = doc
+		}
+	}
+	return assign(value, v)
+}
+
+//BSONCodec stores the values as bson documents like Mongo does, values which aren't documents can't be stored
+type BSONCodec struct{}
+
+//Name returns "bson"
+func (BSONCodec) Name() string {
+	return "bson"
+}
+
+//Marshal encodes the document with bson.Marshal
+func (BSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return bson.Marshal(v)
+}
+
+//Unmarshal decodes the document with bson.Unmarshal, an interface{} value gets bson.M
+func (BSONCodec) Unmarshal(data []byte, v interface{}) error {
+	if p, ok := v.(*interface{}); ok {
+		doc := bson.M{}
+		err := bson.Unmarshal(data, doc)
+		if err != nil {
+			return err
+		}
+		*p = doc
+		return nil
+	}
+	return bson.Unmarshal(data, v)
+}
+
+var codecs = struct {
+	sync.RWMutex
+	byName map[string]Codec
+}{byName: map[string]Codec{
+	"gob":  GobCodec{},
+	"json": JSONCodec{},
+	"bson": BSONCodec{},
+}}
+
+//RegisterCodec makes a custom codec known by its name, so the db files written with it can be opened without db.WithCodec.
+//A codec with the same name is replaced. The gob, JSON and BSON codecs are registered by the package.
+func RegisterCodec(c Codec) {
+	if c == nil || c.Name() == "" {
+		panic("db: RegisterCodec wants a codec with a non-empty name")
+	}
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byName[c.Name()] = c
+}
+
+func codecByName(name string) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.byName[name]
+	return c, ok
+}
+
+//metaBucketName is the top-level bucket keeping the settings of the db file, the codec name is stored under "codec"
+const metaBucketName = "$meta"
+
+var metaCodecKey = []byte("codec")
+
+//codecOf returns the codec of the db file: the stored one or, for a new file, the requested one (gob by default).
+//A requested codec has to match the stored one. Files written before the codec was stored hold gob records.
+//The name of the codec is stored unless the transaction is read-only.
+func codecOf(tx *bolt.Tx, requested Codec) (Codec, error) {
+	var stored string
+	if meta := tx.Bucket([]byte(metaBucketName)); meta != nil {
+		stored = string(meta.Get(metaCodecKey))
+	}
+	if stored == "" && hasRecords(tx) {
+		stored = GobCodec{}.Name()
+	}
+
+	codec := requested
+	switch {
+	case stored != "" && requested != nil && requested.Name() != stored:
+		return nil, fmt.Errorf("Failed to use codec `%s`, the db is written with `%s`", requested.Name(), stored)
+	case stored != "" && requested == nil:
+		c, ok := codecByName(stored)
+		if !ok {
+			return nil, fmt.Errorf("Unknown codec `%s` of the db, pass it with db.WithCodec or register it with db.RegisterCodec", stored)
+		}
+		codec = c
+	case requested == nil:
+		codec = GobCodec{}
+	}
+
+	if !tx.Writable() {
+		return codec, nil
+	}
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+	if err != nil {
+		return nil, err
+	}
+	err = meta.Put(metaCodecKey, []byte(codec.Name()))
+	if err != nil {
+		return nil, err
+	}
+	return codec, nil
+}
+
+//hasRecords reports whether any bucket of records, including the nested collection buckets, isn't empty
+func hasRecords(tx *bolt.Tx) bool {
+	found := false
+	tx.ForEach(func(name []byte, bkt *bolt.Bucket) error {
+		switch string(name) {
+		case metaBucketName, indexesBucketName:
+			return nil
+		}
+		found = bucketHasRecords(bkt)
+		if found {
+			return errStop
+		}
+		return nil
+	})
+	return found
+}
+
+func bucketHasRecords(bkt *bolt.Bucket) bool {
+	c := bkt.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v != nil || bucketHasRecords(bkt.Bucket(k)) {
+			return true
+		}
+	}
+	return false
+}
+
+//encodeValue marshals the value v points to with the codec, nil values can't be stored
+func encodeValue(codec Codec, v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, errors.New("Failed to encode nil pointer")
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return nil, errors.New("Failed to encode nil value")
+	}
+	return codec.Marshal(rv.Interface())
+}
+
+//decodeValue unmarshals a record into the value pointed by result, the record is read as an interface{} value
+//and converted to the result type by the bson rules if needed. The type of the result is made known to gob.
+func decodeValue(codec Codec, data []byte, result interface{}) error {
+	if t := reflect.TypeOf(result); t != nil && t.Kind() == reflect.Ptr {
+		err := registerType(t.Elem())
+		if err != nil {
+			return err
+		}
+	}
+
+	var value interface{}
+	err := codec.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	return assign(value, result)
+}
+
+//register makes the types of the value and of its nested interface values known to gob,
+//so they can be transferred as interface values
+func register(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Kind() == reflect.Interface {
+			err := registerType(v.Elem().Type())
+			if err != nil {
+				return err
+			}
+		}
+		return register(v.Elem())
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			err := register(iter.Key())
+			if err == nil {
+				err = register(iter.Value())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		switch v.Type().Elem().Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+			for i := 0; i < v.Len(); i++ {
+				err := register(v.Index(i))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Struct:
+		if v.Type().Implements(gobEncoderType) || reflect.PtrTo(v.Type()).Implements(gobEncoderType) {
+			return nil
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" { //gob transfers exported fields only
+				err := register(v.Field(i))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+var gobEncoderType = reflect.TypeOf((*gob.GobEncoder)(nil)).Elem()
+
+//registerType makes a type known to gob. A type registered by the user under another name keeps it,
+//a name taken by another type is an error.
+func registerType(t reflect.Type) (err error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Interface {
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			msg := fmt.Sprint(r)
+			if !strings.HasPrefix(msg, "gob: registering duplicate names") {
+				err = fmt.Errorf("Failed to register `%s` with gob, %s", t, msg)
+			}
+		}
+	}()
+	gob.Register(reflect.Zero(t).Interface())
+	return nil
+}
@@ -7,6 +7,22 @@
 */
 package db
 
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+//ErrNotFound - ошибка, возвращаемая при отсутствии искомого документа; совпадает с mgo.ErrNotFound,
+//поэтому проверка err == db.ErrNotFound работает для любой реализации
+var ErrNotFound = mgo.ErrNotFound
+
+//ErrTransactionsUnsupported - ошибка WithTransaction для Монго: драйвер globalsign/mgo не поддерживает
+//многодокументные транзакции, поэтому функция транзакции не вызывается
+var ErrTransactionsUnsupported = errors.New("Transactions are not supported by the mgo driver")
+
 //New - экспортируемая функция-обёртка, для упрощения создания переменной интерфейсного типа
 func New(self Handler) Handler {
 	return self
@@ -32,6 +48,11 @@ type Querier interface {
 	Upsert(selector interface{}, update interface{}) (num int, err error)
 
 	Find(query interface{}) Refiner //Метод позволяет уточнить и разобрать полученные данные
+	Pipe(pipeline interface{}) Piper //Метод запускает конвейер агрегации, например []bson.M{{"$match": ...}, {"$group": ...}}
+
+	EnsureIndex(keys []string, unique, sparse bool, ttl time.Duration) error //Метод создаёт индекс по полям keys, "-field" - по убыванию
+	DropIndex(keys ...string) error                                          //Метод удаляет индекс, созданный по полям keys
+	Indexes() (indexes []mgo.Index, err error)                               //Метод возвращает индексы коллекции, отсортированные по имени
 }
 
 //Refiner - набор методов для уточнения запроса
@@ -40,4 +61,77 @@ type Refiner interface {
 	All(results interface{}) error                 //All принимает в качестве параметра ссылку на слайс структур для анмаршалинга
 	Distinct(key string, result interface{}) error //Distinct распаковывает в result значения, полученные по ключу key
 	Count() (num int, err error)
+
+	Sort(fields ...string) Refiner          //Sort задаёт порядок документов, "-field" - по убыванию
+	Limit(n int) Refiner                   //Limit ограничивает число документов, 0 - без ограничения
+	Skip(n int) Refiner                    //Skip пропускает первые n документов
+	Select(projection interface{}) Refiner //Select оставляет в документах поля проекции, например bson.M{"name": 1}
+
+	Iter() Iterator //Iter возвращает итератор для чтения документов по одному, без загрузки всего результата в память
+}
+
+//Piper - набор методов для чтения результата конвейера агрегации
+type Piper interface {
+	One(result interface{}) error  //One распаковывает в result первый документ результата
+	All(results interface{}) error //All распаковывает в слайс results все документы результата
+	Iter() Iterator                //Iter возвращает итератор по документам результата
+}
+
+//Iterator - итератор по документам запроса:
+//	iter := handler.ExecOn("collection").Find(nil).Iter()
+//	for iter.Next(&doc) {
+//		...
+//	}
+//	if err := iter.Close(); err != nil {
+//		...
+//	}
+type Iterator interface {
+	Next(result interface{}) bool //Next распаковывает следующий документ в result, false - документы закончились или ошибка
+	Err() error                   //Err возвращает ошибку итерации
+	Close() error                 //Close освобождает ресурсы итератора и возвращает ошибку итерации
+}
+
+//ContextHandler - Handler с поддержкой context.Context; реализации проверяют, что контекст не отменён,
+//и ограничивают операцию его дедлайном
+type ContextHandler interface {
+	Handler
+	ConnectContext(ctx context.Context, resources ...interface{}) error
+}
+
+//ContextQuerier - Querier с поддержкой context.Context, возвращается из ExecOn всех реализаций:
+//	q := handler.ExecOn("collection").(db.ContextQuerier)
+type ContextQuerier interface {
+	Querier
+	InsertContext(ctx context.Context, docs ...interface{}) error
+	RemoveContext(ctx context.Context, selector interface{}) error
+	RemoveAllContext(ctx context.Context, selector interface{}) (num int, err error)
+	UpdateContext(ctx context.Context, selector interface{}, update interface{}) error
+	UpdateAllContext(ctx context.Context, selector interface{}, update interface{}) (num int, err error)
+	UpsertContext(ctx context.Context, selector interface{}, update interface{}) (num int, err error)
+}
+
+//ContextRefiner - Refiner с поддержкой context.Context, возвращается из Find всех реализаций
+type ContextRefiner interface {
+	Refiner
+	OneContext(ctx context.Context, result interface{}) error
+	AllContext(ctx context.Context, results interface{}) error
+	DistinctContext(ctx context.Context, key string, result interface{}) error
+	CountContext(ctx context.Context) (num int, err error)
+}
+
+//Transactor - Handler с поддержкой транзакций; WithTransaction вызывает fn и применяет все записи, сделанные через tx,
+//только если fn вернула nil, иначе записи откатываются, а ошибка fn возвращается:
+//	err := handler.(db.Transactor).WithTransaction(func(tx db.Tx) error {
+//		if err := tx.ExecOn("orders").Insert(order); err != nil {
+//			return err
+//		}
+//		return tx.ExecOn("stock").Update(bson.M{"_id": item}, bson.M{"$inc": bson.M{"count": -1}})
+//	})
+type Transactor interface {
+	WithTransaction(fn func(tx Tx) error) error
+}
+
+//Tx - транзакция, внутри fn все операции выполняются через коллекции, полученные от tx
+type Tx interface {
+	ExecOn(resources ...interface{}) Querier
 }
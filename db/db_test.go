@@ -1,9 +1,22 @@
 package db_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
+	boltdb "github.com/boltdb/bolt"
 	"github.com/stretchr/testify/assert"
 	"github.com/zaffka/mongodb-boltdb-mock/db"
 
@@ -286,6 +299,166 @@ func TestMock(t *testing.T) {
 
 }
 
+func TestMemory(t *testing.T) {
+	memory := db.New(&db.Memory{})
+	err := memory.Connect("app")
+	assert.NoError(t, err)
+	defer memory.Close()
+
+	sess := memory.Copy()
+	defer sess.Close()
+
+	id := bson.NewObjectId()
+	users := sess.ExecOn("users")
+
+	t.Run("Insert", func(t *testing.T) {
+		err := users.Insert(bson.M{"_id": id, "name": "ann", "age": 20}, &boltDoc{Name: "bob", Age: 30}, bson.M{"name": "cid", "age": 40})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Insert w duplicate id", func(t *testing.T) {
+		err := users.Insert(bson.M{"_id": id, "name": "dup"})
+		assert.True(t, mgo.IsDup(err))
+	})
+
+	t.Run("Insert writes the generated id back", func(t *testing.T) {
+		coll := sess.ExecOn("generated")
+		ann, bob := &boltUser{Name: "ann"}, bson.M{"name": "bob"}
+		cid, dan := boltUser{Name: "cid"}, map[string]string{"name": "dan"}
+		assert.NoError(t, coll.Insert(ann, bob, cid, dan))
+		assert.True(t, ann.ID.Valid())
+		assert.IsType(t, bson.ObjectId(""), bob["_id"])
+		assert.Empty(t, cid.ID, "a struct passed by value can't be changed")
+		assert.Len(t, dan["_id"], 24, "a string gets the hex form")
+
+		var doc boltUser
+		assert.NoError(t, coll.Find(ann.ID).One(&doc))
+		assert.Equal(t, *ann, doc)
+		var res bson.M
+		assert.NoError(t, coll.Find(bson.M{"_id": bob["_id"]}).One(&res))
+		assert.Equal(t, "bob", res["name"])
+		assert.NoError(t, coll.Find(bson.M{"_id": dan["_id"]}).One(&res))
+		assert.Equal(t, "dan", res["name"])
+	})
+
+	t.Run("Copies share the data", func(t *testing.T) {
+		num, err := memory.ExecOn("app", "users").Find(nil).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 3, num)
+
+		num, err = memory.ExecOn("other", "users").Find(nil).Count()
+		assert.NoError(t, err)
+		assert.Zero(t, num)
+	})
+
+	t.Run("Find one", func(t *testing.T) {
+		var res bson.M
+		err := users.Find(id).One(&res)
+		assert.NoError(t, err)
+		assert.Equal(t, "ann", res["name"])
+
+		var doc boltDoc
+		err = users.Find(bson.M{"age": bson.M{"$gt": 25}, "name": "bob"}).One(&doc)
+		assert.NoError(t, err)
+		assert.Equal(t, 30, doc.Age)
+
+		err = users.Find(bson.M{"name": "nobody"}).One(&doc)
+		assert.Equal(t, db.ErrNotFound, err)
+	})
+
+	t.Run("Results are copies", func(t *testing.T) {
+		var res bson.M
+		err := users.Find(id).One(&res)
+		assert.NoError(t, err)
+		res["name"] = "changed"
+
+		err = users.Find(id).One(&res)
+		assert.NoError(t, err)
+		assert.Equal(t, "ann", res["name"])
+	})
+
+	t.Run("Find all, distinct and count", func(t *testing.T) {
+		var docs []boltDoc
+		err := users.Find(bson.M{"age": bson.M{"$gte": 30}}).All(&docs)
+		assert.NoError(t, err)
+		assert.Len(t, docs, 2)
+
+		var names []string
+		err = users.Find(nil).Distinct("name", &names)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"ann", "bob", "cid"}, names)
+
+		num, err := users.Find(bson.M{"name": bson.M{"$in": []string{"ann", "cid"}}}).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, num)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		err := users.Update(bson.M{"name": "ann"}, bson.M{"$inc": bson.M{"age": 1}})
+		assert.NoError(t, err)
+
+		err = users.Update(id, bson.M{"name": "ann", "replaced": true})
+		assert.NoError(t, err)
+
+		var res bson.M
+		err = users.Find(id).One(&res)
+		assert.NoError(t, err)
+		assert.Equal(t, bson.M{"_id": id, "name": "ann", "replaced": true}, res)
+
+		err = users.Update(bson.M{"name": "nobody"}, bson.M{"$set": bson.M{"age": 1}})
+		assert.Equal(t, db.ErrNotFound, err)
+
+		err = users.Update(id, bson.M{"$set": bson.M{"_id": "other"}})
+		assert.EqualError(t, err, "Failed to update, the `_id` field can't be modified")
+
+		err = users.Update(id, bson.M{"_id": "other", "name": "ann"})
+		assert.EqualError(t, err, "Failed to update, the `_id` field can't be modified")
+
+		err = users.Update(id, bson.M{"_id": id, "name": "ann", "replaced": true})
+		assert.NoError(t, err, "the same _id may be repeated in the replacement")
+	})
+
+	t.Run("Update all", func(t *testing.T) {
+		num, err := users.UpdateAll(bson.M{"age": bson.M{"$exists": true}}, bson.M{"$set": bson.M{"adult": true}})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, num)
+
+		_, err = users.UpdateAll(nil, bson.M{"name": "replacement"})
+		assert.Error(t, err)
+	})
+
+	t.Run("Upsert", func(t *testing.T) {
+		num, err := users.Upsert(bson.M{"name": "dan"}, bson.M{"$set": bson.M{"age": 50}})
+		assert.NoError(t, err)
+		assert.Zero(t, num)
+
+		var res bson.M
+		err = users.Find(bson.M{"name": "dan"}).One(&res)
+		assert.NoError(t, err)
+		assert.Equal(t, 50, res["age"])
+		assert.IsType(t, bson.ObjectId(""), res["_id"])
+
+		num, err = users.Upsert(bson.M{"name": "dan"}, bson.M{"$set": bson.M{"age": 51}})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, num)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		err := users.Remove(id)
+		assert.NoError(t, err)
+
+		err = users.Remove(id)
+		assert.Equal(t, db.ErrNotFound, err)
+
+		num, err := users.RemoveAll(bson.M{"age": bson.M{"$gte": 40}})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, num)
+
+		num, _ = users.Find(nil).Count()
+		assert.Equal(t, 1, num)
+	})
+}
+
 func TestBoltDB(t *testing.T) {
 
 	bolt := db.New(&db.Bolt{})
@@ -330,6 +503,157 @@ func TestBoltDB(t *testing.T) {
 		t.Logf("Result: %v", res)
 	})
 
+	t.Run("Read all from bucket", func(t *testing.T) {
+		var res []db.Mock
+		err := bolt.ExecOn("bucketOne").Find(nil).All(&res)
+		assert.NoError(t, err)
+		assert.Len(t, res, 1)
+		assert.Equal(t, "test", res[0].Msg)
+	})
+
+	t.Run("Read all by key", func(t *testing.T) {
+		res := []db.Mock{{Msg: "stale"}}
+		err := bolt.ExecOn("bucketOne").Find("key").All(&res)
+		assert.NoError(t, err)
+		assert.Equal(t, []db.Mock{{Msg: "test"}}, res)
+	})
+
+	t.Run("Read all w non-slice result", func(t *testing.T) {
+		var res db.Mock
+		err := bolt.ExecOn("bucketOne").Find(nil).All(&res)
+		assert.Error(t, err)
+	})
+
+	t.Run("Read into a map", func(t *testing.T) {
+		var res bson.M
+		err := bolt.ExecOn("bucketOne").Find("key").One(&res)
+		assert.NoError(t, err)
+		assert.Equal(t, "test", res["msg"])
+	})
+
+	t.Run("Count", func(t *testing.T) {
+		for i, mode := range []int{1, 2, 2} {
+			err := bolt.ExecOn("bucketTwo").Insert(i, &db.Mock{Msg: "count", Mode: mode})
+			assert.NoError(t, err)
+		}
+		err := bolt.ExecOn("bucketTwo").Insert("map", bson.M{"mode": 3, "nested": bson.M{"tags": []string{"a", "b"}}})
+		assert.NoError(t, err)
+
+		num, err := bolt.ExecOn("bucketTwo").Find(nil).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 4, num)
+
+		num, err = bolt.ExecOn("bucketTwo").Find(1).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, num)
+
+		num, err = bolt.ExecOn("bucketTwo").Find("nokey").Count()
+		assert.NoError(t, err)
+		assert.Zero(t, num)
+	})
+
+	t.Run("Distinct", func(t *testing.T) {
+		var modes []int
+		err := bolt.ExecOn("bucketTwo").Find(nil).Distinct("mode", &modes)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []int{1, 2, 3}, modes)
+
+		var msgs []string
+		err = bolt.ExecOn("bucketTwo").Find(nil).Distinct("msg", &msgs)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"count"}, msgs)
+	})
+
+	t.Run("Distinct w dotted path", func(t *testing.T) {
+		var tags []string
+		err := bolt.ExecOn("bucketTwo").Find(nil).Distinct("nested.tags", &tags)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a", "b"}, tags)
+	})
+
+	t.Run("Read first w nil query", func(t *testing.T) {
+		var res db.Mock
+		err := bolt.ExecOn("bucketOne").Find(nil).One(&res)
+		assert.NoError(t, err)
+		assert.Equal(t, "test", res.Msg)
+	})
+
+	t.Run("Read unexisted key", func(t *testing.T) {
+		var res db.Mock
+		err := bolt.ExecOn("bucketOne").Find("nokey").One(&res)
+		assert.Equal(t, db.ErrNotFound, err)
+	})
+
+	t.Run("Remove unexisted key", func(t *testing.T) {
+		err := bolt.ExecOn("bucketOne").Remove("nokey")
+		assert.Equal(t, db.ErrNotFound, err)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		err := bolt.ExecOn("bucketOne").Update("key", &db.Mock{Msg: "updated"})
+		assert.NoError(t, err)
+
+		var res db.Mock
+		err = bolt.ExecOn("bucketOne").Find("key").One(&res)
+		assert.NoError(t, err)
+		assert.Equal(t, "updated", res.Msg)
+	})
+
+	t.Run("Update unexisted key", func(t *testing.T) {
+		err := bolt.ExecOn("bucketOne").Update("nokey", &db.Mock{Msg: "updated"})
+		assert.Equal(t, db.ErrNotFound, err)
+
+		num, _ := bolt.ExecOn("bucketOne").Find("nokey").Count()
+		assert.Zero(t, num)
+	})
+
+	t.Run("Upsert", func(t *testing.T) {
+		num, err := bolt.ExecOn("bucketOne").Upsert("upserted", &db.Mock{Msg: "new"})
+		assert.NoError(t, err)
+		assert.Zero(t, num)
+
+		num, err = bolt.ExecOn("bucketOne").Upsert("upserted", &db.Mock{Msg: "replaced"})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, num)
+
+		var res db.Mock
+		err = bolt.ExecOn("bucketOne").Find("upserted").One(&res)
+		assert.NoError(t, err)
+		assert.Equal(t, "replaced", res.Msg)
+	})
+
+	t.Run("Update all", func(t *testing.T) {
+		num, err := bolt.ExecOn("bucketOne").UpdateAll(nil, &db.Mock{Msg: "all"})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, num)
+
+		var msgs []string
+		err = bolt.ExecOn("bucketOne").Find(nil).Distinct("msg", &msgs)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"all"}, msgs)
+	})
+
+	t.Run("Update all w unexisted key", func(t *testing.T) {
+		num, err := bolt.ExecOn("bucketOne").UpdateAll("nokey", &db.Mock{Msg: "none"})
+		assert.NoError(t, err)
+		assert.Zero(t, num)
+	})
+
+	t.Run("Remove all by key", func(t *testing.T) {
+		num, err := bolt.ExecOn("bucketOne").RemoveAll("upserted")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, num)
+	})
+
+	t.Run("Remove all", func(t *testing.T) {
+		num, err := bolt.ExecOn("bucketOne").RemoveAll(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, num)
+
+		num, _ = bolt.ExecOn("bucketOne").Find(nil).Count()
+		assert.Zero(t, num)
+	})
+
 	t.Run("Read from nil bucket", func(t *testing.T) {
 		var res db.Mock
 		err := bolt.ExecOn(nil).Find("key").One(&res)
@@ -342,3 +666,2201 @@ func TestBoltDB(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+type boltDoc struct {
+	Name  string
+	Age   int
+	Tags  []string
+	Score float64 `bson:"rating"`
+	Addr  struct {
+		City string
+	}
+}
+
+func TestBoltDBSelectors(t *testing.T) {
+	bolt := db.New(&db.Bolt{})
+	err := bolt.Connect("bolt", "people")
+	if err != nil {
+		t.Fatalf("Failed to open bolt file, %v", err)
+	}
+	defer bolt.Close()
+
+	for i, name := range []string{"ann", "bob", "cid", "dan"} {
+		doc := boltDoc{Name: name, Age: 20 + i*10, Tags: []string{"user"}, Score: float64(i) / 2}
+		doc.Addr.City = "paris"
+		if i%2 == 1 {
+			doc.Tags = append(doc.Tags, "admin")
+			doc.Addr.City = "rome"
+		}
+		err := bolt.ExecOn("people").Insert(i, doc)
+		if err != nil {
+			t.Fatalf("Insert failed w %v", err)
+		}
+	}
+	err = bolt.ExecOn("people").Insert("raw", bson.M{"name": "eve", "extra": true, "age": int64(60)})
+	if err != nil {
+		t.Fatalf("Insert failed w %v", err)
+	}
+
+	names := func(t *testing.T, query interface{}) []string {
+		var res []string
+		err := bolt.ExecOn("people").Find(query).Distinct("name", &res)
+		assert.NoError(t, err)
+		return res
+	}
+
+	t.Run("Equality", func(t *testing.T) {
+		assert.Equal(t, []string{"bob"}, names(t, bson.M{"name": "bob"}))
+		assert.Equal(t, []string{"eve"}, names(t, bson.M{"age": 60}))
+		assert.Empty(t, names(t, bson.M{"name": "nobody"}))
+	})
+
+	t.Run("Empty selector", func(t *testing.T) {
+		assert.Len(t, names(t, bson.M{}), 5)
+	})
+
+	t.Run("Comparison", func(t *testing.T) {
+		assert.ElementsMatch(t, []string{"cid", "dan", "eve"}, names(t, bson.M{"age": bson.M{"$gt": 30}}))
+		assert.ElementsMatch(t, []string{"bob", "cid"}, names(t, bson.M{"age": bson.M{"$gte": 30, "$lte": 40}}))
+		assert.ElementsMatch(t, []string{"ann"}, names(t, bson.M{"rating": bson.M{"$lt": 0.5}}))
+		assert.ElementsMatch(t, []string{"ann", "bob", "dan", "eve"}, names(t, bson.M{"name": bson.M{"$ne": "cid"}}))
+		assert.ElementsMatch(t, []string{"bob"}, names(t, bson.M{"name": bson.M{"$eq": "bob"}}))
+	})
+
+	t.Run("In and nin", func(t *testing.T) {
+		assert.ElementsMatch(t, []string{"ann", "dan"}, names(t, bson.M{"name": bson.M{"$in": []string{"ann", "dan"}}}))
+		assert.ElementsMatch(t, []string{"bob", "cid", "eve"}, names(t, bson.M{"name": bson.M{"$nin": []string{"ann", "dan"}}}))
+	})
+
+	t.Run("Exists", func(t *testing.T) {
+		assert.Equal(t, []string{"eve"}, names(t, bson.M{"extra": bson.M{"$exists": true}}))
+		assert.Len(t, names(t, bson.M{"extra": bson.M{"$exists": false}}), 4)
+	})
+
+	t.Run("Null matches a missing field", func(t *testing.T) {
+		assert.Len(t, names(t, bson.M{"extra": nil}), 4)
+		assert.Len(t, names(t, bson.M{"extra": bson.M{"$eq": nil}}), 4)
+		assert.Equal(t, []string{"eve"}, names(t, bson.M{"extra": bson.M{"$ne": nil}}))
+		assert.Len(t, names(t, bson.M{"extra": bson.M{"$in": []interface{}{nil, false}}}), 4)
+		assert.Equal(t, []string{"eve"}, names(t, bson.M{"extra": bson.M{"$nin": []interface{}{nil}}}))
+		assert.Empty(t, names(t, bson.M{"name": nil}))
+	})
+
+	t.Run("Arrays and dotted paths", func(t *testing.T) {
+		assert.ElementsMatch(t, []string{"bob", "dan"}, names(t, bson.M{"tags": "admin"}))
+		assert.ElementsMatch(t, []string{"bob", "dan"}, names(t, bson.M{"addr.city": "rome"}))
+		assert.ElementsMatch(t, []string{"bob", "dan"}, names(t, bson.M{"tags.1": bson.M{"$exists": true}}))
+	})
+
+	t.Run("And and or", func(t *testing.T) {
+		assert.ElementsMatch(t, []string{"ann", "eve"}, names(t, bson.M{"$or": []bson.M{{"name": "ann"}, {"extra": true}}}))
+		assert.ElementsMatch(t, []string{"dan"}, names(t, bson.M{"$and": []interface{}{bson.M{"tags": "admin"}, bson.M{"age": bson.M{"$gt": 30}}}}))
+		assert.ElementsMatch(t, []string{"cid"}, names(t, bson.D{{Name: "addr.city", Value: "paris"}, {Name: "age", Value: 40}}))
+	})
+
+	t.Run("Unsupported operator", func(t *testing.T) {
+		var res []string
+		err := bolt.ExecOn("people").Find(bson.M{"name": bson.M{"$regex": "^a"}}).Distinct("name", &res)
+		assert.Error(t, err)
+	})
+
+	t.Run("One and count", func(t *testing.T) {
+		var res boltDoc
+		err := bolt.ExecOn("people").Find(bson.M{"name": "cid"}).One(&res)
+		assert.NoError(t, err)
+		assert.Equal(t, 40, res.Age)
+
+		num, err := bolt.ExecOn("people").Find(bson.M{"addr.city": "paris"}).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, num)
+
+		err = bolt.ExecOn("people").Find(bson.M{"name": "nobody"}).One(&res)
+		assert.Equal(t, db.ErrNotFound, err)
+	})
+
+	t.Run("Update and remove by selector", func(t *testing.T) {
+		err := bolt.ExecOn("people").Update(bson.M{"name": "ann"}, boltDoc{Name: "ann", Age: 99})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"ann"}, names(t, bson.M{"age": 99}))
+
+		num, err := bolt.ExecOn("people").Upsert(bson.M{"_id": "new", "name": "fay"}, bson.M{"name": "fay"})
+		assert.NoError(t, err)
+		assert.Zero(t, num)
+		assert.Equal(t, []string{"fay"}, names(t, "new"))
+
+		num, err = bolt.ExecOn("people").RemoveAll(bson.M{"tags": "admin"})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, num)
+
+		err = bolt.ExecOn("people").Remove(bson.M{"name": "bob"})
+		assert.Equal(t, db.ErrNotFound, err)
+	})
+}
+
+func TestBoltDBUpdateOperators(t *testing.T) {
+	bolt := db.New(&db.Bolt{})
+	err := bolt.Connect("bolt", "people")
+	if err != nil {
+		t.Fatalf("Failed to open bolt file, %v", err)
+	}
+	defer bolt.Close()
+
+	people := bolt.ExecOn("people")
+	err = people.Insert("ann", boltDoc{Name: "ann", Age: 20, Tags: []string{"user"}, Score: 1.5})
+	assert.NoError(t, err)
+	err = people.Insert("raw", bson.M{"name": "raw", "n": 2, "list": []int{1, 2, 3, 4}, "items": []bson.M{{"k": 1}, {"k": 2}}})
+	assert.NoError(t, err)
+
+	read := func(t *testing.T, key string) bson.M {
+		var res bson.M
+		err := bolt.ExecOn("people").Find(key).One(&res)
+		assert.NoError(t, err)
+		return res
+	}
+
+	t.Run("Set and inc keep the struct type", func(t *testing.T) {
+		err := people.Update(bson.M{"name": "ann"}, bson.M{
+			"$set": bson.M{"addr.city": "oslo"},
+			"$inc": bson.M{"age": 5},
+		})
+		assert.NoError(t, err)
+
+		var value interface{}
+		assert.NoError(t, people.Find("ann").One(&value))
+		assert.IsType(t, boltDoc{}, value)
+		res := value.(boltDoc)
+		assert.Equal(t, "oslo", res.Addr.City)
+		assert.Equal(t, 25, res.Age)
+	})
+
+	t.Run("Fields the struct lacks make a document", func(t *testing.T) {
+		err := people.Update(bson.M{"name": "ann"}, bson.M{
+			"$set":   bson.M{"unknown": 1},
+			"$unset": bson.M{"rating": ""},
+		})
+		assert.NoError(t, err)
+		num, err := people.Find(bson.M{"unknown": 1, "rating": bson.M{"$exists": false}}).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, num, "the update isn't lost")
+		assert.NotContains(t, read(t, "ann"), "rating")
+
+		var res boltDoc
+		assert.NoError(t, people.Find("ann").One(&res))
+		assert.Equal(t, 25, res.Age)
+		assert.Zero(t, res.Score)
+	})
+
+	t.Run("Mul, min and max", func(t *testing.T) {
+		err := people.Update("raw", bson.M{"$mul": bson.M{"n": 3, "absent": 2}, "$max": bson.M{"top": 10}, "$min": bson.M{"low": 1}})
+		assert.NoError(t, err)
+		err = people.Update("raw", bson.M{"$max": bson.M{"top": 5}, "$min": bson.M{"low": 0}})
+		assert.NoError(t, err)
+
+		res := read(t, "raw")
+		assert.EqualValues(t, 6, res["n"])
+		assert.EqualValues(t, 0, res["absent"])
+		assert.EqualValues(t, 10, res["top"])
+		assert.EqualValues(t, 0, res["low"])
+	})
+
+	t.Run("Push, add to set and pull", func(t *testing.T) {
+		err := people.Update("ann", bson.M{"$push": bson.M{"tags": "admin"}, "$addToSet": bson.M{"labels": bson.M{"$each": []string{"a", "a", "b"}}}})
+		assert.NoError(t, err)
+		err = people.Update("ann", bson.M{"$addToSet": bson.M{"tags": "user"}})
+		assert.NoError(t, err)
+
+		var res boltDoc
+		err = people.Find("ann").One(&res)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user", "admin"}, res.Tags)
+
+		err = people.Update("raw", bson.M{"$pull": bson.M{"list": bson.M{"$gte": 3}, "items": bson.M{"k": 1}}})
+		assert.NoError(t, err)
+		err = people.Update("raw", bson.M{"$pull": bson.M{"list": 1}})
+		assert.NoError(t, err)
+
+		raw := read(t, "raw")
+		assert.Equal(t, []interface{}{2}, raw["list"])
+		assert.Equal(t, []interface{}{bson.M{"k": 2}}, raw["items"])
+
+		err = people.Update("raw", bson.M{"$set": bson.M{"set": []string{"x"}}})
+		assert.NoError(t, err)
+		err = people.Update("raw", bson.M{"$addToSet": bson.M{"set": []string{"x"}}})
+		assert.NoError(t, err)
+		err = people.Update("raw", bson.M{"$addToSet": bson.M{"set": bson.M{"$each": []interface{}{"x", []string{"x"}}}}})
+		assert.NoError(t, err)
+		assert.Equal(t, []interface{}{"x", []interface{}{"x"}}, read(t, "raw")["set"], "an array is added as an element like Mongo does")
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		err := people.Update("raw", bson.M{"$rename": bson.M{"name": "title"}})
+		assert.NoError(t, err)
+
+		res := read(t, "raw")
+		assert.Equal(t, "raw", res["title"])
+		assert.NotContains(t, res, "name")
+	})
+
+	t.Run("Update all", func(t *testing.T) {
+		num, err := people.UpdateAll(nil, bson.M{"$set": bson.M{"checked": true}})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, num)
+		assert.Equal(t, true, read(t, "raw")["checked"])
+	})
+
+	t.Run("Upsert w operators", func(t *testing.T) {
+		num, err := people.Upsert(bson.M{"_id": "bob", "age": bson.M{"$eq": 30}}, bson.M{"$set": bson.M{"name": "bob"}})
+		assert.NoError(t, err)
+		assert.Zero(t, num)
+		assert.Equal(t, bson.M{"_id": "bob", "age": 30, "name": "bob"}, read(t, "bob"))
+
+		num, err = people.Upsert(bson.M{"_id": "bob"}, bson.M{"$inc": bson.M{"age": 1}})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, num)
+		assert.EqualValues(t, 31, read(t, "bob")["age"])
+	})
+
+	t.Run("Errors leave the records untouched", func(t *testing.T) {
+		err := people.Update("ann", bson.M{"$set": bson.M{"name": "x"}, "age": 1})
+		assert.Error(t, err)
+
+		err = people.Update("ann", bson.M{"$inc": bson.M{"name": 1}})
+		assert.Error(t, err)
+
+		_, err = people.UpdateAll(nil, bson.M{"$set": bson.M{"name": "x"}, "$bogus": bson.M{"a": 1}})
+		assert.Error(t, err)
+
+		var names []string
+		err = people.Find(nil).Distinct("name", &names)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"ann", "bob"}, names)
+	})
+}
+
+//fakeT collects failures reported by Recorder.AssertExpectations
+type fakeT struct {
+	errors []string
+}
+
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+func TestRecorder(t *testing.T) {
+	id := bson.NewObjectId()
+
+	t.Run("Returns expected values", func(t *testing.T) {
+		rec := &db.Recorder{}
+		rec.ExpectExecOn("users").Find(bson.M{"_id": id}).One().Return(bson.M{"_id": id, "name": "ann", "age": 20}, nil)
+		rec.ExpectExecOn("users").Find(db.Any).All().Return([]bson.M{{"name": "ann"}, {"name": "bob"}}, nil)
+		rec.ExpectExecOn("users").Find(nil).Distinct("name").Return([]string{"ann", "bob"}, nil)
+		rec.ExpectExecOn("users").Find(nil).Count().Return(2, nil)
+		rec.ExpectExecOn("users").RemoveAll(db.Any).Return(3, nil)
+		rec.ExpectExecOn("users").Update(bson.M{"_id": id}, db.Any).Return(db.ErrNotFound)
+
+		mock := db.New(rec)
+		sess := mock.Copy()
+		defer sess.Close()
+
+		var doc boltDoc
+		err := sess.ExecOn("users").Find(bson.M{"_id": id}).One(&doc)
+		assert.NoError(t, err)
+		assert.Equal(t, boltDoc{Name: "ann", Age: 20}, doc)
+
+		var docs []boltDoc
+		err = sess.ExecOn("users").Find(bson.M{"age": 1}).All(&docs)
+		assert.NoError(t, err)
+		assert.Equal(t, []boltDoc{{Name: "ann"}, {Name: "bob"}}, docs)
+
+		var names []string
+		err = sess.ExecOn("users").Find(nil).Distinct("name", &names)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"ann", "bob"}, names)
+
+		num, err := sess.ExecOn("users").Find(nil).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, num)
+
+		num, err = sess.ExecOn("users").RemoveAll(bson.M{})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, num)
+
+		err = sess.ExecOn("users").Update(bson.M{"_id": id}, bson.M{"$set": bson.M{"a": 1}})
+		assert.Equal(t, db.ErrNotFound, err)
+
+		rec.AssertExpectations(t)
+		assert.Equal(t, "Copy", rec.Calls()[0].Method)
+	})
+
+	t.Run("Matches documents by their bson form", func(t *testing.T) {
+		rec := &db.Recorder{}
+		rec.ExpectExecOn("users").Insert(bson.M{"name": "ann", "age": int64(20)}).Return(nil)
+		rec.ExpectExecOn("users").Find(&boltDoc{Name: "bob"}).Count().Return(1, nil)
+		rec.ExpectExecOn("users").Insert(db.Matcher(func(arg interface{}) bool {
+			doc, ok := arg.(*boltDoc)
+			return ok && doc.Age > 50
+		})).Return(nil).Times(2)
+
+		users := rec.ExecOn("users")
+		assert.NoError(t, users.Insert(map[string]interface{}{"name": "ann", "age": 20}))
+		assert.NoError(t, users.Insert(&boltDoc{Name: "old", Age: 60}))
+		num, err := users.Find(boltDoc{Name: "bob"}).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, num)
+		assert.NoError(t, users.Insert(&boltDoc{Name: "older", Age: 70}))
+		rec.AssertExpectations(t)
+	})
+
+	t.Run("Reports unexpected calls and wrong counts", func(t *testing.T) {
+		rec := &db.Recorder{}
+		rec.ExpectExecOn("users").Remove(id).Return(nil)
+		rec.ExpectExecOn("users").Insert(db.Any).Return(nil).Times(2)
+
+		err := rec.ExecOn("other").Remove(id)
+		assert.Error(t, err)
+		assert.NoError(t, rec.ExecOn("users").Insert("doc"))
+
+		ft := &fakeT{}
+		assert.False(t, rec.AssertExpectations(ft))
+		assert.Len(t, ft.errors, 3)
+		assert.Contains(t, ft.errors[0], `Unexpected call ExecOn("other").Remove(`)
+	})
+
+	t.Run("Checks the order", func(t *testing.T) {
+		rec := &db.Recorder{}
+		find := rec.ExpectExecOn("users").Find(id).One().Return(bson.M{"_id": id}, nil)
+		remove := rec.ExpectExecOn("users").Remove(id).Return(nil)
+		rec.InOrder(find, remove)
+
+		err := rec.ExecOn("users").Remove(id)
+		assert.Error(t, err)
+
+		var res bson.M
+		assert.NoError(t, rec.ExecOn("users").Find(id).One(&res))
+		assert.NoError(t, rec.ExecOn("users").Remove(id))
+
+		ft := &fakeT{}
+		assert.False(t, rec.AssertExpectations(ft))
+		assert.Len(t, ft.errors, 1)
+		assert.Contains(t, ft.errors[0], "made before")
+	})
+
+	t.Run("Handler calls", func(t *testing.T) {
+		rec := &db.Recorder{}
+		rec.ExpectConnect("baddsn").Return(errors.New("no server"))
+
+		assert.NoError(t, rec.Connect("dsn"))
+		assert.Error(t, rec.Connect("baddsn"))
+		_, err := rec.CopyWithSettings(1, true)
+		assert.NoError(t, err)
+		rec.AssertExpectations(t)
+	})
+}
+
+func TestMockErrors(t *testing.T) {
+	t.Run("Fixed error per method and collection", func(t *testing.T) {
+		mock := &db.Mock{}
+		mock.InjectError(db.MockError{Method: "Insert", Collection: "users", Err: db.ErrDuplicateKey})
+		mock.InjectError(db.MockError{Method: "One", Err: db.ErrNotFound})
+
+		sess := db.New(mock).Copy()
+		err := sess.ExecOn("users").Insert("doc")
+		assert.True(t, mgo.IsDup(err))
+		err = sess.ExecOn("db", "users").Insert("doc")
+		assert.True(t, mgo.IsDup(err))
+		assert.NoError(t, sess.ExecOn("orders").Insert("doc"))
+		assert.NoError(t, sess.ExecOn("users").Remove("doc"))
+
+		var res string
+		err = mock.ExecOn("orders").Find(nil).One(&res)
+		assert.Equal(t, db.ErrNotFound, err)
+		assert.NoError(t, mock.ExecOn("orders").Find(nil).All(&res))
+	})
+
+	t.Run("Error on the Nth call", func(t *testing.T) {
+		mock := &db.Mock{}
+		mock.InjectError(db.MockError{Method: "Count", OnCall: 2, Err: db.ErrNoReachableServers})
+
+		_, err := mock.ExecOn("users").Find(nil).Count()
+		assert.NoError(t, err)
+		_, err = mock.ExecOn("users").Find(nil).Count()
+		assert.Equal(t, db.ErrNoReachableServers, err)
+		_, err = mock.ExecOn("users").Find(nil).Count()
+		assert.NoError(t, err)
+	})
+
+	t.Run("Error w probability", func(t *testing.T) {
+		mock := &db.Mock{}
+		mock.InjectError(db.MockError{Method: "Update", Probability: 0.3, Rand: rand.New(rand.NewSource(1)), Err: db.ErrNoReachableServers})
+
+		expected := rand.New(rand.NewSource(1))
+		var failed int
+		for i := 0; i < 100; i++ {
+			err := mock.ExecOn("users").Update("sel", "upd")
+			if expected.Float64() < 0.3 {
+				assert.Equal(t, db.ErrNoReachableServers, err, "call %d", i)
+				failed++
+			} else {
+				assert.NoError(t, err, "call %d", i)
+			}
+		}
+		assert.NotZero(t, failed)
+		assert.NotEqual(t, 100, failed)
+	})
+
+	t.Run("Handler methods", func(t *testing.T) {
+		mock := &db.Mock{}
+		mock.InjectError(db.MockError{Method: "Connect", Err: db.ErrNoReachableServers})
+		mock.InjectError(db.MockError{Method: "CopyWithSettings", Err: db.ErrNoReachableServers})
+
+		assert.Equal(t, db.ErrNoReachableServers, mock.Connect("dsn"))
+		_, err := mock.CopyWithSettings(1, true)
+		assert.Equal(t, db.ErrNoReachableServers, err)
+	})
+
+	t.Run("Rules added after ExecOn and Copy", func(t *testing.T) {
+		mock := &db.Mock{}
+		coll := mock.ExecOn("users")
+		sess := mock.Copy()
+		copied, err := mock.CopyWithSettings()
+		assert.NoError(t, err)
+		mock.InjectError(db.MockError{Method: "Insert", Err: db.ErrDuplicateKey})
+
+		assert.True(t, mgo.IsDup(coll.Insert(1)))
+		assert.True(t, mgo.IsDup(sess.ExecOn("users").Insert(1)))
+		assert.True(t, mgo.IsDup(copied.ExecOn("users").Insert(1)))
+	})
+
+	t.Run("Concurrent rules", func(t *testing.T) {
+		mock := &db.Mock{}
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mock.InjectError(db.MockError{Method: "Remove", Err: db.ErrNoReachableServers})
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, db.ErrNoReachableServers, mock.ExecOn("users").Remove(1))
+	})
+}
+
+type mockUser struct {
+	ID   bson.ObjectId `bson:"_id"`
+	Name string        `bson:"user_name"`
+	Age  int           `bson:"age"`
+}
+
+func TestMockFixtures(t *testing.T) {
+	ids := []bson.ObjectId{bson.NewObjectId(), bson.NewObjectId()}
+
+	mock := &db.Mock{}
+	mock.Seed("users",
+		bson.M{"_id": ids[0], "user_name": "ann", "age": 20},
+		mockUser{ID: ids[1], Name: "bob", Age: 30},
+	)
+	mock.Seed("empty")
+	sess := db.New(mock).Copy()
+
+	t.Run("One", func(t *testing.T) {
+		var user mockUser
+		err := sess.ExecOn("users").Find(bson.M{"_id": ids[0]}).One(&user)
+		assert.NoError(t, err)
+		assert.Equal(t, mockUser{ID: ids[0], Name: "ann", Age: 20}, user)
+
+		err = sess.ExecOn("empty").Find(nil).One(&user)
+		assert.Equal(t, db.ErrNotFound, err)
+	})
+
+	t.Run("All", func(t *testing.T) {
+		var users []mockUser
+		err := sess.ExecOn("app", "users").Find(nil).All(&users)
+		assert.NoError(t, err)
+		assert.Equal(t, []mockUser{{ID: ids[0], Name: "ann", Age: 20}, {ID: ids[1], Name: "bob", Age: 30}}, users)
+
+		var docs []bson.M
+		err = sess.ExecOn("users").Find(nil).All(&docs)
+		assert.NoError(t, err)
+		assert.Equal(t, "bob", docs[1]["user_name"])
+	})
+
+	t.Run("Distinct", func(t *testing.T) {
+		var ages []int
+		err := sess.ExecOn("users").Find(nil).Distinct("age", &ages)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{20, 30}, ages)
+	})
+
+	t.Run("Count", func(t *testing.T) {
+		num, err := sess.ExecOn("users").Find(nil).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, num)
+
+		num, err = sess.ExecOn("empty").Find(nil).Count()
+		assert.NoError(t, err)
+		assert.Zero(t, num)
+	})
+
+	t.Run("Seeded after ExecOn", func(t *testing.T) {
+		mock := &db.Mock{}
+		coll := mock.ExecOn("users")
+		sess := mock.Copy()
+		mock.Seed("users", bson.M{"name": "ann"})
+
+		var res bson.M
+		assert.NoError(t, coll.Find(nil).One(&res))
+		assert.Equal(t, bson.M{"name": "ann"}, res)
+		num, err := sess.ExecOn("users").Find(nil).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, num)
+	})
+
+	t.Run("Collections w/o fixtures keep the canned values", func(t *testing.T) {
+		num, _ := sess.ExecOn("other").Find(nil).Count()
+		assert.Equal(t, 999, num)
+	})
+}
+
+func TestContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithTimeout(context.Background(), -time.Second)
+	defer cancelExpired()
+
+	handlers := map[string]struct {
+		handler   db.Handler
+		resources []interface{}
+		insert    []interface{}
+		selector  interface{}
+	}{
+		"Bolt":   {&db.Bolt{}, []interface{}{"ctxtest.db", "test"}, []interface{}{"key", boltDoc{Name: "ann"}}, "key"},
+		"Memory": {&db.Memory{}, nil, []interface{}{bson.M{"_id": "key", "name": "ann"}}, "key"},
+	}
+
+	for name, h := range handlers {
+		t.Run(name, func(t *testing.T) {
+			ch := h.handler.(db.ContextHandler)
+			assert.Equal(t, context.Canceled, ch.ConnectContext(cancelled, h.resources...))
+			assert.NoError(t, ch.ConnectContext(context.Background(), h.resources...))
+			defer ch.Close()
+
+			q := ch.ExecOn("test").(db.ContextQuerier)
+			assert.NoError(t, q.InsertContext(context.Background(), h.insert...))
+			assert.Equal(t, context.Canceled, q.InsertContext(cancelled, h.insert...))
+
+			err := q.UpdateContext(expired, h.selector, bson.M{"$set": bson.M{"name": "bob"}})
+			assert.Equal(t, context.DeadlineExceeded, err)
+			_, err = q.UpdateAllContext(cancelled, nil, bson.M{"$set": bson.M{"name": "bob"}})
+			assert.Equal(t, context.Canceled, err)
+			_, err = q.UpsertContext(cancelled, h.selector, bson.M{"$set": bson.M{"name": "bob"}})
+			assert.Equal(t, context.Canceled, err)
+			assert.Equal(t, context.Canceled, q.RemoveContext(cancelled, h.selector))
+			_, err = q.RemoveAllContext(cancelled, nil)
+			assert.Equal(t, context.Canceled, err)
+
+			r := q.Find(bson.M{"name": "ann"}).(db.ContextRefiner)
+			var doc bson.M
+			assert.Equal(t, context.Canceled, r.OneContext(cancelled, &doc))
+			var docs []bson.M
+			assert.Equal(t, context.Canceled, r.AllContext(cancelled, &docs))
+			var names []string
+			assert.Equal(t, context.DeadlineExceeded, r.DistinctContext(expired, "name", &names))
+			_, err = r.CountContext(cancelled)
+			assert.Equal(t, context.Canceled, err)
+
+			//nothing has been changed by the cancelled calls
+			num, err := r.CountContext(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, 1, num)
+			assert.NoError(t, r.OneContext(context.Background(), &doc))
+			assert.Equal(t, "ann", doc["name"])
+		})
+	}
+
+	t.Run("Mock", func(t *testing.T) {
+		mock := &db.Mock{}
+		ctx := context.WithValue(context.Background(), "key", "value")
+
+		assert.NoError(t, mock.ConnectContext(ctx, "dsn"))
+		assert.Equal(t, ctx, mock.Ctx)
+		assert.Equal(t, context.Canceled, mock.ConnectContext(cancelled, "dsn"))
+
+		coll := mock.ExecOn("users").(*db.MockCollection)
+		num, err := coll.UpsertContext(ctx, nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 999, num)
+		assert.Equal(t, ctx, coll.Ctx)
+		assert.Equal(t, context.Canceled, coll.InsertContext(cancelled, 1))
+		assert.Zero(t, coll.DocsNum)
+
+		query := coll.Find(nil).(*db.MockQuery)
+		var res string
+		assert.NoError(t, query.OneContext(ctx, &res))
+		assert.Equal(t, "result", query.Res)
+		assert.Equal(t, ctx, query.Ctx)
+		_, err = query.CountContext(expired)
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+
+	t.Run("Recorder", func(t *testing.T) {
+		rec := &db.Recorder{}
+		rec.ExpectExecOn("users").Insert(db.Any).Return(nil)
+		rec.ExpectExecOn("users").Find(nil).Count().Return(5, nil)
+
+		q := rec.ExecOn("users").(db.ContextQuerier)
+		assert.Equal(t, context.Canceled, q.InsertContext(cancelled, bson.M{}))
+		assert.NoError(t, q.InsertContext(context.Background(), bson.M{}))
+		num, err := q.Find(nil).(db.ContextRefiner).CountContext(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 5, num)
+
+		calls := rec.Calls()
+		assert.Equal(t, cancelled, calls[1].Context)
+		assert.Equal(t, "Insert", calls[2].Method)
+		assert.True(t, rec.AssertExpectations(t))
+	})
+}
+
+func TestOptions(t *testing.T) {
+	t.Run("Bolt", func(t *testing.T) {
+		bolt := db.New(&db.Bolt{})
+		err := bolt.Connect(db.WithDSN("opttest.db"), db.WithBuckets("users", "orders"))
+		assert.NoError(t, err)
+		defer bolt.Close()
+
+		assert.NoError(t, bolt.ExecOn("orders").Insert("key", "value"))
+		assert.NoError(t, bolt.ExecOn("users").Insert("key", "value"))
+	})
+
+	t.Run("Memory", func(t *testing.T) {
+		memory := &db.Memory{}
+		assert.NoError(t, memory.Connect(db.WithDSN("mongodb://localhost:27017/app?w=1")))
+		assert.NoError(t, memory.ExecOn("users").Insert(bson.M{"_id": 1}))
+
+		num, err := memory.ExecOn("app", "users").Find(nil).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, num)
+	})
+
+	t.Run("Mock", func(t *testing.T) {
+		mock := &db.Mock{}
+		assert.NoError(t, mock.Connect(db.WithDSN("dsn")))
+		assert.Equal(t, "dsn", mock.Msg)
+
+		copy, err := mock.CopyWithSettings(db.WithMode(mgo.Monotonic), db.WithRefresh())
+		assert.NoError(t, err)
+		assert.Equal(t, int(mgo.Monotonic), copy.(*db.Mock).Mode)
+		assert.True(t, copy.(*db.Mock).Refresh)
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		errs := []error{
+			(&db.Mongo{}).Connect(),
+			(&db.Mongo{}).Connect(42),
+			(&db.Bolt{}).Connect(db.WithDSN("")),
+			(&db.Bolt{}).Connect(db.WithDSN("a.db"), "bucket"),
+			(&db.Bolt{}).Connect(db.WithDSN("a.db"), db.WithBuckets()),
+			(&db.Mock{}).Connect(),
+			(&db.Memory{}).Connect(1),
+		}
+		for i, err := range errs {
+			assert.Error(t, err, "case %d", i)
+		}
+
+		_, err := (&db.Mongo{}).CopyWithSettings(true)
+		assert.EqualError(t, err, "Unexpected parameters set, want db.WithMode(mode), db.WithRefresh() or `mode int, refresh bool`, got 1 value(s)")
+		_, err = (&db.Mongo{}).CopyWithSettings(db.WithMode(42))
+		assert.EqualError(t, err, "Option WithMode wants a mode from mgo.Eventual (0) to mgo.Nearest (6), got 42")
+		_, err = (&db.Mongo{}).CopyWithSettings(1, "yes")
+		assert.Error(t, err)
+	})
+
+	t.Run("BoltDB options elsewhere", func(t *testing.T) {
+		_, err := (&db.Mongo{}).CopyWithSettings(db.WithBoltMode(db.BoltReadOnly))
+		assert.EqualError(t, err, "Unexpected options db.WithBoltMode, they are for BoltDB only")
+		_, err = (&db.Mongo{}).CopyWithSettings(db.WithMode(mgo.Strong), db.WithCodec(db.JSONCodec{}))
+		assert.Error(t, err)
+		err = (&db.Mongo{}).Connect(db.WithDSN("mongodb://localhost:1"), db.WithPath("app.db"), db.WithBuckets("users"))
+		assert.EqualError(t, err, "Unexpected options db.WithPath, db.WithBuckets, they are for BoltDB only")
+		err = (&db.Mongo{}).ConnectContext(context.Background(), db.WithDSN("mongodb://localhost:1"), db.WithNoSync())
+		assert.Error(t, err)
+
+		memory := &db.Memory{}
+		assert.Error(t, memory.Connect(db.WithDSN("app"), db.WithAutoCreate()))
+		assert.NoError(t, memory.Connect(db.WithDSN("app")))
+		_, err = memory.CopyWithSettings(db.WithBoltMode(db.BoltStrict))
+		assert.Error(t, err)
+		_, err = memory.CopyWithSettings(db.WithMode(mgo.Strong), db.WithRefresh())
+		assert.NoError(t, err, "mgo settings are skipped")
+		_, err = memory.CopyWithSettings(1, true)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Recorder", func(t *testing.T) {
+		rec := &db.Recorder{}
+		rec.ExpectConnect(db.WithDSN("dsn")).Return(errors.New("connection refused"))
+
+		assert.NoError(t, rec.Connect(db.WithDSN("other")))
+		assert.EqualError(t, rec.Connect(db.WithDSN("dsn")), "connection refused")
+		assert.True(t, rec.AssertExpectations(t))
+	})
+}
+
+func TestBoltDBPersistent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltpersistent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data", "app.db")
+
+	bolt := db.New(&db.Bolt{})
+	err = bolt.Connect(db.WithPath(path), db.WithBuckets("users"), db.WithFileMode(0600), db.WithNoSync())
+	assert.NoError(t, err)
+	assert.NoError(t, bolt.ExecOn("users").Insert("ann", boltDoc{Name: "ann", Age: 20}))
+	bolt.Close()
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err, "Close keeps the file")
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	t.Run("Reopen", func(t *testing.T) {
+		bolt := db.New(&db.Bolt{})
+		err := bolt.Connect(db.WithPath(path))
+		assert.NoError(t, err)
+		defer bolt.Close()
+
+		var doc boltDoc
+		assert.NoError(t, bolt.ExecOn("users").Find("ann").One(&doc))
+		assert.Equal(t, 20, doc.Age)
+	})
+
+	t.Run("Read-only", func(t *testing.T) {
+		bolt := db.New(&db.Bolt{})
+		err := bolt.Connect(db.WithPath(path), db.WithBoltOptions(&boltdb.Options{ReadOnly: true, Timeout: time.Second}))
+		assert.NoError(t, err)
+		defer bolt.Close()
+
+		num, err := bolt.ExecOn("users").Find(nil).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, num)
+		assert.Error(t, bolt.ExecOn("users").Insert("bob", boltDoc{Name: "bob"}))
+
+		err = (&db.Bolt{}).Connect(db.WithPath(path), db.WithBuckets("orders"), db.WithBoltOptions(&boltdb.Options{ReadOnly: true}))
+		assert.Error(t, err)
+	})
+
+	t.Run("Lock timeout", func(t *testing.T) {
+		bolt := db.New(&db.Bolt{})
+		assert.NoError(t, bolt.Connect(db.WithPath(path)))
+		defer bolt.Close()
+
+		err := (&db.Bolt{}).Connect(db.WithPath(path), db.WithBoltOptions(&boltdb.Options{Timeout: 50 * time.Millisecond}))
+		assert.Equal(t, boltdb.ErrTimeout, err)
+	})
+}
+
+func TestBoltDBConcurrent(t *testing.T) {
+	bolt := db.New(&db.Bolt{})
+	err := bolt.Connect("concurrent.db", "one", "two", "three")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+
+	buckets := []string{"one", "two", "three"}
+	var wg sync.WaitGroup
+	for _, bucket := range buckets {
+		wg.Add(1)
+		go func(bucket string) {
+			defer wg.Done()
+			sess := bolt.Copy()
+			defer sess.Close()
+
+			coll := sess.ExecOn(bucket)
+			for i := 0; i < 20; i++ {
+				err := coll.Insert(i, boltDoc{Name: bucket, Age: i})
+				assert.NoError(t, err)
+			}
+			q := coll.Find(bson.M{"name": bucket})
+			num, err := q.Count()
+			assert.NoError(t, err)
+			assert.Equal(t, 20, num)
+
+			var docs []boltDoc
+			assert.NoError(t, q.All(&docs))
+			for _, d := range docs {
+				assert.Equal(t, bucket, d.Name)
+			}
+		}(bucket)
+	}
+	wg.Wait()
+
+	for _, bucket := range buckets {
+		num, err := bolt.ExecOn(bucket).Find(nil).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 20, num, "copies' Close keeps the db open")
+	}
+}
+
+func TestBoltDBSessions(t *testing.T) {
+	bolt := db.New(&db.Bolt{})
+	err := bolt.Connect(db.WithDSN("sessions.db"), db.WithBuckets("test"), db.WithNoSync())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+	assert.NoError(t, bolt.ExecOn("test").Insert("key", boltDoc{Name: "ann"}))
+
+	t.Run("Read-only", func(t *testing.T) {
+		sess, err := bolt.CopyWithSettings(db.WithBoltMode(db.BoltReadOnly))
+		assert.NoError(t, err)
+		defer sess.Close()
+
+		coll := sess.ExecOn("test")
+		assert.Equal(t, db.ErrReadOnly, coll.Insert("other", boltDoc{}))
+		assert.Equal(t, db.ErrReadOnly, coll.Update("key", bson.M{"$set": bson.M{"name": "bob"}}))
+		_, err = coll.RemoveAll(nil)
+		assert.Equal(t, db.ErrReadOnly, err)
+
+		var doc boltDoc
+		assert.NoError(t, coll.Find("key").One(&doc))
+		assert.Equal(t, "ann", doc.Name)
+
+		copy := sess.Copy()
+		assert.Equal(t, db.ErrReadOnly, copy.ExecOn("test").Insert("other", boltDoc{}), "copies keep the mode")
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		sess, err := bolt.CopyWithSettings(db.BoltBatch)
+		assert.NoError(t, err)
+		defer sess.Close()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				assert.NoError(t, sess.ExecOn("test").Insert(i, boltDoc{Name: "batch", Age: i}))
+			}(i)
+		}
+		wg.Wait()
+
+		num, err := sess.ExecOn("test").Find(bson.M{"name": "batch"}).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 50, num)
+
+		num, err = sess.ExecOn("test").Upsert("key", bson.M{"$inc": bson.M{"age": 1}})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, num)
+	})
+
+	t.Run("Strict", func(t *testing.T) {
+		sess, err := bolt.CopyWithSettings(db.WithBoltMode(db.BoltStrict))
+		assert.NoError(t, err)
+		defer sess.Close()
+
+		assert.NoError(t, sess.ExecOn("test").Update("key", bson.M{"$set": bson.M{"age": 30}}))
+		var doc boltDoc
+		assert.NoError(t, bolt.ExecOn("test").Find("key").One(&doc))
+		assert.Equal(t, 30, doc.Age)
+	})
+
+	t.Run("Settings", func(t *testing.T) {
+		_, err := bolt.CopyWithSettings(db.WithBoltMode(42))
+		assert.Error(t, err)
+		_, err = bolt.CopyWithSettings(3, true)
+		assert.Error(t, err)
+		_, err = bolt.CopyWithSettings(db.WithMode(mgo.Strong))
+		assert.Error(t, err, "mgo settings aren't ignored")
+		_, err = bolt.CopyWithSettings(db.WithBoltMode(db.BoltStrict), db.WithRefresh())
+		assert.Error(t, err)
+
+		sess, err := bolt.CopyWithSettings()
+		assert.NoError(t, err)
+		sess.Close()
+		assert.NoError(t, bolt.ExecOn("test").Insert("after", boltDoc{}), "Close of a copy leaves the db open")
+	})
+}
+
+func TestTransactions(t *testing.T) {
+	errOutOfStock := errors.New("out of stock")
+
+	//placeOrder inserts the order and takes the item from the stock, all or nothing
+	placeOrder := func(h db.Handler, id int) error {
+		return h.(db.Transactor).WithTransaction(func(tx db.Tx) error {
+			_, err := tx.ExecOn("orders").Upsert(bson.M{"_id": id}, bson.M{"$set": bson.M{"item": "apple"}})
+			if err != nil {
+				return err
+			}
+			var stock bson.M
+			err = tx.ExecOn("stock").Find(bson.M{"_id": "apple"}).One(&stock)
+			if err != nil {
+				return err
+			}
+			if stock["count"] == 0 {
+				return errOutOfStock
+			}
+			return tx.ExecOn("stock").Update(bson.M{"_id": "apple"}, bson.M{"$inc": bson.M{"count": -1}})
+		})
+	}
+
+	t.Run("Memory", func(t *testing.T) {
+		memory := db.New(&db.Memory{})
+		assert.NoError(t, memory.Connect())
+		assert.NoError(t, memory.ExecOn("stock").Insert(bson.M{"_id": "apple", "count": 1}))
+
+		assert.NoError(t, placeOrder(memory, 1))
+		assert.Equal(t, errOutOfStock, placeOrder(memory.Copy(), 2))
+
+		num, _ := memory.ExecOn("orders").Find(nil).Count()
+		assert.Equal(t, 1, num, "the second order is rolled back")
+	})
+
+	t.Run("Bolt", func(t *testing.T) {
+		bolt := db.New(&db.Bolt{})
+		assert.NoError(t, bolt.Connect("tx.db", "orders", "stock"))
+		defer bolt.Close()
+		_, err := bolt.ExecOn("stock").Upsert(bson.M{"_id": "apple"}, bson.M{"$set": bson.M{"count": 1}})
+		assert.NoError(t, err)
+
+		assert.NoError(t, placeOrder(bolt, 1))
+		assert.Equal(t, errOutOfStock, placeOrder(bolt, 2))
+
+		num, _ := bolt.ExecOn("orders").Find(nil).Count()
+		assert.Equal(t, 1, num, "the second order is rolled back")
+
+		reader, _ := bolt.CopyWithSettings(db.BoltReadOnly)
+		assert.Equal(t, db.ErrReadOnly, placeOrder(reader, 3))
+	})
+
+	t.Run("Mongo", func(t *testing.T) {
+		called := false
+		err := (&db.Mongo{}).WithTransaction(func(tx db.Tx) error {
+			called = true
+			return nil
+		})
+		assert.Equal(t, db.ErrTransactionsUnsupported, err)
+		assert.False(t, called)
+	})
+
+	t.Run("Mock", func(t *testing.T) {
+		mock := &db.Mock{}
+		mock.Seed("stock", bson.M{"_id": "apple", "count": 0})
+
+		assert.Equal(t, errOutOfStock, placeOrder(mock, 1))
+		mock.Seed("stock", bson.M{"_id": "apple", "count": 1})
+		assert.NoError(t, placeOrder(mock, 2))
+		assert.Equal(t, 1, mock.Commits)
+		assert.Equal(t, 1, mock.Rollbacks)
+
+		mock.InjectError(db.MockError{Method: "WithTransaction", Err: db.ErrNoReachableServers})
+		assert.Equal(t, db.ErrNoReachableServers, placeOrder(mock, 3))
+	})
+
+	t.Run("Mock seeded inside the transaction", func(t *testing.T) {
+		mock := &db.Mock{}
+		assert.NoError(t, mock.WithTransaction(func(tx db.Tx) error {
+			coll := tx.ExecOn("stock")
+			mock.Seed("stock", bson.M{"_id": "apple", "count": 1})
+			mock.InjectError(db.MockError{Method: "Insert", Err: db.ErrDuplicateKey})
+
+			var doc bson.M
+			assert.NoError(t, coll.Find(nil).One(&doc))
+			assert.Equal(t, 1, doc["count"])
+			assert.True(t, mgo.IsDup(tx.ExecOn("orders").Insert(bson.M{"_id": 1})))
+			return nil
+		}))
+	})
+
+	t.Run("Recorder", func(t *testing.T) {
+		rec := &db.Recorder{}
+		rec.ExpectExecOn("orders").Upsert(bson.M{"_id": 1}, db.Any).Return(0, nil)
+		rec.ExpectExecOn("stock").Find(bson.M{"_id": "apple"}).One().Return(bson.M{"count": 0}, nil)
+
+		assert.Equal(t, errOutOfStock, placeOrder(rec, 1))
+		calls := rec.Calls()
+		assert.Equal(t, "WithTransaction", calls[0].Method)
+		assert.Equal(t, "Rollback", calls[len(calls)-1].Method)
+		assert.True(t, rec.AssertExpectations(t))
+	})
+}
+
+func TestRefiner(t *testing.T) {
+	docs := []boltDoc{
+		{Name: "ann", Age: 30, Score: 5},
+		{Name: "bob", Age: 20, Score: 7},
+		{Name: "cid", Age: 30, Score: 9},
+		{Name: "dan", Age: 40, Score: 1},
+	}
+
+	bolt := db.New(&db.Bolt{})
+	if err := bolt.Connect("refiner.db", "people"); err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+	memory := db.New(&db.Memory{})
+	assert.NoError(t, memory.Connect())
+
+	for i, d := range docs {
+		assert.NoError(t, bolt.ExecOn("people").Insert(i, d))
+		assert.NoError(t, memory.ExecOn("people").Insert(d))
+	}
+
+	for name, h := range map[string]db.Handler{"Bolt": bolt, "Memory": memory} {
+		coll := h.ExecOn("people")
+
+		t.Run(name+" Sort", func(t *testing.T) {
+			var res []boltDoc
+			assert.NoError(t, coll.Find(nil).Sort("-age", "rating").All(&res))
+			names := []string{}
+			for _, r := range res {
+				names = append(names, r.Name)
+			}
+			assert.Equal(t, []string{"dan", "ann", "cid", "bob"}, names)
+		})
+
+		t.Run(name+" Skip and Limit", func(t *testing.T) {
+			var res []boltDoc
+			assert.NoError(t, coll.Find(nil).Sort("name").Skip(1).Limit(2).All(&res))
+			assert.Len(t, res, 2)
+			assert.Equal(t, "bob", res[0].Name)
+			assert.Equal(t, "cid", res[1].Name)
+
+			var one boltDoc
+			assert.NoError(t, coll.Find(bson.M{"age": 30}).Sort("-name").One(&one))
+			assert.Equal(t, "cid", one.Name)
+			assert.Equal(t, db.ErrNotFound, coll.Find(nil).Skip(10).One(&one))
+
+			num, err := coll.Find(nil).Skip(1).Limit(2).Count()
+			assert.NoError(t, err)
+			assert.Equal(t, 2, num)
+			num, err = coll.Find(nil).Skip(3).Count()
+			assert.NoError(t, err)
+			assert.Equal(t, 1, num)
+
+			var ages []int
+			assert.NoError(t, coll.Find(nil).Limit(1).Distinct("age", &ages))
+			assert.Len(t, ages, 3, "Distinct ignores Limit")
+		})
+
+		t.Run(name+" Select", func(t *testing.T) {
+			var res bson.M
+			assert.NoError(t, coll.Find(bson.M{"name": "ann"}).Select(bson.M{"name": 1, "_id": 0}).One(&res))
+			assert.Equal(t, bson.M{"name": "ann"}, res)
+
+			var doc boltDoc
+			assert.NoError(t, coll.Find(bson.M{"name": "ann"}).Select(bson.M{"age": 0}).One(&doc))
+			assert.Equal(t, "ann", doc.Name)
+			assert.Zero(t, doc.Age)
+
+			assert.Error(t, coll.Find(nil).Select(bson.M{"name": 1, "age": 0}).One(&res))
+			assert.Error(t, coll.Find(nil).Sort("").One(&res))
+		})
+	}
+
+	t.Run("Mock", func(t *testing.T) {
+		q := (&db.Mock{}).ExecOn("people").Find(nil).Sort("-age").Skip(10).Limit(5).Select(bson.M{"name": 1})
+		mq := q.(*db.MockQuery)
+		assert.Equal(t, []string{"-age"}, mq.SortFields)
+		assert.Equal(t, 10, mq.SkipN)
+		assert.Equal(t, 5, mq.LimitN)
+		assert.Equal(t, bson.M{"name": 1}, mq.Projection)
+	})
+
+	t.Run("Recorder", func(t *testing.T) {
+		rec := &db.Recorder{}
+		rec.ExpectExecOn("people").Find(nil).All().Return([]bson.M{{"name": "ann"}}, nil)
+
+		var res []bson.M
+		assert.NoError(t, rec.ExecOn("people").Find(nil).Sort("name").Limit(10).All(&res))
+		calls := rec.Calls()
+		assert.Equal(t, `ExecOn("people").Find(<nil>).Sort("name")`, calls[1].String())
+		assert.Equal(t, "Limit", calls[2].Method)
+		assert.True(t, rec.AssertExpectations(t))
+	})
+}
+
+func TestIter(t *testing.T) {
+	bolt := db.New(&db.Bolt{})
+	if err := bolt.Connect("iter.db", "people"); err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+	memory := db.New(&db.Memory{})
+	assert.NoError(t, memory.Connect())
+
+	for i := 0; i < 10; i++ {
+		d := boltDoc{Name: fmt.Sprintf("user%d", i), Age: i}
+		assert.NoError(t, bolt.ExecOn("people").Insert(i, d))
+		assert.NoError(t, memory.ExecOn("people").Insert(d))
+	}
+
+	for name, h := range map[string]db.Handler{"Bolt": bolt, "Memory": memory} {
+		coll := h.ExecOn("people")
+
+		t.Run(name, func(t *testing.T) {
+			iter := coll.Find(bson.M{"age": bson.M{"$gte": 5}}).Iter()
+			var doc boltDoc
+			num := 0
+			for iter.Next(&doc) {
+				assert.True(t, doc.Age >= 5)
+				num++
+			}
+			assert.NoError(t, iter.Err())
+			assert.NoError(t, iter.Close())
+			assert.Equal(t, 5, num)
+
+			iter = coll.Find(nil).Sort("-age").Limit(2).Iter()
+			var ages []int
+			for iter.Next(&doc) {
+				ages = append(ages, doc.Age)
+			}
+			assert.NoError(t, iter.Close())
+			assert.Equal(t, []int{9, 8}, ages)
+
+			iter = coll.Find(nil).Sort("").Iter()
+			assert.False(t, iter.Next(&doc))
+			assert.Error(t, iter.Close())
+		})
+	}
+
+	t.Run("Bolt key and early Close", func(t *testing.T) {
+		iter := bolt.ExecOn("people").Find(3).Iter()
+		var doc boltDoc
+		assert.True(t, iter.Next(&doc))
+		assert.Equal(t, "user3", doc.Name)
+		assert.False(t, iter.Next(&doc))
+		assert.NoError(t, iter.Close())
+
+		iter = bolt.ExecOn("people").Find(nil).Iter()
+		assert.True(t, iter.Next(&doc))
+		assert.NoError(t, iter.Close())
+		assert.False(t, iter.Next(&doc))
+		assert.NoError(t, bolt.ExecOn("people").Insert(100, boltDoc{}), "Close ends the read transaction")
+
+		assert.Error(t, bolt.ExecOn("missing").Find(nil).Iter().Close())
+	})
+
+	t.Run("Mock", func(t *testing.T) {
+		mock := &db.Mock{}
+		mock.Seed("people", bson.M{"name": "ann"}, bson.M{"name": "bob"})
+
+		iter := mock.ExecOn("people").Find(nil).Iter()
+		var names []string
+		var doc boltDoc
+		for iter.Next(&doc) {
+			names = append(names, doc.Name)
+		}
+		assert.NoError(t, iter.Close())
+		assert.Equal(t, []string{"ann", "bob"}, names)
+
+		mock.InjectError(db.MockError{Method: "Iter", Err: db.ErrNoReachableServers})
+		iter = mock.ExecOn("people").Find(nil).Iter()
+		assert.False(t, iter.Next(&doc))
+		assert.Equal(t, db.ErrNoReachableServers, iter.Err())
+	})
+
+	t.Run("Recorder", func(t *testing.T) {
+		rec := &db.Recorder{}
+		errCursor := errors.New("cursor not found")
+		rec.ExpectExecOn("people").Find(nil).Iter().Return([]bson.M{{"name": "ann"}}, errCursor)
+
+		iter := rec.ExecOn("people").Find(nil).Iter()
+		var doc bson.M
+		assert.True(t, iter.Next(&doc))
+		assert.Equal(t, "ann", doc["name"])
+		assert.False(t, iter.Next(&doc))
+		assert.Equal(t, errCursor, iter.Close())
+		assert.True(t, rec.AssertExpectations(t))
+	})
+}
+
+func TestPipe(t *testing.T) {
+	bolt := db.New(&db.Bolt{})
+	if err := bolt.Connect("pipe.db", "people"); err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+	memory := db.New(&db.Memory{})
+	assert.NoError(t, memory.Connect())
+	mock := &db.Mock{}
+
+	people := []boltDoc{
+		{Name: "ann", Age: 30, Tags: []string{"admin", "dev"}},
+		{Name: "bob", Age: 20, Tags: []string{"dev"}},
+		{Name: "cid", Age: 40},
+		{Name: "dan", Age: 25, Tags: []string{"ops", "dev"}},
+	}
+	for i, p := range people {
+		p.Addr.City = "paris"
+		if i%2 == 1 {
+			p.Addr.City = "rome"
+		}
+		assert.NoError(t, bolt.ExecOn("people").Insert(i, p))
+		assert.NoError(t, memory.ExecOn("people").Insert(p))
+		people[i] = p
+	}
+	mock.Seed("people", people[0], people[1], people[2], people[3])
+
+	type cityStat struct {
+		City  string   `bson:"_id"`
+		Num   int      `bson:"num"`
+		Total int      `bson:"total"`
+		Avg   float64  `bson:"avg"`
+		Names []string `bson:"names"`
+		Old   int      `bson:"old"`
+	}
+
+	for name, h := range map[string]db.Handler{"Bolt": bolt, "Memory": memory, "Mock": mock} {
+		coll := h.ExecOn("people")
+
+		t.Run(name, func(t *testing.T) {
+			var stats []cityStat
+			err := coll.Pipe([]bson.M{
+				{"$match": bson.M{"age": bson.M{"$gte": 20}}},
+				{"$sort": bson.M{"name": 1}},
+				{"$group": bson.M{
+					"_id":   "$addr.city",
+					"num":   bson.M{"$sum": 1},
+					"total": bson.M{"$sum": "$age"},
+					"avg":   bson.M{"$avg": "$age"},
+					"names": bson.M{"$push": "$name"},
+					"old":   bson.M{"$max": "$age"},
+				}},
+				{"$sort": bson.M{"_id": -1}},
+			}).All(&stats)
+			assert.NoError(t, err)
+			assert.Equal(t, []cityStat{
+				{City: "rome", Num: 2, Total: 45, Avg: 22.5, Names: []string{"bob", "dan"}, Old: 25},
+				{City: "paris", Num: 2, Total: 70, Avg: 35, Names: []string{"ann", "cid"}, Old: 40},
+			}, stats)
+
+			var tags []bson.M
+			err = coll.Pipe([]bson.D{
+				{{Name: "$unwind", Value: "$tags"}},
+				{{Name: "$group", Value: bson.M{"_id": "$tags", "num": bson.M{"$sum": 1}}}},
+				{{Name: "$sort", Value: bson.D{{Name: "num", Value: -1}, {Name: "_id", Value: 1}}}},
+				{{Name: "$limit", Value: 2}},
+			}).All(&tags)
+			assert.NoError(t, err)
+			assert.Equal(t, []bson.M{{"_id": "dev", "num": 3}, {"_id": "admin", "num": 1}}, tags)
+
+			var doc struct {
+				Who  string
+				City string
+			}
+			err = coll.Pipe([]bson.M{
+				{"$sort": bson.M{"age": -1}},
+				{"$project": bson.M{"_id": 0, "who": "$name", "city": "$addr.city"}},
+			}).One(&doc)
+			assert.NoError(t, err)
+			assert.Equal(t, "cid", doc.Who)
+			assert.Equal(t, "paris", doc.City)
+
+			iter := coll.Pipe([]bson.M{
+				{"$unwind": bson.M{"path": "$tags", "preserveNullAndEmptyArrays": true, "includeArrayIndex": "i"}},
+				{"$match": bson.M{"name": bson.M{"$in": []string{"ann", "cid"}}}},
+				{"$project": bson.M{"_id": 0, "name": 1, "tags": 1, "i": 1}},
+			}).Iter()
+			var unwound []bson.M
+			var m bson.M
+			for iter.Next(&m) {
+				unwound = append(unwound, m)
+				m = nil
+			}
+			assert.NoError(t, iter.Close())
+			assert.Equal(t, []bson.M{
+				{"name": "ann", "tags": "admin", "i": int64(0)},
+				{"name": "ann", "tags": "dev", "i": int64(1)},
+				{"name": "cid", "i": nil},
+			}, unwound)
+
+			assert.Equal(t, db.ErrNotFound, coll.Pipe([]bson.M{{"$match": bson.M{"age": 99}}}).One(&m))
+
+			for _, pipeline := range []interface{}{
+				bson.M{"$match": bson.M{}},
+				[]bson.M{{"$match": bson.M{}, "$limit": 1}},
+				[]bson.M{{"$lookup": bson.M{}}},
+				[]bson.M{{"$sort": bson.M{"a": 1, "b": -1}}},
+				[]bson.M{{"$project": bson.M{"name": 1, "age": 0}}},
+				[]bson.M{{"$group": bson.M{"num": bson.M{"$sum": 1}}}},
+				[]bson.M{{"$group": bson.M{"_id": nil, "num": bson.M{"$median": 1}}}},
+				[]bson.M{{"$unwind": "tags"}},
+				[]bson.M{{"$limit": 0}},
+			} {
+				assert.Error(t, coll.Pipe(pipeline).All(&m), "%v", pipeline)
+			}
+		})
+	}
+
+	t.Run("Bolt transaction", func(t *testing.T) {
+		err := bolt.(db.Transactor).WithTransaction(func(tx db.Tx) error {
+			assert.NoError(t, tx.ExecOn("people").Insert(10, boltDoc{Name: "eve", Age: 50}))
+			var res []bson.M
+			assert.NoError(t, tx.ExecOn("people").Pipe([]bson.M{{"$group": bson.M{"_id": nil, "num": bson.M{"$sum": 1}}}}).All(&res))
+			assert.Equal(t, []bson.M{{"_id": nil, "num": 5}}, res)
+			return errors.New("rollback")
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("Mock", func(t *testing.T) {
+		pipeline := []bson.M{{"$match": bson.M{"name": "ann"}}}
+		p := mock.ExecOn("people").Pipe(pipeline).(*db.MockPipe)
+		var res []bson.M
+		assert.NoError(t, p.All(&res))
+		assert.Equal(t, "results", p.Res)
+		assert.Equal(t, pipeline, p.Pipeline)
+		assert.Len(t, res, 1)
+
+		assert.NoError(t, mock.ExecOn("empty").Pipe(pipeline).All(&res))
+		assert.Len(t, res, 0)
+
+		mock.InjectError(db.MockError{Method: "Pipe", Err: db.ErrNoReachableServers})
+		assert.Equal(t, db.ErrNoReachableServers, p.One(&res))
+		assert.Equal(t, db.ErrNoReachableServers, p.Iter().Close())
+	})
+
+	t.Run("Recorder", func(t *testing.T) {
+		rec := &db.Recorder{}
+		pipeline := []bson.M{{"$group": bson.M{"_id": "$city", "num": bson.M{"$sum": 1}}}}
+		rec.ExpectExecOn("people").Pipe(pipeline).All().Return([]bson.M{{"_id": "rome", "num": 2}}, nil)
+		rec.ExpectExecOn("people").Find(nil).All().Return([]bson.M{}, nil)
+
+		var res []cityStat
+		err := rec.ExecOn("people").Pipe([]interface{}{bson.M{"$group": bson.M{"_id": "$city", "num": bson.M{"$sum": int64(1)}}}}).All(&res)
+		assert.NoError(t, err)
+		assert.Equal(t, []cityStat{{City: "rome", Num: 2}}, res)
+
+		assert.Error(t, rec.ExecOn("people").Pipe(nil).All(&res), "Find expectations don't match pipelines")
+		assert.NoError(t, rec.ExecOn("people").Find(nil).All(&res))
+
+		calls := rec.Calls()
+		assert.Equal(t, `ExecOn("people").Pipe([]interface {}{}).All()`, calls[len(calls)-3].String())
+		assert.False(t, rec.AssertExpectations(&testing.T{}))
+	})
+}
+
+func TestIndexes(t *testing.T) {
+	bolt := db.New(&db.Bolt{})
+	if err := bolt.Connect("indexes.db", "people"); err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+	memory := db.New(&db.Memory{})
+	assert.NoError(t, memory.Connect())
+
+	n := 0
+	inserts := map[string]func(doc bson.M) error{
+		"Bolt": func(doc bson.M) error {
+			n++
+			return bolt.ExecOn("people").Insert(n, doc)
+		},
+		"Memory": func(doc bson.M) error {
+			return memory.ExecOn("people").Insert(doc)
+		},
+	}
+
+	for name, h := range map[string]db.Handler{"Bolt": bolt, "Memory": memory} {
+		coll, insert := h.ExecOn("people"), inserts[name]
+
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, insert(bson.M{"name": "ann", "email": "ann@x", "tags": []string{"a", "b"}}))
+			assert.NoError(t, insert(bson.M{"name": "bob", "email": "bob@x"}))
+			assert.NoError(t, insert(bson.M{"name": "ann", "email": "ann2@x"}))
+
+			assert.True(t, mgo.IsDup(coll.EnsureIndex([]string{"name"}, true, false, 0)), "records with equal values")
+			assert.NoError(t, coll.EnsureIndex([]string{"email"}, true, false, 0))
+			assert.NoError(t, coll.EnsureIndex([]string{"email"}, true, false, 0), "the same index again")
+			assert.Error(t, coll.EnsureIndex([]string{"email"}, false, false, 0), "the same keys with other options")
+			assert.True(t, mgo.IsDup(coll.EnsureIndex([]string{"name", "-age"}, true, true, 0)), "two anns without age")
+			assert.NoError(t, coll.EnsureIndex([]string{"name", "-age"}, false, false, 0))
+			assert.NoError(t, coll.EnsureIndex([]string{"tags"}, true, true, 0))
+			assert.NoError(t, coll.EnsureIndex([]string{"created"}, false, false, time.Hour))
+			assert.Error(t, coll.EnsureIndex(nil, false, false, 0))
+			assert.Error(t, coll.EnsureIndex([]string{"$text:name"}, false, false, 0))
+			assert.Error(t, coll.EnsureIndex([]string{"a", "b"}, false, false, time.Hour))
+
+			err := insert(bson.M{"name": "cid", "email": "bob@x"})
+			assert.True(t, mgo.IsDup(err), "%v", err)
+			assert.Contains(t, err.Error(), "email_1")
+			assert.True(t, mgo.IsDup(insert(bson.M{"name": "cid", "email": "cid@x", "tags": []string{"c", "b"}})), "multikey")
+			assert.NoError(t, insert(bson.M{"name": "ann", "age": 30, "email": "ann4@x"}))
+			assert.NoError(t, insert(bson.M{"email": "dan@x"}), "sparse indexes skip documents without the fields")
+			assert.NoError(t, insert(bson.M{"email": "eve@x"}))
+			assert.NoError(t, insert(bson.M{"name": "hal"}))
+			assert.True(t, mgo.IsDup(insert(bson.M{"name": "ivy"})), "a missing email is indexed as null")
+
+			assert.True(t, mgo.IsDup(coll.Update(bson.M{"email": "bob@x"}, bson.M{"$set": bson.M{"email": "ann@x"}})))
+			_, err = coll.UpdateAll(bson.M{"email": bson.M{"$in": []string{"dan@x", "eve@x"}}}, bson.M{"$set": bson.M{"email": "x@x"}})
+			assert.True(t, mgo.IsDup(err))
+			num, err := coll.Find(bson.M{"email": "x@x"}).Count()
+			assert.NoError(t, err)
+			assert.Equal(t, 0, num, "UpdateAll is rolled back")
+
+			assert.NoError(t, coll.Update(bson.M{"email": "bob@x"}, bson.M{"$set": bson.M{"email": "bob2@x"}}))
+			assert.NoError(t, insert(bson.M{"name": "bob", "email": "bob@x"}), "the old value is free")
+			assert.NoError(t, coll.Remove(bson.M{"email": "ann@x"}))
+			assert.NoError(t, insert(bson.M{"name": "fay", "email": "ann@x", "tags": []string{"a"}}), "the values of a removed record are free")
+
+			indexes, err := coll.Indexes()
+			assert.NoError(t, err)
+			var names []string
+			for _, idx := range indexes {
+				names = append(names, idx.Name)
+			}
+			assert.Equal(t, []string{"_id_", "created_1", "email_1", "name_1_age_-1", "tags_1"}, names)
+			assert.Equal(t, mgo.Index{Key: []string{"created"}, ExpireAfter: time.Hour, Name: "created_1"}, indexes[len(indexes)-4])
+
+			assert.NoError(t, coll.DropIndex("email"))
+			assert.Error(t, coll.DropIndex("email"))
+			assert.NoError(t, insert(bson.M{"name": "gus", "email": "ann@x"}), "the index is dropped")
+		})
+	}
+
+	t.Run("Bolt transaction", func(t *testing.T) {
+		err := bolt.(db.Transactor).WithTransaction(func(tx db.Tx) error {
+			coll := tx.ExecOn("people")
+			assert.NoError(t, coll.EnsureIndex([]string{"nick"}, true, true, 0))
+			assert.NoError(t, coll.Insert(100, bson.M{"nick": "z"}))
+			err := coll.Insert(101, bson.M{"nick": "z"})
+			assert.True(t, mgo.IsDup(err))
+			return err
+		})
+		assert.Error(t, err)
+		indexes, err := bolt.ExecOn("people").Indexes()
+		assert.NoError(t, err)
+		assert.Len(t, indexes, 4, "EnsureIndex is rolled back")
+		assert.Error(t, bolt.ExecOn("missing").EnsureIndex([]string{"a"}, false, false, 0))
+	})
+
+	t.Run("Bolt persistent", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "indexes")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "people.db")
+
+		h := db.New(&db.Bolt{})
+		assert.NoError(t, h.Connect(db.WithPath(path), db.WithBuckets("people")))
+		assert.NoError(t, h.ExecOn("people").EnsureIndex([]string{"email"}, true, false, 0))
+		assert.NoError(t, h.ExecOn("people").Insert(1, bson.M{"email": "a@x"}))
+		h.Close()
+
+		assert.NoError(t, h.Connect(db.WithPath(path)))
+		defer h.Close()
+		assert.True(t, mgo.IsDup(h.ExecOn("people").Insert(2, bson.M{"email": "a@x"})))
+		assert.NoError(t, h.ExecOn("people").Insert(1, bson.M{"email": "a@x", "name": "ann"}), "a record keeps its own values")
+	})
+
+	t.Run("Mock", func(t *testing.T) {
+		mock := &db.Mock{}
+		mock.Seed("people", bson.M{"email": "ann@x"})
+		coll := mock.ExecOn("people")
+
+		assert.NoError(t, coll.EnsureIndex([]string{"email"}, true, false, 0))
+		assert.NoError(t, coll.EnsureIndex([]string{"-age"}, false, false, 0))
+		assert.True(t, mgo.IsDup(coll.Insert(bson.M{"email": "ann@x"})))
+		assert.True(t, mgo.IsDup(coll.Insert(bson.M{"email": "bob@x"}, bson.M{"email": "bob@x"})))
+		assert.NoError(t, coll.Insert(bson.M{"email": "bob@x"}))
+		assert.NoError(t, coll.Insert(bson.M{"email": "bob@x"}), "inserted documents aren't kept")
+
+		indexes, err := coll.Indexes()
+		assert.NoError(t, err)
+		assert.Equal(t, []mgo.Index{
+			{Key: []string{"_id"}, Name: "_id_"},
+			{Key: []string{"-age"}, Name: "age_-1"},
+			{Key: []string{"email"}, Unique: true, Name: "email_1"},
+		}, indexes)
+		assert.NoError(t, coll.DropIndex("email"))
+		assert.NoError(t, coll.Insert(bson.M{"email": "ann@x"}))
+
+		mock.InjectError(db.MockError{Method: "Indexes", Err: db.ErrNoReachableServers})
+		_, err = coll.Indexes()
+		assert.Equal(t, db.ErrNoReachableServers, err)
+	})
+
+	t.Run("Mock collection w/o state", func(t *testing.T) {
+		coll := &db.MockCollection{}
+		assert.NoError(t, coll.EnsureIndex([]string{"email"}, true, false, 0))
+		assert.Error(t, coll.EnsureIndex(nil, false, false, 0))
+		assert.Error(t, coll.DropIndex("email"))
+		indexes, err := coll.Indexes()
+		assert.NoError(t, err)
+		assert.Equal(t, []mgo.Index{{Key: []string{"_id"}, Name: "_id_"}}, indexes)
+	})
+
+	t.Run("Recorder", func(t *testing.T) {
+		rec := &db.Recorder{}
+		idx := []mgo.Index{{Key: []string{"email"}, Unique: true, Name: "email_1"}}
+		rec.ExpectExecOn("people").EnsureIndex([]string{"email"}, true, db.Any, time.Duration(0)).Return(nil)
+		rec.ExpectExecOn("people").Indexes().Return(idx, nil)
+		rec.ExpectExecOn("people").DropIndex("email").Return(errors.New("index not found"))
+
+		coll := rec.ExecOn("people")
+		assert.NoError(t, coll.EnsureIndex([]string{"email"}, true, false, 0))
+		indexes, err := coll.Indexes()
+		assert.NoError(t, err)
+		assert.Equal(t, idx, indexes)
+		assert.Error(t, coll.DropIndex("email"))
+		assert.Error(t, coll.DropIndex("name"), "unexpected")
+		assert.False(t, rec.AssertExpectations(&testing.T{}))
+	})
+}
+
+func TestBoltIndexQueries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indexqueries")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "people.db")
+
+	h := db.New(&db.Bolt{})
+	assert.NoError(t, h.Connect(db.WithPath(path), db.WithBuckets("people")))
+	coll := h.ExecOn("people")
+	docs := []bson.M{
+		{"name": "ann", "age": 30, "tags": []string{"a", "b"}, "addr": []bson.M{{"city": "Oslo"}, {"city": "Rome"}}},
+		{"name": "bob", "age": 25.5, "tags": []string{"b"}, "addr": []bson.M{{"city": "Rome"}}},
+		{"name": "cid", "age": "old"},
+		{"name": "dan", "age": 41},
+		{"name": "eve"},
+		{"name": "fay", "age": nil, "tags": nil},
+	}
+	for i, doc := range docs {
+		assert.NoError(t, coll.Insert(i+1, doc))
+	}
+	assert.NoError(t, coll.EnsureIndex([]string{"name"}, true, false, 0))
+	assert.NoError(t, coll.EnsureIndex([]string{"age"}, false, false, 0))
+	assert.NoError(t, coll.EnsureIndex([]string{"tags"}, false, true, 0))
+	assert.NoError(t, coll.EnsureIndex([]string{"addr.city"}, false, false, 0))
+
+	names := func(selector bson.M) []string {
+		var found []boltDoc
+		assert.NoError(t, coll.Find(selector).All(&found), "%v", selector)
+		res := []string{}
+		for _, doc := range found {
+			res = append(res, doc.Name)
+		}
+		return res
+	}
+	for _, c := range []struct {
+		selector bson.M
+		expected []string
+	}{
+		{bson.M{"name": "bob"}, []string{"bob"}},
+		{bson.M{"name": bson.M{"$in": []string{"eve", "ann", "zed"}}}, []string{"ann", "eve"}},
+		{bson.M{"name": "ann", "age": 31}, []string{}},
+		{bson.M{"age": 30.0}, []string{"ann"}},
+		{bson.M{"age": bson.M{"$gt": 25.5}}, []string{"ann", "dan"}},
+		{bson.M{"age": bson.M{"$gte": 25.5, "$lt": 41}}, []string{"ann", "bob"}},
+		{bson.M{"age": bson.M{"$lte": 30}}, []string{"ann", "bob"}},
+		{bson.M{"age": bson.M{"$gt": "a"}}, []string{"cid"}},
+		{bson.M{"age": nil}, []string{"eve", "fay"}},
+		{bson.M{"tags": "b"}, []string{"ann", "bob"}},
+		{bson.M{"tags": nil}, []string{"cid", "dan", "eve", "fay"}},
+		{bson.M{"tags": []string{"b"}}, []string{"bob"}},
+		{bson.M{"addr.city": "Rome"}, []string{"ann", "bob"}},
+		{bson.M{"addr.city": bson.M{"$lt": "P"}}, []string{"ann"}},
+	} {
+		assert.Equal(t, c.expected, names(c.selector), "%v", c.selector)
+	}
+
+	var doc boltDoc
+	it := coll.Find(bson.M{"tags": "b"}).Iter()
+	assert.True(t, it.Next(&doc))
+	assert.Equal(t, "ann", doc.Name)
+	assert.True(t, it.Next(&doc))
+	assert.Equal(t, "bob", doc.Name)
+	assert.False(t, it.Next(&doc))
+	assert.NoError(t, it.Close())
+
+	assert.NoError(t, coll.Update(bson.M{"name": "bob"}, bson.M{"$set": bson.M{"age": 50}, "$unset": bson.M{"tags": 1}}))
+	assert.NoError(t, coll.Remove(bson.M{"name": "dan"}))
+	assert.Equal(t, []string{"bob"}, names(bson.M{"age": bson.M{"$gt": 40}}))
+	assert.Equal(t, []string{"ann"}, names(bson.M{"tags": "b"}))
+	num, err := coll.UpdateAll(bson.M{"age": bson.M{"$lt": 100}}, bson.M{"$inc": bson.M{"age": 1}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, num)
+	assert.Equal(t, []string{"ann", "bob"}, names(bson.M{"age": bson.M{"$in": []int{31, 51}}}))
+	h.Close()
+
+	//records written bypassing the package aren't indexed until the rebuild
+	raw, err := boltdb.Open(path, 0600, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, raw.Update(func(tx *boltdb.Tx) error {
+		bkt := tx.Bucket([]byte("people"))
+		_, ann := bkt.Cursor().First()
+		return bkt.Put([]byte("copy"), append([]byte(nil), ann...))
+	}))
+	raw.Close()
+
+	assert.NoError(t, h.Connect(db.WithPath(path)))
+	defer h.Close()
+	coll = h.ExecOn("people")
+	num, err = coll.Find(bson.M{"age": 31}).Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, num, "the stale index misses the copy")
+	assert.True(t, mgo.IsDup(h.(*db.Bolt).RebuildIndexes()), "the copy breaks the unique name index")
+	assert.NoError(t, coll.DropIndex("name"))
+	assert.NoError(t, h.(*db.Bolt).RebuildIndexes())
+	num, err = coll.Find(bson.M{"age": 31}).Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, num)
+	assert.Equal(t, []string{"ann", "ann"}, names(bson.M{"addr.city": "Oslo"}))
+	assert.Error(t, h.(*db.Bolt).RebuildIndexes("nothing"))
+}
+
+//upperCodec is a custom codec storing JSON in upper case
+type upperCodec struct{ db.JSONCodec }
+
+func (upperCodec) Name() string { return "upper-json" }
+
+func (c upperCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := c.JSONCodec.Marshal(v)
+	return bytes.ToUpper(data), err
+}
+
+func (c upperCodec) Unmarshal(data []byte, v interface{}) error {
+	return c.JSONCodec.Unmarshal(bytes.ToLower(data), v)
+}
+
+func TestBoltCodecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codecs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	id := bson.NewObjectId()
+	for _, codec := range []db.Codec{db.GobCodec{}, db.JSONCodec{}, db.BSONCodec{}} {
+		path := filepath.Join(dir, codec.Name()+".db")
+
+		t.Run(codec.Name(), func(t *testing.T) {
+			h := db.New(&db.Bolt{})
+			assert.NoError(t, h.Connect(db.WithPath(path), db.WithBuckets("people"), db.WithCodec(codec)))
+			coll := h.ExecOn("people")
+			assert.NoError(t, coll.EnsureIndex([]string{"rating"}, false, false, 0))
+			assert.NoError(t, coll.Insert("ann", boltDoc{Name: "ann", Age: 30, Tags: []string{"a"}, Score: 4.5}))
+			assert.NoError(t, coll.Insert("bob", bson.M{"name": "bob", "ref": id, "rating": 2}))
+			if codec.Name() == "bson" {
+				assert.Error(t, coll.Insert("num", 42), "bson stores documents only")
+			} else {
+				assert.NoError(t, coll.Insert("num", 42))
+			}
+			assert.NoError(t, coll.Update(bson.M{"name": "ann"}, bson.M{"$inc": bson.M{"age": 1}}))
+			h.Close()
+
+			assert.NoError(t, h.Connect(db.WithPath(path)), "the codec is read from the db")
+			coll = h.ExecOn("people")
+			var doc boltDoc
+			assert.NoError(t, coll.Find(bson.M{"rating": bson.M{"$gt": 4}}).One(&doc))
+			assert.Equal(t, boltDoc{Name: "ann", Age: 31, Tags: []string{"a"}, Score: 4.5}, doc)
+			var m bson.M
+			assert.NoError(t, coll.Find(bson.M{"ref": id}).One(&m))
+			assert.Equal(t, "bob", m["name"])
+			names := []string{}
+			assert.NoError(t, coll.Find(nil).Distinct("name", &names))
+			assert.Equal(t, []string{"ann", "bob"}, names)
+			h.Close()
+
+			for _, other := range []db.Codec{db.GobCodec{}, db.JSONCodec{}, db.BSONCodec{}} {
+				if other.Name() != codec.Name() {
+					assert.Error(t, h.Connect(db.WithPath(path), db.WithCodec(other)))
+				}
+			}
+		})
+	}
+
+	t.Run("Readable", func(t *testing.T) {
+		raw, err := boltdb.Open(filepath.Join(dir, "json.db"), 0600, &boltdb.Options{ReadOnly: true})
+		assert.NoError(t, err)
+		defer raw.Close()
+		assert.NoError(t, raw.View(func(tx *boltdb.Tx) error {
+			assert.Equal(t, "json", string(tx.Bucket([]byte("$meta")).Get([]byte("codec"))))
+			found := 0
+			tx.Bucket([]byte("people")).ForEach(func(k, v []byte) error {
+				if bytes.Contains(v, []byte(`"rating":4.5`)) || bytes.Contains(v, []byte(`{"$oid":"`+id.Hex()+`"}`)) {
+					found++
+				}
+				return nil
+			})
+			assert.Equal(t, 2, found, "bson field names and extended json")
+			return nil
+		}))
+	})
+
+	t.Run("Custom", func(t *testing.T) {
+		path := filepath.Join(dir, "custom.db")
+		h := db.New(&db.Bolt{})
+		assert.NoError(t, h.Connect(db.WithPath(path), db.WithCodec(upperCodec{})))
+		assert.NoError(t, h.ExecOn().Insert(1, bson.M{"name": "ann"}))
+		h.Close()
+
+		assert.Error(t, h.Connect(db.WithPath(path)), "the codec isn't registered")
+		db.RegisterCodec(upperCodec{})
+		assert.NoError(t, h.Connect(db.WithPath(path)))
+		defer h.Close()
+		num, err := h.ExecOn().Find(bson.M{"name": "ann"}).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, num)
+
+		assert.Error(t, h.Connect(db.WithPath(filepath.Join(dir, "gob.db")), db.WithCodec(nil)))
+	})
+
+	t.Run("Legacy", func(t *testing.T) {
+		path := filepath.Join(dir, "legacy.db")
+		h := db.New(&db.Bolt{})
+		assert.NoError(t, h.Connect(db.WithPath(path)))
+		assert.NoError(t, h.ExecOn().Insert(1, bson.M{"name": "ann"}))
+		h.Close()
+
+		//the files made before the meta bucket have gob keys
+		var key bytes.Buffer
+		assert.NoError(t, gob.NewEncoder(&key).Encode(1))
+		raw, err := boltdb.Open(path, 0600, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, raw.Update(func(tx *boltdb.Tx) error {
+			bkt := tx.Bucket([]byte("default"))
+			k, v := bkt.Cursor().First()
+			v = append([]byte(nil), v...)
+			if err := bkt.Delete(k); err != nil {
+				return err
+			}
+			if err := bkt.Put(key.Bytes(), v); err != nil {
+				return err
+			}
+			return tx.DeleteBucket([]byte("$meta"))
+		}))
+		raw.Close()
+
+		//and values encoded as plain interface values
+		var legacy bytes.Buffer
+		var value interface{} = map[string]interface{}{"name": "bob"}
+		gob.Register(value)
+		assert.NoError(t, gob.NewEncoder(&legacy).Encode(&value))
+		var key2 bytes.Buffer
+		assert.NoError(t, gob.NewEncoder(&key2).Encode(2))
+		raw, err = boltdb.Open(path, 0600, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, raw.Update(func(tx *boltdb.Tx) error {
+			return tx.Bucket([]byte("default")).Put(key2.Bytes(), legacy.Bytes())
+		}))
+		raw.Close()
+
+		assert.Error(t, h.Connect(db.WithPath(path), db.WithCodec(db.JSONCodec{})), "records without the codec name are gob")
+		assert.NoError(t, h.Connect(db.WithPath(path)))
+		defer h.Close()
+		var doc bson.M
+		assert.NoError(t, h.ExecOn().Find(1).One(&doc))
+		assert.Equal(t, "ann", doc["name"])
+		assert.NoError(t, h.ExecOn().Find(bson.M{"name": "bob"}).One(&doc))
+		assert.Equal(t, "bob", doc["name"])
+	})
+
+	t.Run("Conflicting gob name", func(t *testing.T) {
+		gob.RegisterName(reflect.TypeOf(gobClash{}).PkgPath()+".gobClash", gobOther{})
+		h := db.New(&db.Bolt{})
+		assert.NoError(t, h.Connect("gobclash"))
+		defer h.Close()
+		err := h.ExecOn().Insert("key", gobClash{Name: "ann"})
+		assert.Error(t, err, "the name of gobClash is taken")
+		assert.Contains(t, err.Error(), "gobClash")
+	})
+}
+
+type gobClash struct{ Name string }
+
+type gobOther struct{ Name string }
+
+//gobReopenDoc is stored by TestBoltGobReopen and read by its child process which doesn't know the type
+type gobReopenDoc struct {
+	Name string
+	Age  int
+}
+
+func TestBoltGobReopen(t *testing.T) {
+	if path := os.Getenv("BOLT_GOB_REOPEN"); path != "" {
+		h := db.New(&db.Bolt{})
+		assert.NoError(t, h.Connect(db.WithPath(path)))
+		defer h.Close()
+		coll := h.ExecOn("people")
+
+		num, err := coll.Find(bson.M{"name": "ann"}).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, num, "a selector query in a fresh process")
+		var doc bson.M
+		assert.NoError(t, coll.Find(bson.M{"age": bson.M{"$gt": 25}}).One(&doc))
+		assert.Equal(t, bson.M{"name": "bob", "age": 30}, doc)
+		var names []string
+		assert.NoError(t, coll.Find(nil).Sort("-age").Distinct("name", &names))
+		assert.Equal(t, []string{"ann", "bob"}, names)
+		assert.NoError(t, coll.EnsureIndex([]string{"age"}, false, false, 0), "the index is filled")
+		var docs []gobReopenDoc
+		assert.NoError(t, coll.Find(nil).Sort("age").All(&docs))
+		assert.Equal(t, []gobReopenDoc{{"ann", 20}, {"bob", 30}}, docs)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "gobreopen")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "people.db")
+	h := db.New(&db.Bolt{})
+	assert.NoError(t, h.Connect(db.WithPath(path), db.WithBuckets("people")))
+	assert.NoError(t, h.ExecOn("people").Insert(1, &gobReopenDoc{Name: "ann", Age: 20}))
+	assert.NoError(t, h.ExecOn("people").Insert(2, gobReopenDoc{Name: "bob", Age: 30}))
+	h.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestBoltGobReopen$")
+	cmd.Env = append(os.Environ(), "BOLT_GOB_REOPEN="+path)
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, "%s", out)
+}
+
+func TestBoltKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.db")
+
+	type tenantKey struct {
+		Tenant string
+		Seq    int
+	}
+	id := bson.NewObjectId()
+	h := db.New(&db.Bolt{})
+	assert.NoError(t, h.Connect(db.WithPath(path), db.WithBuckets("numbers", "tenants")))
+	coll := h.ExecOn()
+	assert.NoError(t, coll.Insert("ann", bson.M{"name": "ann"}))
+	assert.NoError(t, coll.Insert(id, bson.M{"name": "oid"}))
+	for _, n := range []int{10, -3, 2} {
+		assert.NoError(t, h.ExecOn("numbers").Insert(n, bson.M{"n": n}))
+	}
+	assert.NoError(t, h.ExecOn("tenants").Insert(tenantKey{"acme", 2}, bson.M{"seq": 2}))
+	assert.NoError(t, h.ExecOn("tenants").Insert([]interface{}{"acme", 1}, bson.M{"seq": 1}))
+
+	for _, key := range []interface{}{2, int64(2), int8(2), uint(2), 2.0} {
+		num, err := h.ExecOn("numbers").Find(key).Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, num, "%T", key)
+	}
+	var doc bson.M
+	assert.NoError(t, coll.Find(string(id)).One(&doc), "an ObjectId is its raw bytes")
+	assert.Equal(t, "oid", doc["name"])
+	assert.NoError(t, h.ExecOn("tenants").Find(tenantKey{"acme", 1}).One(&doc), "structs and slices are tuples")
+	assert.Equal(t, 1, doc["seq"])
+
+	var numbers []bson.M
+	assert.NoError(t, h.ExecOn("numbers").Find(nil).All(&numbers))
+	assert.Equal(t, []bson.M{{"n": -3}, {"n": 2}, {"n": 10}}, numbers, "integer keys are ordered")
+
+	for _, key := range []interface{}{2.5, uint64(1 << 63), []interface{}{"a", []int{1}}, []int{}, struct{}{}, (*int)(nil), make(chan int)} {
+		assert.Error(t, h.ExecOn("numbers").Insert(key, bson.M{}), "%#v", key)
+	}
+	h.Close()
+
+	raw, err := boltdb.Open(path, 0600, &boltdb.Options{ReadOnly: true})
+	assert.NoError(t, err)
+	defer raw.Close()
+	assert.NoError(t, raw.View(func(tx *boltdb.Tx) error {
+		assert.Equal(t, "ordered", string(tx.Bucket([]byte("$meta")).Get([]byte("keys"))))
+		assert.NotNil(t, tx.Bucket([]byte("default")).Get([]byte("ann")), "strings are UTF-8")
+		assert.NotNil(t, tx.Bucket([]byte("default")).Get([]byte(id)))
+		assert.NotNil(t, tx.Bucket([]byte("numbers")).Get([]byte{0x80, 0, 0, 0, 0, 0, 0, 10}), "big-endian with the sign bit flipped")
+		assert.NotNil(t, tx.Bucket([]byte("tenants")).Get([]byte("acme\x00\x01\x80\x00\x00\x00\x00\x00\x00\x02")))
+		return nil
+	}))
+}
+
+type boltUser struct {
+	ID   bson.ObjectId `bson:"_id,omitempty"`
+	Name string
+}
+
+type boltSeqUser struct {
+	ID   int64 `bson:"_id"`
+	Name string
+}
+
+func TestBoltInsertDocuments(t *testing.T) {
+	h := db.New(&db.Bolt{})
+	assert.NoError(t, h.Connect("insertdocs", "users", "seq"))
+	defer h.Close()
+	users := h.ExecOn("users")
+
+	ann := &boltUser{Name: "ann"}
+	bob := bson.M{"name": "bob"}
+	cid := bson.D{{Name: "name", Value: "cid"}}
+	id := bson.NewObjectId()
+	assert.NoError(t, users.Insert(ann, bob, &cid, bson.M{"_id": id, "name": "dan"}, boltUser{Name: "eve"}))
+	assert.True(t, ann.ID.Valid(), "the generated _id is written back")
+	assert.IsType(t, bson.ObjectId(""), bob["_id"])
+	assert.Equal(t, "_id", cid[0].Name)
+
+	var doc boltUser
+	assert.NoError(t, users.Find(ann.ID).One(&doc), "the _id is the key")
+	assert.Equal(t, *ann, doc)
+	assert.NoError(t, users.Find(bson.M{"_id": bob["_id"]}).One(&doc))
+	assert.Equal(t, "bob", doc.Name)
+	assert.NoError(t, users.Find(cid[0].Value).One(&doc))
+	assert.Equal(t, "cid", doc.Name)
+	assert.NoError(t, users.Find(id).One(&doc))
+	assert.Equal(t, boltUser{ID: id, Name: "dan"}, doc)
+	num, err := users.Find(bson.M{"name": "eve"}).Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, num)
+
+	err = users.Insert(bson.M{"name": "fay"}, &boltUser{ID: id, Name: "gus"})
+	assert.True(t, mgo.IsDup(err), "%v", err)
+	num, err = users.Find(bson.M{"name": "fay"}).Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, num, "the documents are inserted atomically")
+	assert.True(t, mgo.IsDup(users.Insert(bson.M{"_id": 1}, bson.M{"_id": 1.0})), "a duplicate inside the call")
+	assert.Error(t, users.Insert(bson.M{"name": "hal"}, "not a document"))
+	assert.Error(t, users.Insert())
+
+	seq := h.ExecOn("seq")
+	a, b := &boltSeqUser{Name: "a"}, &boltSeqUser{Name: "b"}
+	assert.NoError(t, seq.Insert(a, b))
+	assert.Equal(t, []int64{1, 2}, []int64{a.ID, b.ID}, "integer _id fields get the bucket sequence")
+	assert.NoError(t, seq.Insert(&boltSeqUser{ID: 10, Name: "c"}))
+	var all []boltSeqUser
+	assert.NoError(t, seq.Find(nil).All(&all))
+	assert.Equal(t, []boltSeqUser{{1, "a"}, {2, "b"}, {10, "c"}}, all)
+
+	assert.NoError(t, users.Insert("key", bson.M{"name": "ivy"}), "key, value")
+	assert.NoError(t, users.Insert("key", bson.M{"name": "jay"}), "key, value replaces the value")
+	assert.NoError(t, users.Find("key").One(&doc))
+	assert.Equal(t, "jay", doc.Name)
+}
+
+func TestBoltReplacementKeepsID(t *testing.T) {
+	h := db.New(&db.Bolt{})
+	assert.NoError(t, h.Connect("replace", "users", "seq"))
+	defer h.Close()
+	users := h.ExecOn("users")
+
+	id := bson.NewObjectId()
+	assert.NoError(t, users.Insert(bson.M{"_id": id, "name": "ann"}))
+	assert.NoError(t, users.Update(bson.M{"_id": id}, bson.M{"name": "bob"}))
+	var doc bson.M
+	assert.NoError(t, users.Find(bson.M{"_id": id}).One(&doc), "the replacement keeps the _id")
+	assert.Equal(t, bson.M{"_id": id, "name": "bob"}, doc)
+	assert.NoError(t, users.Update(bson.M{"name": "bob"}, &boltUser{Name: "cid"}))
+	var user boltUser
+	assert.NoError(t, users.Find(bson.M{"_id": id}).One(&user))
+	assert.Equal(t, boltUser{ID: id, Name: "cid"}, user)
+
+	id2 := bson.NewObjectId()
+	_, err := users.Upsert(bson.M{"_id": id2}, bson.M{"name": "dan"})
+	assert.NoError(t, err)
+	assert.NoError(t, users.Find(bson.M{"_id": id2}).One(&doc), "the upserted replacement gets the _id of the selector")
+	assert.Equal(t, bson.M{"_id": id2, "name": "dan"}, doc)
+	_, err = users.Upsert(bson.M{"_id": id2}, bson.M{"name": "eve"})
+	assert.NoError(t, err)
+	assert.NoError(t, users.Find(bson.M{"_id": id2}).One(&doc))
+	assert.Equal(t, "eve", doc["name"])
+	num, err := users.Find(nil).Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, num)
+
+	seq := h.ExecOn("seq")
+	assert.NoError(t, seq.Insert(&boltSeqUser{Name: "a"}))
+	assert.NoError(t, seq.Update(bson.M{"_id": 1}, boltSeqUser{Name: "b"}))
+	var all []boltSeqUser
+	assert.NoError(t, seq.Find(bson.M{"_id": 1}).All(&all), "an integer _id is converted to the field type")
+	assert.Equal(t, []boltSeqUser{{1, "b"}}, all)
+
+	assert.NoError(t, users.Insert("key", &db.Mock{Msg: "test"}))
+	assert.NoError(t, users.Update("key", &db.Mock{Msg: "updated"}), "records without _id are replaced as they are")
+	var res db.Mock
+	assert.NoError(t, users.Find("key").One(&res))
+	assert.Equal(t, "updated", res.Msg)
+}
+
+func TestBoltKeyRanges(t *testing.T) {
+	h := db.New(&db.Bolt{})
+	assert.NoError(t, h.Connect("keyranges", "numbers", "events", "users"))
+	defer h.Close()
+
+	numbers := h.ExecOn("numbers")
+	for n := -3; n <= 10; n++ {
+		assert.NoError(t, numbers.Insert(n, bson.M{"n": n}))
+	}
+	ns := func(query interface{}) []int {
+		var docs []bson.M
+		assert.NoError(t, numbers.Find(query).All(&docs), "%#v", query)
+		res := []int{}
+		for _, doc := range docs {
+			res = append(res, doc["n"].(int))
+		}
+		return res
+	}
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, ns(db.KeyRange{From: 0, To: 5}))
+	assert.Equal(t, []int{4, 3, 2, 1, 0}, ns(&db.KeyRange{From: 0, To: 5, Reverse: true}))
+	assert.Equal(t, []int{8, 9, 10}, ns(db.KeyRange{From: 8}))
+	assert.Equal(t, []int{-3, -2}, ns(db.KeyRange{To: int64(-1)}))
+	assert.Equal(t, []int{-2, -3}, ns(db.KeyRange{To: -1.0, Reverse: true}))
+	assert.Equal(t, []int{10, 9}, ns(db.KeyRange{From: 9, To: 100, Reverse: true}))
+	assert.Equal(t, []int{}, ns(db.KeyRange{From: 5, To: 5}))
+	assert.Equal(t, []int{6}, ns(bson.M{"n": bson.M{"$gt": 5, "$lt": 7}}))
+
+	var doc bson.M
+	assert.NoError(t, numbers.Find(db.KeyRange{Reverse: true}).One(&doc))
+	assert.Equal(t, 10, doc["n"], "the last key first")
+	num, err := numbers.Find(db.KeyRange{From: -3, To: 0}).Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, num)
+	num, err = numbers.RemoveAll(db.KeyRange{From: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, 6, num)
+	assert.Equal(t, []int{3, 4}, ns(db.KeyRange{From: 3}))
+	assert.Error(t, numbers.Find(db.KeyRange{From: 2.5}).One(&doc))
+	assert.Error(t, numbers.Find(db.KeyPrefix{}).One(&doc))
+
+	events := h.ExecOn("events")
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, tenant := range []string{"acme", "acme2", "acme", "bolt", "acme"} {
+		assert.NoError(t, events.Insert([]interface{}{tenant, start.Add(time.Duration(i) * time.Hour)}, bson.M{"i": i}))
+	}
+	is := func(query interface{}) []int {
+		res := []int{}
+		var doc bson.M
+		it := events.Find(query).Iter()
+		for it.Next(&doc) {
+			res = append(res, doc["i"].(int))
+		}
+		assert.NoError(t, it.Close())
+		return res
+	}
+	assert.Equal(t, []int{0, 2, 4}, is(db.KeyPrefix{Prefix: []interface{}{"acme"}}), "acme2 isn't a tenant of acme")
+	assert.Equal(t, []int{4, 2, 0}, is(db.KeyPrefix{Prefix: []interface{}{"acme"}, Reverse: true}))
+	assert.Equal(t, []int{0, 2, 4, 1}, is(db.KeyPrefix{Prefix: "acme"}))
+	assert.Equal(t, []int{1, 4, 2, 0}, is(&db.KeyPrefix{Prefix: "acme", Reverse: true}))
+	assert.Equal(t, []int{2}, is(db.KeyRange{From: []interface{}{"acme", start.Add(time.Hour)}, To: []interface{}{"acme", start.Add(4 * time.Hour)}}))
+	assert.Equal(t, []int{}, is(db.KeyPrefix{Prefix: "c"}))
+
+	users := h.ExecOn("users")
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, users.Insert(&boltSeqUser{Name: fmt.Sprint("u", i)}))
+	}
+	assert.NoError(t, users.Insert([]byte{0xff, 0xff}, bson.M{"name": "max"}))
+	var found []boltSeqUser
+	assert.NoError(t, users.Find(bson.M{"_id": bson.M{"$gt": 2, "$lte": 4}}).All(&found), "an _id range is sought")
+	assert.Equal(t, []boltSeqUser{{3, "u2"}, {4, "u3"}}, found)
+	assert.NoError(t, users.Find(bson.M{"_id": 5}).All(&found))
+	assert.Equal(t, []boltSeqUser{{5, "u4"}}, found)
+	assert.NoError(t, users.Find(db.KeyPrefix{Prefix: []byte{0xff}}).One(&doc), "a prefix without the end")
+	assert.Equal(t, "max", doc["name"])
+}
+
+func TestBoltKeysOtherThanID(t *testing.T) {
+	h := db.New(&db.Bolt{})
+	assert.NoError(t, h.Connect("keysotherthanid", "kv", "docs"))
+	defer h.Close()
+
+	count := func(coll db.Querier, query interface{}) int {
+		num, err := coll.Find(query).Count()
+		assert.NoError(t, err)
+		return num
+	}
+	kv := h.ExecOn("kv")
+	assert.NoError(t, kv.Insert("k1", bson.M{"_id": "x", "name": "ann"}))
+	assert.Equal(t, 1, count(kv, bson.M{"_id": "x"}), "the key isn't the _id")
+	assert.Equal(t, 1, count(kv, bson.M{"_id": bson.M{"$gte": "x"}}))
+	var doc bson.M
+	it := kv.Find(bson.M{"_id": "x"}).Iter()
+	assert.True(t, it.Next(&doc))
+	assert.NoError(t, it.Close())
+	_, err := kv.Upsert(bson.M{"_id": "x"}, bson.M{"$set": bson.M{"age": 20}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count(kv, nil), "the record is updated, not added")
+	assert.NoError(t, kv.Find("k1").One(&doc))
+	assert.Equal(t, 20, doc["age"])
+	assert.NoError(t, kv.Update(bson.M{"_id": "x"}, bson.M{"$inc": bson.M{"age": 1}}))
+	assert.Equal(t, 1, count(kv, bson.M{"age": 21}))
+	assert.NoError(t, kv.Remove(bson.M{"_id": "x"}))
+	assert.Equal(t, 0, count(kv, nil))
+
+	docs := h.ExecOn("docs")
+	assert.NoError(t, docs.Insert(bson.M{"_id": "a"}, bson.M{"_id": "b"}))
+	assert.Equal(t, 1, count(docs, bson.M{"_id": "b"}))
+	assert.NoError(t, docs.Insert("c", bson.M{"_id": "c"}), "the key is the _id")
+	assert.NoError(t, docs.Insert("k", bson.M{"_id": "d"}), "a record under another key")
+	assert.Equal(t, 1, count(docs, bson.M{"_id": "d"}))
+	assert.Equal(t, 2, count(docs, bson.M{"_id": bson.M{"$gt": "b"}}))
+}
+
+func TestBoltNestedBuckets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nested")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.db")
+
+	h := db.New(&db.Bolt{})
+	assert.NoError(t, h.Connect(db.WithPath(path), db.WithCollections("app", "users", "orders"), db.WithBuckets("users")))
+	users := h.ExecOn("app", "users")
+	assert.NoError(t, users.Insert(&boltSeqUser{Name: "ann"}, &boltSeqUser{Name: "bob"}))
+	assert.NoError(t, h.ExecOn("app", "orders").Insert(bson.M{"_id": 1, "user": "ann"}))
+	assert.Error(t, h.ExecOn("app", "carts").Insert(bson.M{"_id": 1}), "a missing collection without db.WithAutoCreate")
+	assert.Error(t, h.ExecOn("shop", "users").Find(nil).One(&bson.M{}))
+	assert.Error(t, (&db.Bolt{}).Connect(db.WithDSN("nested"), db.WithCollections("app")))
+
+	var found []boltSeqUser
+	assert.NoError(t, users.Find(nil).All(&found))
+	assert.Equal(t, []boltSeqUser{{1, "ann"}, {2, "bob"}}, found)
+	num, err := h.ExecOn("app", "orders").Find(nil).Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, num, "collections of a database are apart")
+	assert.NoError(t, h.ExecOn("", "users").Insert("key", bson.M{"top": true}))
+	num, err = h.ExecOn("users").Find(nil).Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, num, "an empty database name gives a top-level bucket")
+
+	assert.NoError(t, users.EnsureIndex([]string{"name"}, true, false, 0))
+	err = users.Insert(&boltSeqUser{Name: "ann"})
+	assert.True(t, mgo.IsDup(err))
+	assert.Contains(t, err.Error(), "app.users")
+	indexes, err := users.Indexes()
+	assert.NoError(t, err)
+	assert.Len(t, indexes, 2)
+	indexes, err = h.ExecOn("app", "orders").Indexes()
+	assert.NoError(t, err)
+	assert.Equal(t, []mgo.Index{{Key: []string{"_id"}, Name: "_id_"}}, indexes)
+	h.Close()
+
+	raw, err := boltdb.Open(path, 0600, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, raw.Update(func(tx *boltdb.Tx) error {
+		app := tx.Bucket([]byte("app"))
+		assert.NotNil(t, app, "the database is a top-level bucket")
+		assert.NotNil(t, app.Bucket([]byte("orders")))
+		bkt := app.Bucket([]byte("users"))
+		_, ann := bkt.Cursor().First()
+		return bkt.Put([]byte("copy"), append([]byte(nil), ann...))
+	}))
+	raw.Close()
+
+	assert.NoError(t, h.Connect(db.WithPath(path), db.WithAutoCreate()))
+	defer h.Close()
+	assert.True(t, mgo.IsDup(h.(*db.Bolt).RebuildIndexes()), "the nested collection is rebuilt")
+	assert.NoError(t, h.ExecOn("app", "users").DropIndex("name"))
+	assert.NoError(t, h.(*db.Bolt).RebuildIndexes())
+
+	carts := h.ExecOn("shop", "carts")
+	num, err = carts.Find(nil).Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, num, "a missing collection is empty")
+	var doc bson.M
+	assert.Equal(t, mgo.ErrNotFound, carts.Find(nil).One(&doc))
+	it := carts.Find(nil).Iter()
+	assert.False(t, it.Next(&doc))
+	assert.NoError(t, it.Close())
+	assert.NoError(t, carts.Insert(bson.M{"_id": "c1", "items": 2}), "the buckets are created on the first write")
+	assert.NoError(t, carts.Find(bson.M{"_id": "c1"}).One(&doc))
+	assert.Equal(t, 2, doc["items"])
+	assert.NoError(t, h.(*db.Bolt).WithTransaction(func(tx db.Tx) error {
+		return tx.ExecOn("shop", "wishes").Insert("w1", bson.M{"n": 1})
+	}))
+	num, err = h.ExecOn("shop", "wishes").Find(nil).Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, num)
+}
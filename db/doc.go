@@ -0,0 +1,100 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+//docOf represents a value as a bson document, so its fields can be reached by the bson names.
+//Structs are converted with the bson marshaling rules (lowercased field names or `bson` tags),
+//nested documents become bson.M and arrays become []interface{}.
+func docOf(v interface{}) (bson.M, bool) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || (rv.Kind() == reflect.Ptr && rv.IsNil()) {
+		return nil, false
+	}
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, false
+	}
+	doc := bson.M{}
+	if err := bson.Unmarshal(data, doc); err != nil {
+		return nil, false
+	}
+	return doc, true
+}
+
+//appendUnique adds value to the set, arrays are flattened like Mongo does for the distinct command
+func appendUnique(set []interface{}, value interface{}) []interface{} {
+	if arr, ok := value.([]interface{}); ok {
+		for _, v := range arr {
+			set = appendUnique(set, v)
+		}
+		return set
+	}
+	for _, v := range set {
+		if reflect.DeepEqual(v, value) {
+			return set
+		}
+	}
+	return append(set, value)
+}
+
+//unmarshalValues writes values into the slice pointed by result using the bson conversion rules
+func unmarshalValues(values []interface{}, result interface{}) error {
+	if values == nil {
+		values = []interface{}{}
+	}
+	data, err := bson.Marshal(bson.M{"values": values})
+	if err != nil {
+		return err
+	}
+	var holder struct{ Values bson.Raw }
+	err = bson.Unmarshal(data, &holder)
+	if err != nil {
+		return err
+	}
+	err = holder.Values.Unmarshal(result)
+	if err != nil {
+		return fmt.Errorf("Failed to unmarshal values into `%T`, %v", result, err)
+	}
+	return nil
+}
+
+//assign puts src into the value pointed by result.
+//Types which can't be assigned directly are converted with the bson marshaling rules.
+func assign(src interface{}, result interface{}) error {
+	rv := reflect.ValueOf(result)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("Unexpected result type, want a non-nil pointer, got `%T`", result)
+	}
+	dst := rv.Elem()
+	sv := reflect.ValueOf(src)
+	if !sv.IsValid() {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	for dst.Kind() == reflect.Ptr && !sv.Type().AssignableTo(dst.Type()) {
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		dst = dst.Elem()
+	}
+	switch {
+	case sv.Type().AssignableTo(dst.Type()):
+		dst.Set(sv)
+		return nil
+	case sv.Kind() == dst.Kind() && sv.Type().ConvertibleTo(dst.Type()):
+		dst.Set(sv.Convert(dst.Type()))
+		return nil
+	}
+
+	data, err := bson.Marshal(src)
+	if err != nil {
+		return fmt.Errorf("Failed to assign `%T` to `%T`, %v", src, result, err)
+	}
+	return bson.Unmarshal(data, dst.Addr().Interface())
+}
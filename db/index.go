@@ -0,0 +1,207 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+//newIndex checks the arguments of EnsureIndex for the in-process realizations and names the index like mgo does,
+//keys are field names or dotted paths, "-field" for the descending order
+func newIndex(keys []string, unique, sparse bool, ttl time.Duration) (mgo.Index, error) {
+	if len(keys) == 0 {
+		return mgo.Index{}, errors.New("EnsureIndex wants at least one key")
+	}
+	if ttl < 0 {
+		return mgo.Index{}, fmt.Errorf("EnsureIndex wants a non-negative ttl, got %v", ttl)
+	}
+	if ttl > 0 && len(keys) > 1 {
+		return mgo.Index{}, errors.New("EnsureIndex can't set a ttl for a compound index")
+	}
+
+	name, err := indexName(keys)
+	if err != nil {
+		return mgo.Index{}, err
+	}
+	return mgo.Index{
+		Key:         append([]string(nil), keys...),
+		Unique:      unique,
+		Sparse:      sparse,
+		ExpireAfter: ttl,
+		Name:        name,
+	}, nil
+}
+
+//indexName returns the mgo name of the index like "name_1_age_-1"
+func indexName(keys []string) (string, error) {
+	names := make([]string, len(keys))
+	seen := map[string]bool{}
+	for i, key := range keys {
+		field, dir := indexField(key), "1"
+		if strings.HasPrefix(key, "-") {
+			dir = "-1"
+		}
+		switch {
+		case field == "":
+			return "", errors.New("Index keys can't be empty")
+		case strings.HasPrefix(field, "$"):
+			return "", fmt.Errorf("Unsupported index key `%s`, only ascending and descending fields are supported", key)
+		case seen[field]:
+			return "", fmt.Errorf("Index key `%s` is repeated", field)
+		}
+		seen[field] = true
+		names[i] = field + "_" + dir
+	}
+	return strings.Join(names, "_"), nil
+}
+
+func indexField(key string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(key, "+"), "-")
+}
+
+//sameIndex reports whether the indexes have the same definition
+func sameIndex(a, b mgo.Index) bool {
+	return reflect.DeepEqual(a.Key, b.Key) && a.Unique == b.Unique && a.Sparse == b.Sparse && a.ExpireAfter == b.ExpireAfter
+}
+
+//idIndex is the implicit index of the `_id` field listed by Indexes like Mongo does
+func idIndex() mgo.Index {
+	return mgo.Index{Key: []string{"_id"}, Name: "_id_"}
+}
+
+//sortIndexes orders the indexes by name like mgo.Collection.Indexes does
+func sortIndexes(indexes []mgo.Index) {
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Name < indexes[j].Name })
+}
+
+//indexEntries returns the encoded values of the document for the index.
+//Like Mongo an array value or a path through an array of documents gives an entry for each element
+//and a missing field is indexed as null,
+//a sparse index skips the documents missing all of the fields.
+func indexEntries(doc bson.M, idx mgo.Index) [][]byte {
+	entries := [][]byte{nil}
+	present := false
+	for _, key := range idx.Key {
+		found := lookup(doc, indexField(key))
+		present = present || len(found) > 0
+
+		var values []interface{}
+		for _, v := range found {
+			if arr, ok := v.([]interface{}); ok && len(arr) > 0 {
+				values = append(values, arr...)
+				continue
+			}
+			values = append(values, v)
+		}
+		if len(values) == 0 {
+			values = []interface{}{nil}
+		}
+		var next [][]byte
+		for _, prefix := range entries {
+			for _, v := range values {
+				entry := appendIndexValue(append([]byte(nil), prefix...), v)
+				if !containsEntry(next, entry) {
+					next = append(next, entry)
+				}
+			}
+		}
+		entries = next
+	}
+	if idx.Sparse && !present {
+		return nil
+	}
+	return entries
+}
+
+//indexValues returns the values of the index fields, missing fields are nil
+func indexValues(doc bson.M, idx mgo.Index) []interface{} {
+	values := make([]interface{}, len(idx.Key))
+	for i, key := range idx.Key {
+		values[i], _ = getPath(doc, indexField(key))
+	}
+	return values
+}
+
+func containsEntry(entries [][]byte, entry []byte) bool {
+	for _, e := range entries {
+		if string(e) == string(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+//appendIndexValue encodes a value so equal values give equal bytes whatever their Go types are
+//(numbers are compared as float64) and the values of a type are ordered by their bytes.
+//Every value starts with its Mongo sort rank and no encoded value is a prefix of another one,
+//so the encoded values can be concatenated.
+func appendIndexValue(b []byte, v interface{}) []byte {
+	rank := sortRank(v)
+	b = append(b, byte(rank+1))
+	switch rank {
+	case 1: //numbers
+		bits := math.Float64bits(toFloat(reflect.ValueOf(v)))
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return appendUint64(b, bits)
+	case 2:
+		return appendIndexString(b, v.(string))
+	case 3:
+		doc := v.(bson.M)
+		keys := make([]string, 0, len(doc))
+		for k := range doc {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b = appendIndexString(b, k)
+			b = appendIndexValue(b, doc[k])
+		}
+		return append(b, 0, 0)
+	case 4:
+		for _, e := range v.([]interface{}) {
+			b = appendIndexValue(b, e)
+		}
+		return append(b, 0)
+	case 5:
+		return append(b, v.(bson.ObjectId)...)
+	case 6:
+		if v.(bool) {
+			return append(b, 1)
+		}
+		return append(b, 0)
+	case 7:
+		return appendUint64(b, uint64(v.(time.Time).UnixNano())^(1<<63))
+	case 8:
+		return appendIndexString(b, fmt.Sprintf("%#v", v))
+	}
+	return b
+}
+
+//appendIndexString writes a string ended with 0x00 0x01, zero bytes of the string are escaped as 0x00 0xff
+func appendIndexString(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		b = append(b, s[i])
+		if s[i] == 0 {
+			b = append(b, 0xff)
+		}
+	}
+	return append(b, 0, 1)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
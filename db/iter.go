@@ -0,0 +1,52 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+)
+
+//sliceIter iterates over the values already loaded into memory
+type sliceIter struct {
+	values []interface{}
+	err    error
+	tail   error //error reported when the values end
+}
+
+//newSliceIter returns an iterator over the elements of a slice, any other value gives an iterator failing with an error
+func newSliceIter(values interface{}) *sliceIter {
+	if values == nil {
+		return &sliceIter{}
+	}
+	v := reflect.ValueOf(values)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return &sliceIter{err: fmt.Errorf("Failed to iterate over `%T`, want a slice", values)}
+	}
+	it := &sliceIter{values: make([]interface{}, v.Len())}
+	for i := range it.values {
+		it.values[i] = v.Index(i).Interface()
+	}
+	return it
+}
+
+func (it *sliceIter) Next(result interface{}) bool {
+	if it.err != nil {
+		return false
+	}
+	if len(it.values) == 0 {
+		it.err = it.tail
+		return false
+	}
+	value := it.values[0]
+	it.values = it.values[1:]
+	it.err = assign(value, result)
+	return it.err == nil
+}
+
+func (it *sliceIter) Err() error {
+	return it.err
+}
+
+func (it *sliceIter) Close() error {
+	it.values = nil
+	return it.err
+}
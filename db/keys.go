@@ -0,0 +1,373 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/globalsign/mgo/bson"
+)
+
+//keyEncoding turns the keys given to Insert, Find, Update... into the bytes of the bolt keys
+type keyEncoding struct {
+	encode  func(key interface{}) ([]byte, error)
+	ordered bool //the keys are ordered like their values, so ranges of them can be sought
+}
+
+//Key formats stored in the $meta bucket under "keys"
+const (
+	orderedKeys = "ordered"
+	gobKeys     = "gob"
+)
+
+var metaKeysKey = []byte("keys")
+
+//keyEncodingOf returns the encoding of the key format stored in the db
+func keyEncodingOf(format string) (keyEncoding, error) {
+	switch format {
+	case orderedKeys:
+		return keyEncoding{encode: encodeKey, ordered: true}, nil
+	case gobKeys:
+		return keyEncoding{encode: encodeGobKey}, nil
+	}
+	return keyEncoding{}, fmt.Errorf("Unknown key format `%s` of the db", format)
+}
+
+//keyFormat returns the encoding of the keys stored in the db: new dbs get the ordered keys,
+//dbs with records made before the key format was stored have gob keys. The format of a new db is stored
+//unless the transaction is read-only.
+func keyFormat(tx *bolt.Tx) (keyEncoding, error) {
+	var stored string
+	if meta := tx.Bucket([]byte(metaBucketName)); meta != nil {
+		stored = string(meta.Get(metaKeysKey))
+	}
+	if stored == "" {
+		stored = orderedKeys
+		if hasRecords(tx) {
+			stored = gobKeys
+		}
+		if tx.Writable() {
+			meta, err := tx.CreateBucketIfNotExists([]byte(metaBucketName))
+			if err != nil {
+				return keyEncoding{}, err
+			}
+			err = meta.Put(metaKeysKey, []byte(stored))
+			if err != nil {
+				return keyEncoding{}, err
+			}
+		}
+	}
+	return keyEncodingOf(stored)
+}
+
+//encodeKey encodes a key so equal keys give equal bytes whatever their Go types are
+//and the keys of a type are ordered by their bytes, which are readable by other tools:
+//strings and []byte are stored as they are, bson.ObjectId as its 12 raw bytes,
+//integers and floats without a fraction as 8 big-endian bytes with the sign bit flipped, so negative keys go first,
+//time.Time as its Unix nanoseconds like an integer, bools as one byte.
+//Slices, arrays and structs are composite keys: their elements (exported fields) are concatenated,
+//strings and []byte are ended with 0x00 0x01 and their zero bytes escaped as 0x00 0xff,
+//so a key starting with the same elements starts with the same bytes.
+func encodeKey(key interface{}) ([]byte, error) {
+	v, err := keyValue(key)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case v.Type() == objectIDType:
+		return appendObjectIDKey(nil, v)
+	case v.Kind() == reflect.String:
+		return []byte(v.String()), nil
+	case isBytes(v):
+		return append([]byte{}, v.Bytes()...), nil
+	case v.Kind() == reflect.Slice, v.Kind() == reflect.Array, v.Kind() == reflect.Struct && v.Type() != timeType:
+		return appendTupleKey(nil, v)
+	}
+	return appendKeyScalar(nil, v)
+}
+
+var (
+	objectIDType = reflect.TypeOf(bson.ObjectId(""))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+//keyValue returns the value the key points to
+func keyValue(key interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(key)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return v, fmt.Errorf("Unsupported key `%T`, want a non-nil value", key)
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return v, fmt.Errorf("Unsupported key `%T`, want a non-nil value", key)
+	}
+	return v, nil
+}
+
+func isBytes(v reflect.Value) bool {
+	return v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8
+}
+
+//appendTupleKey writes the elements of a composite key
+func appendTupleKey(b []byte, v reflect.Value) ([]byte, error) {
+	var parts []reflect.Value
+	if v.Kind() == reflect.Struct {
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				parts = append(parts, v.Field(i))
+			}
+		}
+	} else {
+		for i := 0; i < v.Len(); i++ {
+			parts = append(parts, v.Index(i))
+		}
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("Unsupported key `%s`, a composite key wants at least one element", v.Type())
+	}
+
+	for _, part := range parts {
+		p, err := keyValue(part.Interface())
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case p.Type() == objectIDType:
+			b, err = appendObjectIDKey(b, p)
+		case p.Kind() == reflect.String:
+			b = appendIndexString(b, p.String())
+		case isBytes(p):
+			b = appendIndexString(b, string(p.Bytes()))
+		case p.Kind() == reflect.Slice, p.Kind() == reflect.Array, p.Kind() == reflect.Struct && p.Type() != timeType:
+			err = fmt.Errorf("Unsupported key `%s`, composite keys can't be nested", v.Type())
+		default:
+			b, err = appendKeyScalar(b, p)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func appendObjectIDKey(b []byte, v reflect.Value) ([]byte, error) {
+	id := bson.ObjectId(v.String())
+	if !id.Valid() {
+		return nil, fmt.Errorf("Unsupported key, invalid ObjectId %q", string(id))
+	}
+	return append(b, id...), nil
+}
+
+//appendKeyScalar writes a number, a time or a bool
+func appendKeyScalar(b []byte, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendUint64(b, uint64(v.Int())^(1<<63)), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("Unsupported key %d, integer keys have to fit int64", v.Uint())
+		}
+		return appendUint64(b, v.Uint()^(1<<63)), nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return nil, fmt.Errorf("Unsupported key %v, float keys have to be integers", f)
+		}
+		return appendUint64(b, uint64(int64(f))^(1<<63)), nil
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	}
+	if v.Type() == timeType {
+		return appendUint64(b, uint64(v.Interface().(time.Time).UnixNano())^(1<<63)), nil
+	}
+	return nil, fmt.Errorf("Unsupported key type `%s`", v.Type())
+}
+
+//encodeGobKey marshals a key to gob with a fresh encoder like the db files made before the key format was stored
+func encodeGobKey(key interface{}) ([]byte, error) {
+	return encode(key)
+}
+
+//encode marshals v to gob with a fresh encoder, so equal values always give equal bytes
+func encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//KeyRange is a Bolt query of the records with the keys from From up to To, From is included and To isn't,
+//a nil bound is open. The bounds are encoded like the keys, so the ranges of integers, strings, times,
+//ObjectIds and composite keys follow the order of their values. The records are read in the order of the keys,
+//Reverse reads them in the descending order.
+type KeyRange struct {
+	From    interface{}
+	To      interface{}
+	Reverse bool
+}
+
+//KeyPrefix is a Bolt query of the records whose keys start with the encoded Prefix,
+//e.g. a string or the first elements of composite keys like []interface{}{"tenant"}.
+//Reverse reads the records in the descending order of the keys.
+type KeyPrefix struct {
+	Prefix  interface{}
+	Reverse bool
+}
+
+//keySpan is a range of the encoded keys sought with a cursor: from `from` (included) up to `to` (excluded),
+//nil bounds are open
+type keySpan struct {
+	from, to []byte
+	reverse  bool
+}
+
+//spanOf returns the span of a KeyRange or KeyPrefix query, ok is false for the other queries
+func spanOf(query interface{}, keys keyEncoding) (span *keySpan, ok bool, err error) {
+	switch q := query.(type) {
+	case *KeyRange:
+		if q != nil {
+			span, err = rangeSpan(*q, keys)
+			return span, true, err
+		}
+	case KeyRange:
+		span, err = rangeSpan(q, keys)
+		return span, true, err
+	case *KeyPrefix:
+		if q != nil {
+			span, err = prefixSpan(*q, keys)
+			return span, true, err
+		}
+	case KeyPrefix:
+		span, err = prefixSpan(q, keys)
+		return span, true, err
+	}
+	return nil, false, nil
+}
+
+func rangeSpan(r KeyRange, keys keyEncoding) (*keySpan, error) {
+	if !keys.ordered {
+		return nil, errors.New("Failed to seek a range of keys, the db has gob-encoded keys")
+	}
+	span := &keySpan{reverse: r.Reverse}
+	var err error
+	if r.From != nil {
+		span.from, err = keys.encode(r.From)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to encode the range start, %v", err)
+		}
+	}
+	if r.To != nil {
+		span.to, err = keys.encode(r.To)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to encode the range end, %v", err)
+		}
+	}
+	return span, nil
+}
+
+func prefixSpan(p KeyPrefix, keys keyEncoding) (*keySpan, error) {
+	if !keys.ordered {
+		return nil, errors.New("Failed to seek a prefix of keys, the db has gob-encoded keys")
+	}
+	prefix, err := keys.encode(p.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode the prefix, %v", err)
+	}
+	return &keySpan{from: prefix, to: prefixEnd(prefix), reverse: p.Reverse}, nil
+}
+
+//prefixEnd returns the first key after the keys starting with the prefix, nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+//idSpan returns the span of the keys which may match the `_id` condition of the selector, nil if it has none.
+//Documents are stored under their `_id`, so equality and $gt, $gte, $lt, $lte bounds of `_id` are sought
+//instead of scanning the whole bucket. The span is used only on the buckets keyed by `_id`, see idKeysBucketName.
+func idSpan(selector bson.M, keys keyEncoding) *keySpan {
+	cond, ok := selector["_id"]
+	if !ok || !keys.ordered {
+		return nil
+	}
+	ops, isDoc := cond.(bson.M)
+	if !isDoc || !isOperators(ops) {
+		ops = bson.M{"$eq": cond}
+	}
+
+	span := &keySpan{}
+	for op, v := range ops {
+		switch v.(type) {
+		case nil, bson.M, []interface{}:
+			continue
+		}
+		enc, err := keys.encode(v)
+		if err != nil {
+			continue
+		}
+		switch op {
+		case "$eq":
+			span.from, span.to = enc, append(enc, 0)
+		case "$gt", "$gte":
+			span.from = enc
+		case "$lt":
+			span.to = enc
+		case "$lte":
+			span.to = append(enc, 0) //the first key after enc
+		}
+	}
+	if span.from == nil && span.to == nil {
+		return nil
+	}
+	return span
+}
+
+//first moves the cursor to the first record of the span in its order
+func (s *keySpan) first(c *bolt.Cursor) (k, v []byte) {
+	switch {
+	case s.reverse && s.to != nil:
+		if k, _ = c.Seek(s.to); k == nil {
+			return s.check(c.Last())
+		}
+		return s.check(c.Prev())
+	case s.reverse:
+		return s.check(c.Last())
+	case s.from != nil:
+		return s.check(c.Seek(s.from))
+	}
+	return s.check(c.First())
+}
+
+//next moves the cursor to the next record of the span
+func (s *keySpan) next(c *bolt.Cursor) (k, v []byte) {
+	if s.reverse {
+		return s.check(c.Prev())
+	}
+	return s.check(c.Next())
+}
+
+//check ends the span at the first key out of it
+func (s *keySpan) check(k, v []byte) ([]byte, []byte) {
+	if k == nil || (s.from != nil && bytes.Compare(k, s.from) < 0) || (s.to != nil && bytes.Compare(k, s.to) >= 0) {
+		return nil, nil
+	}
+	return k, v
+}
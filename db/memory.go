@@ -0,0 +1,758 @@
+/*Package db - in-memory realization with the Mongo semantics
+Documents are kept as bson.M per database and collection, no server or files needed.
+*/
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+const defaultMemoryDBName = "test"
+
+//Memory struct keeps documents in maps, copies of the handler share the same data
+type Memory struct {
+	store  *memoryStore
+	dbName string
+}
+
+type memoryStore struct {
+	sync.RWMutex
+	colls   map[string][]bson.M     //documents by "database.collection"
+	indexes map[string][]mgo.Index //indexes made by EnsureIndex by "database.collection"
+}
+
+//Connect sets up an empty storage, an optional resource is the default database name
+//given as `databaseName string` or db.WithDSN with a database name or a mongo connection string
+func (m *Memory) Connect(resources ...interface{}) (err error) {
+	o, err := connectOptions(resources)
+	if err != nil {
+		return err
+	}
+	if err := o.rejectBolt(); err != nil {
+		return err
+	}
+	m.dbName = defaultMemoryDBName
+	if dbName := databaseOf(o.DSN); dbName != "" {
+		m.dbName = dbName
+	}
+	m.store = &memoryStore{colls: map[string][]bson.M{}, indexes: map[string][]mgo.Index{}}
+	return nil
+}
+
+//ConnectContext is Connect failing with the ctx error if ctx is done
+func (m *Memory) ConnectContext(ctx context.Context, resources ...interface{}) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.Connect(resources...)
+}
+
+//Copy returns a handler sharing the data
+func (m *Memory) Copy() Handler {
+	return &Memory{store: m.storage(), dbName: m.dbName}
+}
+
+//CopyWithSettings returns a handler sharing the data, the mgo settings make no sense for the memory and are skipped,
+//the BoltDB options are errors
+func (m *Memory) CopyWithSettings(settings ...interface{}) (Handler, error) {
+	o, _, err := applyOptions(settings)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.rejectBolt(); err != nil {
+		return nil, err
+	}
+	return m.Copy(), nil
+}
+
+//Close does nothing, the data stays available for the copies of the handler
+func (m *Memory) Close() {}
+
+//ExecOn sets the databaseName and collectionName the same way as Mongo.ExecOn does
+func (m *Memory) ExecOn(resources ...interface{}) Querier {
+	dbName, collName := m.dbName, "test"
+	if dbName == "" {
+		dbName = defaultMemoryDBName
+	}
+
+	switch len(resources) {
+	case 2:
+		if name, ok := resources[0].(string); ok && name != "" {
+			dbName = name
+		}
+		if name, ok := resources[1].(string); ok {
+			collName = name
+		}
+	case 1:
+		if name, ok := resources[0].(string); ok {
+			collName = name
+		}
+	}
+
+	return &MemoryCollection{store: m.storage(), name: dbName + "." + collName}
+}
+
+//WithTransaction runs fn on a copy of the data, the copy replaces the data if fn returns nil.
+//The other handlers sharing the data wait for the transaction to finish, so fn has to use tx only.
+func (m *Memory) WithTransaction(fn func(tx Tx) error) error {
+	store := m.storage()
+	store.Lock()
+	defer store.Unlock()
+
+	txStore := &memoryStore{colls: make(map[string][]bson.M, len(store.colls)), indexes: map[string][]mgo.Index{}}
+	for name, docs := range store.colls { //documents are never modified in place, so copying the slices is enough
+		txStore.colls[name] = append([]bson.M(nil), docs...)
+	}
+	for name, indexes := range store.indexes {
+		txStore.indexes[name] = append([]mgo.Index(nil), indexes...)
+	}
+
+	err := fn(&Memory{store: txStore, dbName: m.dbName})
+	if err != nil {
+		return err
+	}
+	store.colls, store.indexes = txStore.colls, txStore.indexes
+	return nil
+}
+
+func (m *Memory) storage() *memoryStore {
+	if m.store == nil {
+		m.store = &memoryStore{colls: map[string][]bson.M{}, indexes: map[string][]mgo.Index{}}
+	}
+	return m.store
+}
+
+//MemoryCollection works with the documents of one collection
+type MemoryCollection struct {
+	store *memoryStore
+	name  string
+}
+
+//Insert puts documents to the collection, a missing `_id` is set to a new bson.ObjectId (its hex form for a string field)
+//and written back to the document passed by pointer or as a map like Bolt does.
+//Like Mongo it stops at the first duplicate `_id` or unique index value keeping the documents inserted before.
+func (mc *MemoryCollection) Insert(docs ...interface{}) error {
+	mc.store.Lock()
+	defer mc.store.Unlock()
+
+	for _, d := range docs {
+		doc, ok := docOf(d)
+		if !ok {
+			return fmt.Errorf("Failed to insert `%T`, want a document", d)
+		}
+		_, hasID := doc["_id"]
+		if !hasID {
+			doc["_id"] = generateID(d)
+		}
+		if mc.indexOf(bson.M{"_id": doc["_id"]}) >= 0 {
+			return dupError(mc.name, "_id_", doc["_id"])
+		}
+		if err := mc.checkUnique(doc, -1); err != nil {
+			return err
+		}
+		mc.store.colls[mc.name] = append(mc.store.colls[mc.name], doc)
+		if !hasID {
+			writeID(d, doc["_id"])
+		}
+	}
+	return nil
+}
+
+//generateID returns a new `_id` for the document like Bolt's Insert does: a bson.ObjectId or its hex form for a string field
+func generateID(d interface{}) interface{} {
+	oid := bson.NewObjectId()
+	if id, err := idOf(d); err == nil && id.typ().Kind() == reflect.String && id.typ() != objectIDType {
+		return oid.Hex()
+	}
+	return oid
+}
+
+//writeID puts the generated `_id` into the inserted document if it can hold it:
+//a struct passed by pointer, a map or *bson.D
+func writeID(d interface{}, value interface{}) {
+	id, err := idOf(d)
+	if err != nil || id.value != nil || !reflect.TypeOf(value).AssignableTo(id.typ()) {
+		return
+	}
+	id.value, id.generated = value, true
+	id.writeBack()
+}
+
+//Remove deletes the first document matching the selector, returns ErrNotFound if nothing matched
+func (mc *MemoryCollection) Remove(selector interface{}) error {
+	sel, err := memorySelector(selector)
+	if err != nil {
+		return err
+	}
+
+	mc.store.Lock()
+	defer mc.store.Unlock()
+
+	i, err := mc.find(sel)
+	if err != nil {
+		return err
+	}
+	if i < 0 {
+		return ErrNotFound
+	}
+	docs := mc.store.colls[mc.name]
+	mc.store.colls[mc.name] = append(docs[:i:i], docs[i+1:]...)
+	return nil
+}
+
+//RemoveAll deletes all documents matching the selector, returns the number of deleted docs
+func (mc *MemoryCollection) RemoveAll(selector interface{}) (num int, err error) {
+	sel, err := memorySelector(selector)
+	if err != nil {
+		return 0, err
+	}
+
+	mc.store.Lock()
+	defer mc.store.Unlock()
+
+	var kept []bson.M
+	for _, doc := range mc.store.colls[mc.name] {
+		ok, err := match(doc, sel)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			num++
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	mc.store.colls[mc.name] = kept
+	return num, nil
+}
+
+//Update modifies the first document matching the selector, returns ErrNotFound if nothing matched.
+//The update is either a replacement document or a document of update operators.
+func (mc *MemoryCollection) Update(selector interface{}, update interface{}) error {
+	sel, err := memorySelector(selector)
+	if err != nil {
+		return err
+	}
+
+	mc.store.Lock()
+	defer mc.store.Unlock()
+
+	i, err := mc.find(sel)
+	if err != nil {
+		return err
+	}
+	if i < 0 {
+		return ErrNotFound
+	}
+	return mc.update(i, update)
+}
+
+//UpdateAll modifies all documents matching the selector with update operators, returns the number of updated docs
+func (mc *MemoryCollection) UpdateAll(selector interface{}, update interface{}) (num int, err error) {
+	sel, err := memorySelector(selector)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok, err := updateOperators(update); err != nil || !ok {
+		return 0, errors.New("Failed to update, UpdateAll wants update operators")
+	}
+
+	mc.store.Lock()
+	defer mc.store.Unlock()
+
+	docs := mc.store.colls[mc.name]
+	updated := make([]bson.M, len(docs))
+	copy(updated, docs)
+	for i, doc := range docs {
+		ok, err := match(doc, sel)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+		updated[i], err = updateDoc(doc, update)
+		if err != nil {
+			return 0, err
+		}
+		num++
+	}
+	mc.store.colls[mc.name] = updated
+	for i := range updated {
+		if err := mc.checkUnique(updated[i], i); err != nil {
+			mc.store.colls[mc.name] = docs
+			return 0, err
+		}
+	}
+	return num, nil
+}
+
+//Upsert modifies the first document matching the selector or inserts a new one.
+//Like MongoCollection.Upsert it returns the number of updated documents, so an insert gives 0.
+func (mc *MemoryCollection) Upsert(selector interface{}, update interface{}) (num int, err error) {
+	sel, err := memorySelector(selector)
+	if err != nil {
+		return 0, err
+	}
+
+	mc.store.Lock()
+	defer mc.store.Unlock()
+
+	i, err := mc.find(sel)
+	if err != nil {
+		return 0, err
+	}
+	if i >= 0 {
+		return 1, mc.update(i, update)
+	}
+
+	doc, err := upsertDoc(sel)
+	if err != nil {
+		return 0, err
+	}
+	doc, err = updateDoc(doc, update)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = bson.NewObjectId()
+	}
+	if err := mc.checkUnique(doc, -1); err != nil {
+		return 0, err
+	}
+	mc.store.colls[mc.name] = append(mc.store.colls[mc.name], doc)
+	return 0, nil
+}
+
+//Find sets the query for the Refiner methods, a non-document query is matched against `_id`
+func (mc *MemoryCollection) Find(query interface{}) Refiner {
+	sel, err := memorySelector(query)
+	return &MemoryQuery{coll: mc, selector: sel, err: err}
+}
+
+//Pipe runs the aggregation pipeline in-process over copies of the collection documents taken by One, All or Iter
+func (mc *MemoryCollection) Pipe(pipeline interface{}) Piper {
+	return &pipe{pipeline: pipeline, source: func() ([]bson.M, error) {
+		return mc.matching(bson.M{})
+	}}
+}
+
+//EnsureIndex creates the index unless it exists, a unique index fails with a duplicate key error
+//if the documents already have equal values. The ttl is kept, but the documents don't expire.
+func (mc *MemoryCollection) EnsureIndex(keys []string, unique, sparse bool, ttl time.Duration) error {
+	idx, err := newIndex(keys, unique, sparse, ttl)
+	if err != nil {
+		return err
+	}
+
+	mc.store.Lock()
+	defer mc.store.Unlock()
+
+	indexes := mc.store.indexes[mc.name]
+	for _, other := range indexes {
+		if other.Name == idx.Name {
+			if !sameIndex(other, idx) {
+				return fmt.Errorf("Index with name: %s already exists with different options", idx.Name)
+			}
+			return nil
+		}
+	}
+
+	mc.store.indexes[mc.name] = []mgo.Index{idx}
+	for i, doc := range mc.store.colls[mc.name] {
+		if err := mc.checkUnique(doc, i); err != nil {
+			mc.store.indexes[mc.name] = indexes
+			return err
+		}
+	}
+	mc.store.indexes[mc.name] = append(indexes, idx)
+	return nil
+}
+
+//DropIndex removes the index made by EnsureIndex with the same keys
+func (mc *MemoryCollection) DropIndex(keys ...string) error {
+	name, err := indexName(keys)
+	if err != nil {
+		return err
+	}
+
+	mc.store.Lock()
+	defer mc.store.Unlock()
+
+	indexes := mc.store.indexes[mc.name]
+	for i, idx := range indexes {
+		if idx.Name == name {
+			mc.store.indexes[mc.name] = append(indexes[:i:i], indexes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("index not found with name [%s]", name)
+}
+
+//Indexes returns the `_id_` index and the indexes made by EnsureIndex sorted by name
+func (mc *MemoryCollection) Indexes() (indexes []mgo.Index, err error) {
+	mc.store.RLock()
+	defer mc.store.RUnlock()
+
+	indexes = append([]mgo.Index{idIndex()}, mc.store.indexes[mc.name]...)
+	sortIndexes(indexes)
+	return indexes, nil
+}
+
+//InsertContext is Insert failing with the ctx error if ctx is done
+func (mc *MemoryCollection) InsertContext(ctx context.Context, docs ...interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mc.Insert(docs...)
+}
+
+//RemoveContext is Remove failing with the ctx error if ctx is done
+func (mc *MemoryCollection) RemoveContext(ctx context.Context, selector interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mc.Remove(selector)
+}
+
+//RemoveAllContext is RemoveAll failing with the ctx error if ctx is done
+func (mc *MemoryCollection) RemoveAllContext(ctx context.Context, selector interface{}) (num int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return mc.RemoveAll(selector)
+}
+
+//UpdateContext is Update failing with the ctx error if ctx is done
+func (mc *MemoryCollection) UpdateContext(ctx context.Context, selector interface{}, update interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mc.Update(selector, update)
+}
+
+//UpdateAllContext is UpdateAll failing with the ctx error if ctx is done
+func (mc *MemoryCollection) UpdateAllContext(ctx context.Context, selector interface{}, update interface{}) (num int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return mc.UpdateAll(selector, update)
+}
+
+//UpsertContext is Upsert failing with the ctx error if ctx is done
+func (mc *MemoryCollection) UpsertContext(ctx context.Context, selector interface{}, update interface{}) (num int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return mc.Upsert(selector, update)
+}
+
+//find returns the index of the first document matching the selector or -1
+func (mc *MemoryCollection) find(sel bson.M) (int, error) {
+	for i, doc := range mc.store.colls[mc.name] {
+		ok, err := match(doc, sel)
+		if err != nil {
+			return -1, err
+		}
+		if ok {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+//indexOf is find for the selectors known to be valid
+func (mc *MemoryCollection) indexOf(sel bson.M) int {
+	i, _ := mc.find(sel)
+	return i
+}
+
+//update replaces the document placed at the index with its updated copy
+func (mc *MemoryCollection) update(i int, update interface{}) error {
+	docs := mc.store.colls[mc.name]
+	doc, err := updateDoc(docs[i], update)
+	if err != nil {
+		return err
+	}
+	if err := mc.checkUnique(doc, i); err != nil {
+		return err
+	}
+	docs[i] = doc
+	return nil
+}
+
+//checkUnique returns a duplicate key error if the unique indexes have the values of the document
+//for any other document, skip is the index of the document itself or -1 for a new one
+func (mc *MemoryCollection) checkUnique(doc bson.M, skip int) error {
+	for _, idx := range mc.store.indexes[mc.name] {
+		if !idx.Unique {
+			continue
+		}
+		entries := indexEntries(doc, idx)
+		for i, other := range mc.store.colls[mc.name] {
+			if i == skip {
+				continue
+			}
+			for _, entry := range indexEntries(other, idx) {
+				if containsEntry(entries, entry) {
+					return dupError(mc.name, idx.Name, indexValues(doc, idx)...)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//matching returns copies of the documents matching the selector
+func (mc *MemoryCollection) matching(sel bson.M) ([]bson.M, error) {
+	mc.store.RLock()
+	defer mc.store.RUnlock()
+
+	var docs []bson.M
+	for _, doc := range mc.store.colls[mc.name] {
+		ok, err := match(doc, sel)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			docs = append(docs, copyDoc(doc))
+		}
+	}
+	return docs, nil
+}
+
+//MemoryQuery refines the documents matching the query
+type MemoryQuery struct {
+	coll     *MemoryCollection
+	selector bson.M
+	err      error
+	refine   refinement
+}
+
+//Sort orders the documents by the fields, "-field" sorts in the descending order
+func (mq *MemoryQuery) Sort(fields ...string) Refiner {
+	mq.refine.setSort(fields)
+	return mq
+}
+
+//Limit restricts the number of documents, zero means no limit
+func (mq *MemoryQuery) Limit(n int) Refiner {
+	mq.refine.setLimit(n)
+	return mq
+}
+
+//Skip skips the first n documents
+func (mq *MemoryQuery) Skip(n int) Refiner {
+	mq.refine.setSkip(n)
+	return mq
+}
+
+//Select keeps only the fields of the projection like bson.M{"name": 1} or removes them like bson.M{"name": 0}
+func (mq *MemoryQuery) Select(projection interface{}) Refiner {
+	mq.refine.setProjection(projection)
+	return mq
+}
+
+//One unmarshals the first matching document into result, returns ErrNotFound if nothing matched
+func (mq *MemoryQuery) One(result interface{}) error {
+	docs, err := mq.docs()
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return ErrNotFound
+	}
+	return assign(docs[0], result)
+}
+
+//All unmarshals all matching documents into the slice pointed by results
+func (mq *MemoryQuery) All(results interface{}) error {
+	resultv := reflect.ValueOf(results)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("Unexpected results type, want a pointer to a slice, got `%T`", results)
+	}
+
+	docs, err := mq.docs()
+	if err != nil {
+		return err
+	}
+
+	slicev := resultv.Elem().Slice(0, 0)
+	for _, doc := range docs {
+		elemp := reflect.New(slicev.Type().Elem())
+		err := assign(doc, elemp.Interface())
+		if err != nil {
+			return err
+		}
+		slicev = reflect.Append(slicev, elemp.Elem())
+	}
+	resultv.Elem().Set(slicev)
+	return nil
+}
+
+//Distinct writes the unique values of the field named by key into the slice pointed by result,
+//like in mgo Sort, Skip, Limit and Select don't affect it
+func (mq *MemoryQuery) Distinct(key string, result interface{}) error {
+	if mq.err != nil {
+		return mq.err
+	}
+	docs, err := mq.coll.matching(mq.selector)
+	if err != nil {
+		return err
+	}
+
+	var values []interface{}
+	for _, doc := range docs {
+		for _, v := range lookup(doc, key) {
+			values = appendUnique(values, v)
+		}
+	}
+	return unmarshalValues(values, result)
+}
+
+//Count returns the number of matching documents
+func (mq *MemoryQuery) Count() (num int, err error) {
+	docs, err := mq.docs()
+	if err != nil {
+		return 0, err
+	}
+	return len(docs), nil
+}
+
+//OneContext is One failing with the ctx error if ctx is done
+func (mq *MemoryQuery) OneContext(ctx context.Context, result interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mq.One(result)
+}
+
+//AllContext is All failing with the ctx error if ctx is done
+func (mq *MemoryQuery) AllContext(ctx context.Context, results interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mq.All(results)
+}
+
+//DistinctContext is Distinct failing with the ctx error if ctx is done
+func (mq *MemoryQuery) DistinctContext(ctx context.Context, key string, result interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mq.Distinct(key, result)
+}
+
+//CountContext is Count failing with the ctx error if ctx is done
+func (mq *MemoryQuery) CountContext(ctx context.Context) (num int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return mq.Count()
+}
+
+//Iter returns an iterator over copies of the matching documents taken at the call
+func (mq *MemoryQuery) Iter() Iterator {
+	docs, err := mq.docs()
+	if err != nil {
+		return &sliceIter{err: err}
+	}
+	return newSliceIter(docs)
+}
+
+//docs returns copies of the matching documents sorted, skipped, limited and projected
+func (mq *MemoryQuery) docs() ([]bson.M, error) {
+	if mq.err != nil {
+		return nil, mq.err
+	}
+	if mq.refine.err != nil {
+		return nil, mq.refine.err
+	}
+	docs, err := mq.coll.matching(mq.selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var refined []bson.M
+	for _, i := range mq.refine.order(docs) {
+		doc, err := mq.refine.project(docs[i])
+		if err != nil {
+			return nil, err
+		}
+		refined = append(refined, doc)
+	}
+	return refined, nil
+}
+
+//memorySelector normalizes a query, nil selects everything and a non-document value is an `_id`
+func memorySelector(query interface{}) (bson.M, error) {
+	if query == nil {
+		return bson.M{}, nil
+	}
+	if sel, ok := selectorOf(query); ok {
+		return sel, nil
+	}
+	sel, ok := docOf(bson.M{"_id": query})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected query `%T`", query)
+	}
+	return sel, nil
+}
+
+//updateDoc returns an updated copy of the document, a replacement document keeps the `_id`
+func updateDoc(doc bson.M, update interface{}) (bson.M, error) {
+	ops, ok, err := updateOperators(update)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		updated := copyDoc(doc)
+		err := applyUpdate(updated, ops)
+		if err != nil {
+			return nil, err
+		}
+		if id, ok := doc["_id"]; ok && !equal(id, updated["_id"]) {
+			return nil, errors.New("Failed to update, the `_id` field can't be modified")
+		}
+		return updated, nil
+	}
+
+	updated, ok := docOf(update)
+	if !ok {
+		return nil, fmt.Errorf("Failed to update with `%T`, want a document", update)
+	}
+	if id, ok := doc["_id"]; ok {
+		if other, ok := updated["_id"]; ok && !equal(id, other) {
+			return nil, errors.New("Failed to update, the `_id` field can't be modified")
+		}
+		updated["_id"] = id
+	}
+	return updated, nil
+}
+
+//copyDoc returns a deep copy of the document
+func copyDoc(doc bson.M) bson.M {
+	c, _ := docOf(doc)
+	return c
+}
+
+//dupError mimics the error returned by Mongo for duplicate values of the index, so mgo.IsDup(err) reports true
+func dupError(collection, index string, values ...interface{}) error {
+	key := make([]string, len(values))
+	for i, v := range values {
+		key[i] = fmt.Sprintf(": %#v", v)
+	}
+	return &mgo.LastError{
+		Code: 11000,
+		Err:  fmt.Sprintf("E11000 duplicate key error collection: %s index: %s dup key: { %s }", collection, index, strings.Join(key, ", ")),
+	}
+}
@@ -5,7 +5,8 @@ It's a community developing driver inspired by labix/mgo.v2
 package db
 
 import (
-	"errors"
+	"context"
+	"time"
 
 	"github.com/globalsign/mgo"
 )
@@ -15,17 +16,48 @@ type Mongo struct {
 	*mgo.Session
 }
 
-//Connect dials to the mongo server
+//Connect dials to the mongo server, resources are db.WithDSN(dsn) or `dsn string`
 func (m *Mongo) Connect(resources ...interface{}) (err error) {
-	dsn, ok := resources[0].(string)
+	o, err := requireDSN(resources)
+	if err != nil {
+		return err
+	}
+	if err := o.rejectBolt(); err != nil {
+		return err
+	}
+
+	m.Session, err = mgo.Dial(o.DSN)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+//ConnectContext dials to the mongo server giving up at the ctx deadline
+func (m *Mongo) ConnectContext(ctx context.Context, resources ...interface{}) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline, ok := ctx.Deadline()
 	if !ok {
-		return errors.New("Unexpected resources set, want `dsn string`")
+		return m.Connect(resources...)
 	}
 
-	m.Session, err = mgo.Dial(dsn)
+	o, err := requireDSN(resources)
 	if err != nil {
 		return err
 	}
+	if err := o.rejectBolt(); err != nil {
+		return err
+	}
+
+	m.Session, err = mgo.DialWithTimeout(o.DSN, time.Until(deadline))
+	if err != nil {
+		return ctxErr(ctx, err)
+	}
+	//the same timeouts as mgo.Dial sets, the deadline limits dialing only
+	m.Session.SetSyncTimeout(time.Minute)
+	m.Session.SetSocketTimeout(time.Minute)
 	return nil
 }
 
@@ -35,23 +67,20 @@ func (m *Mongo) Copy() Handler {
 	return &Mongo{copy}
 }
 
-//CopyWithSettings makes session copy with new working mode
+//CopyWithSettings makes session copy with new working mode,
+//settings are db.WithMode(mode), db.WithRefresh() or `mode int, refresh bool`
 func (m *Mongo) CopyWithSettings(settings ...interface{}) (Handler, error) {
-	var mode int
-	var refresh bool
-
-	mode, ok := settings[0].(int)
-	if !ok {
-		return nil, errors.New("Unexpected parameters set, want `mode int, refresh bool`")
-	}
-
-	refresh, ok = settings[1].(bool)
-	if !ok {
-		return nil, errors.New("Unexpected parameters set, want `mode int, refresh bool`")
+	o, err := settingsOptions(settings)
+	if err != nil {
+		return nil, err
 	}
 
 	copy := m.Session.Copy()
-	copy.SetMode(mgo.Mode(mode), refresh)
+	mode := copy.Mode()
+	if o.modeSet {
+		mode = o.Mode
+	}
+	copy.SetMode(mode, o.Refresh)
 	return &Mongo{copy}, nil
 }
 
@@ -60,6 +89,12 @@ func (m *Mongo) Close() {
 	m.Session.Close()
 }
 
+//WithTransaction returns ErrTransactionsUnsupported without calling fn,
+//the mgo driver has no multi-document transactions
+func (m *Mongo) WithTransaction(fn func(tx Tx) error) error {
+	return ErrTransactionsUnsupported
+}
+
 /*
 ExecOn - sets resources for the Mongo driver - databaseName and a collectionName
 Is databaseName doesn't set driver will use one from the connection string
@@ -152,12 +187,137 @@ func (mc *MongoCollection) Upsert(selector interface{}, update interface{}) (num
 //Find searches for the docs according to query
 func (mc *MongoCollection) Find(query interface{}) Refiner {
 	q := mc.Collection.Find(query)
-	return &MongoQuery{q}
+	return &MongoQuery{Query: q, coll: mc.Collection, query: query}
+}
+
+//InsertContext puts documents to db within the ctx deadline
+func (mc *MongoCollection) InsertContext(ctx context.Context, docs ...interface{}) error {
+	coll, done, err := collectionFor(ctx, mc.Collection)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return ctxErr(ctx, coll.Insert(docs...))
+}
+
+//RemoveContext deletes one document according to selector within the ctx deadline
+func (mc *MongoCollection) RemoveContext(ctx context.Context, selector interface{}) error {
+	coll, done, err := collectionFor(ctx, mc.Collection)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return ctxErr(ctx, coll.Remove(selector))
+}
+
+//RemoveAllContext deletes all documents according to selector within the ctx deadline
+func (mc *MongoCollection) RemoveAllContext(ctx context.Context, selector interface{}) (num int, err error) {
+	coll, done, err := collectionFor(ctx, mc.Collection)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	num, err = (&MongoCollection{coll}).RemoveAll(selector)
+	return num, ctxErr(ctx, err)
+}
+
+//UpdateContext updates one document within the ctx deadline
+func (mc *MongoCollection) UpdateContext(ctx context.Context, selector interface{}, update interface{}) error {
+	coll, done, err := collectionFor(ctx, mc.Collection)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return ctxErr(ctx, coll.Update(selector, update))
+}
+
+//UpdateAllContext updates documents within the ctx deadline
+func (mc *MongoCollection) UpdateAllContext(ctx context.Context, selector interface{}, update interface{}) (num int, err error) {
+	coll, done, err := collectionFor(ctx, mc.Collection)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	num, err = (&MongoCollection{coll}).UpdateAll(selector, update)
+	return num, ctxErr(ctx, err)
+}
+
+//UpsertContext updates document or inserts a new one within the ctx deadline
+func (mc *MongoCollection) UpsertContext(ctx context.Context, selector interface{}, update interface{}) (num int, err error) {
+	coll, done, err := collectionFor(ctx, mc.Collection)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	num, err = (&MongoCollection{coll}).Upsert(selector, update)
+	return num, ctxErr(ctx, err)
+}
+
+//Pipe prepares the aggregation pipeline with mgo.Collection.Pipe
+func (mc *MongoCollection) Pipe(pipeline interface{}) Piper {
+	return &MongoPipe{mc.Collection.Pipe(pipeline)}
+}
+
+//EnsureIndex creates the index with mgo.Collection.EnsureIndex, ttl makes Mongo remove the documents
+//whose time field is older than ttl
+func (mc *MongoCollection) EnsureIndex(keys []string, unique, sparse bool, ttl time.Duration) error {
+	return mc.Collection.EnsureIndex(mgo.Index{Key: keys, Unique: unique, Sparse: sparse, ExpireAfter: ttl})
+}
+
+//MongoPipe is a wrapper for *mgo.Pipe
+type MongoPipe struct {
+	*mgo.Pipe
+}
+
+//Iter returns the mgo.Iter of the pipeline
+func (mp *MongoPipe) Iter() Iterator {
+	return mp.Pipe.Iter()
 }
 
 //MongoQuery wrapper for *mgo.Query
 type MongoQuery struct {
 	*mgo.Query
+
+	coll    *mgo.Collection //to repeat the query on a session with the ctx deadline
+	query   interface{}
+	refines []func(q *mgo.Query) *mgo.Query //Sort, Limit, Skip and Select to be repeated as well
+}
+
+//Sort orders the documents by the fields, "-field" sorts in the descending order
+func (mq *MongoQuery) Sort(fields ...string) Refiner {
+	return mq.refine(func(q *mgo.Query) *mgo.Query { return q.Sort(fields...) })
+}
+
+//Limit restricts the number of documents, zero means no limit
+func (mq *MongoQuery) Limit(n int) Refiner {
+	return mq.refine(func(q *mgo.Query) *mgo.Query { return q.Limit(n) })
+}
+
+//Skip skips the first n documents
+func (mq *MongoQuery) Skip(n int) Refiner {
+	return mq.refine(func(q *mgo.Query) *mgo.Query { return q.Skip(n) })
+}
+
+//Select keeps only the fields of the projection like bson.M{"name": 1} or removes them like bson.M{"name": 0}
+func (mq *MongoQuery) Select(projection interface{}) Refiner {
+	return mq.refine(func(q *mgo.Query) *mgo.Query { return q.Select(projection) })
+}
+
+//Iter returns the mgo.Iter of the query
+func (mq *MongoQuery) Iter() Iterator {
+	return mq.Query.Iter()
+}
+
+func (mq *MongoQuery) refine(fn func(q *mgo.Query) *mgo.Query) Refiner {
+	mq.Query = fn(mq.Query)
+	mq.refines = append(mq.refines, fn)
+	return mq
 }
 
 //One refines mongo query and return one record
@@ -195,3 +355,97 @@ func (mq *MongoQuery) Count() (num int, err error) {
 	}
 	return num, nil
 }
+
+//OneContext refines mongo query and return one record within the ctx deadline
+func (mq *MongoQuery) OneContext(ctx context.Context, result interface{}) error {
+	q, done, err := mq.queryFor(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return ctxErr(ctx, q.One(result))
+}
+
+//AllContext refines mongo query and return all records within the ctx deadline
+func (mq *MongoQuery) AllContext(ctx context.Context, results interface{}) error {
+	q, done, err := mq.queryFor(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return ctxErr(ctx, q.All(results))
+}
+
+//DistinctContext selects values set for the key within the ctx deadline
+func (mq *MongoQuery) DistinctContext(ctx context.Context, key string, result interface{}) error {
+	q, done, err := mq.queryFor(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return ctxErr(ctx, q.Distinct(key, result))
+}
+
+//CountContext returns numbers of the queried records within the ctx deadline
+func (mq *MongoQuery) CountContext(ctx context.Context) (num int, err error) {
+	q, done, err := mq.queryFor(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	num, err = q.Count()
+	if err != nil {
+		return 0, ctxErr(ctx, err)
+	}
+	return num, nil
+}
+
+//queryFor repeats the query on a session with the socket timeout set by the ctx deadline,
+//done closes that session
+func (mq *MongoQuery) queryFor(ctx context.Context) (q *mgo.Query, done func(), err error) {
+	if mq.coll == nil { //MongoQuery made outside of MongoCollection.Find
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		return mq.Query, func() {}, nil
+	}
+
+	coll, done, err := collectionFor(ctx, mq.coll)
+	if err != nil {
+		return nil, nil, err
+	}
+	q = coll.Find(mq.query)
+	for _, fn := range mq.refines {
+		q = fn(q)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		q.SetMaxTime(time.Until(deadline))
+	}
+	return q, done, nil
+}
+
+//collectionFor returns the collection bound to a copy of its session
+//with the socket timeout set to the time left before the ctx deadline, done closes that copy
+func collectionFor(ctx context.Context, coll *mgo.Collection) (c *mgo.Collection, done func(), err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	sess := coll.Database.Session.Copy()
+	if deadline, ok := ctx.Deadline(); ok {
+		sess.SetSocketTimeout(time.Until(deadline))
+	}
+	return coll.With(sess), sess.Close, nil
+}
+
+//ctxErr replaces an error caused by the ctx deadline or cancellation with the ctx error
+func ctxErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
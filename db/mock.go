@@ -1,6 +1,77 @@
 package db
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+//ErrDuplicateKey - ошибка дубликата ключа, как от сервера Монго; mgo.IsDup(err) для неё вернёт true
+var ErrDuplicateKey error = &mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}
+
+//ErrNoReachableServers - ошибка сети, которую mgo возвращает при недоступности сервера
+var ErrNoReachableServers = errors.New("no reachable servers")
+
+//MockError - правило, по которому методы мока возвращают ошибку
+type MockError struct {
+	Method      string     //имя метода (Insert, Update, One...), пустая строка - любой метод
+	Collection  string     //имя коллекции из ExecOn, пустая строка - любая коллекция
+	Err         error      //возвращаемая ошибка
+	OnCall      int        //номер подходящего вызова (начиная с 1), на котором вернуть ошибку; 0 - каждый вызов
+	Probability float64    //вероятность ошибки от 0 до 1; 0 - ошибка возвращается всегда
+	Rand        *rand.Rand //источник случайных чисел для Probability (например, rand.New(rand.NewSource(1))); nil - общий из math/rand
+}
+
+//mockState - правила ошибок и фикстуры, общие для мока, его копий, коллекций и запросов
+type mockState struct {
+	sync.Mutex
+	rules    []*mockErrorRule
+	fixtures map[string][]interface{} //документы по имени коллекции
+	indexes  map[string][]mgo.Index   //индексы EnsureIndex по имени коллекции
+}
+
+type mockErrorRule struct {
+	MockError
+	calls int
+}
+
+//float64 - следующее случайное число правила из [0, 1)
+func (r *mockErrorRule) float64() float64 {
+	if r.Rand != nil {
+		return r.Rand.Float64()
+	}
+	return rand.Float64()
+}
+
+//check - возвращает ошибку первого правила, подходящего под вызов метода на коллекции
+func (ms *mockState) check(method, collection string) error {
+	if ms == nil {
+		return nil
+	}
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, r := range ms.rules {
+		if (r.Method != "" && r.Method != method) || (r.Collection != "" && r.Collection != collection) {
+			continue
+		}
+		r.calls++
+		if r.OnCall > 0 && r.calls != r.OnCall {
+			continue
+		}
+		if r.Probability > 0 && r.float64() >= r.Probability {
+			continue
+		}
+		return r.Err
+	}
+	return nil
+}
 
 //Mock - структура для проверки методов db.Handler
 type Mock struct {
@@ -8,29 +79,104 @@ type Mock struct {
 	Mode    int
 	Refresh bool
 	Closed  bool
+	Ctx     context.Context //контекст последнего вызова ConnectContext
+
+	Commits   int //число транзакций WithTransaction, в которых fn вернула nil
+	Rollbacks int //число транзакций WithTransaction, в которых fn вернула ошибку
+
+	state *mockState
 }
 
-//Connect - присваивает resource в поле Msg структуры
+//fixturesOf - возвращает фикстуры коллекции; ok == false, если для коллекции не задано фикстур
+func (ms *mockState) fixturesOf(collection string) (docs []interface{}, ok bool) {
+	if ms == nil {
+		return nil, false
+	}
+	ms.Lock()
+	defer ms.Unlock()
+
+	docs, ok = ms.fixtures[collection]
+	return append([]interface{}(nil), docs...), ok
+}
+
+//InjectError - добавляет правило, по которому методы мока (и полученных от него коллекций и запросов) вернут ошибку
+func (mk *Mock) InjectError(e MockError) {
+	ms := mk.shared()
+	ms.Lock()
+	ms.rules = append(ms.rules, &mockErrorRule{MockError: e})
+	ms.Unlock()
+}
+
+//Seed - задаёт документы коллекции, которые вернут One, All, Distinct и Count запросов к ней (вместо "result" и 999).
+//Документы отдаются без учёта запроса, переданного в Find, и конвертируются в результат по правилам bson.
+func (mk *Mock) Seed(collection string, docs ...interface{}) {
+	ms := mk.shared()
+	ms.Lock()
+	if ms.fixtures == nil {
+		ms.fixtures = map[string][]interface{}{}
+	}
+	ms.fixtures[collection] = append([]interface{}{}, docs...)
+	ms.Unlock()
+}
+
+//mockStateInit - защищает ленивое создание состояния мока, вызываемое из разных горутин
+var mockStateInit sync.Mutex
+
+//shared - возвращает состояние мока, создавая его при первом обращении, чтобы копии, транзакции и коллекции,
+//полученные до InjectError и Seed, видели добавленные позже правила и фикстуры
+func (mk *Mock) shared() *mockState {
+	mockStateInit.Lock()
+	defer mockStateInit.Unlock()
+	if mk.state == nil {
+		mk.state = &mockState{}
+	}
+	return mk.state
+}
+
+//Connect - присваивает dsn (db.WithDSN или первый строковый resource) в поле Msg структуры
 func (mk *Mock) Connect(resources ...interface{}) (err error) {
-	dsn, ok := resources[0].(string)
-	if !ok {
-		return errors.New("Unexpected resources set, want `dsn string`")
+	if err := mk.shared().check("Connect", ""); err != nil {
+		return err
 	}
-	mk.Msg = dsn
+	o, err := requireDSN(resources)
+	if err != nil {
+		return err
+	}
+	mk.Msg = o.DSN
 	return nil
 }
 
+//ConnectContext - пишет ctx в поле Ctx; если контекст отменён или истёк, возвращает ctx.Err(), иначе вызывает Connect
+func (mk *Mock) ConnectContext(ctx context.Context, resources ...interface{}) (err error) {
+	mk.Ctx = ctx
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mk.Connect(resources...)
+}
+
 //Copy - возвращает db.Handler со структурой &Mock{Msg: "session copied"}
 func (mk *Mock) Copy() Handler {
-	m := &Mock{}
+	m := &Mock{state: mk.shared()}
 	m.Msg = "session copied"
 	return m
 }
 
 //CopyWithSettings - возвращает db.Handler со структурой &Mock{Msg: "session copied w settings"}
+//Настройки db.WithMode и db.WithRefresh пишутся в поля Mode и Refresh копии, позиционные настройки не проверяются
 func (mk *Mock) CopyWithSettings(settings ...interface{}) (Handler, error) {
-	m := &Mock{}
+	if err := mk.shared().check("CopyWithSettings", ""); err != nil {
+		return nil, err
+	}
+	o, ok, err := applyOptions(settings)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mock{state: mk.shared()}
 	m.Msg = "session copied w settings"
+	if ok {
+		m.Mode, m.Refresh = int(o.Mode), o.Refresh
+	}
 	return m, nil
 }
 
@@ -39,10 +185,32 @@ func (mk *Mock) Close() {
 	mk.Closed = true
 }
 
+//WithTransaction - вызывает fn с копией мока &Mock{Msg: "transaction"} в качестве tx;
+//увеличивает Commits, если fn вернула nil, иначе Rollbacks и возвращает ошибку fn
+func (mk *Mock) WithTransaction(fn func(tx Tx) error) error {
+	if err := mk.shared().check("WithTransaction", ""); err != nil {
+		return err
+	}
+	tx := &Mock{state: mk.shared()}
+	tx.Msg = "transaction"
+	if err := fn(tx); err != nil {
+		mk.Rollbacks++
+		return err
+	}
+	mk.Commits++
+	return nil
+}
+
 //ExecOn - возвращает db.Querier со структурой &MockCollection{Msg: "ExecOn called"}
+//Имя коллекции (последний строковый параметр) используется правилами MockError и фикстурами
 func (mk *Mock) ExecOn(resources ...interface{}) Querier {
-	m := &MockCollection{}
+	m := &MockCollection{state: mk.shared()}
 	m.Msg = "ExecOn called"
+	for _, r := range resources {
+		if name, ok := r.(string); ok {
+			m.name = name
+		}
+	}
 	return m
 }
 
@@ -52,27 +220,48 @@ type MockCollection struct {
 	DocsNum  int
 	Selector int
 	Upd      int
+	Ctx      context.Context //контекст последнего вызова метода ...Context
+
+	name string
+	state *mockState
 }
 
-//Insert - считает количество переданных документов, пишет число в поле DocsNum
+//Insert - считает количество переданных документов, пишет число в поле DocsNum.
+//При уникальных индексах возвращает ошибку дубликата (mgo.IsDup), если документ совпадает по индексу
+//с фикстурой коллекции или с другим документом вызова; сами документы в фикстуры не добавляются
 func (mc *MockCollection) Insert(docs ...interface{}) error {
+	if err := mc.state.check("Insert", mc.name); err != nil {
+		return err
+	}
+	if err := mc.state.checkUnique(mc.name, docs); err != nil {
+		return err
+	}
 	mc.DocsNum = len(docs)
 	return nil
 }
 
 //Remove - пишет число 111 в поле Selector
 func (mc *MockCollection) Remove(selector interface{}) error {
+	if err := mc.state.check("Remove", mc.name); err != nil {
+		return err
+	}
 	mc.Selector = 111
 	return nil
 }
 
 //RemoveAll - пишет число 333 в поле Selector
 func (mc *MockCollection) RemoveAll(selector interface{}) (num int, err error) {
+	if err := mc.state.check("RemoveAll", mc.name); err != nil {
+		return 0, err
+	}
 	return 333, nil
 }
 
 //Update - пишет число 555 в поле Selector и 777 в поле Upd
 func (mc *MockCollection) Update(selector interface{}, update interface{}) error {
+	if err := mc.state.check("Update", mc.name); err != nil {
+		return err
+	}
 	mc.Selector = 555
 	mc.Upd = 777
 	return nil
@@ -80,44 +269,388 @@ func (mc *MockCollection) Update(selector interface{}, update interface{}) error
 
 //UpdateAll - возвращает число 888 и nil для ошибки
 func (mc *MockCollection) UpdateAll(selector interface{}, update interface{}) (num int, err error) {
+	if err := mc.state.check("UpdateAll", mc.name); err != nil {
+		return 0, err
+	}
 	return 888, nil
 }
 
 //Upsert - возвращает число 999 и nil для ошибки
 func (mc *MockCollection) Upsert(selector interface{}, update interface{}) (num int, err error) {
+	if err := mc.state.check("Upsert", mc.name); err != nil {
+		return 0, err
+	}
 	return 999, nil
 }
 
+//InsertContext - пишет ctx в поле Ctx; возвращает ctx.Err() для отменённого контекста, иначе вызывает Insert
+func (mc *MockCollection) InsertContext(ctx context.Context, docs ...interface{}) error {
+	mc.Ctx = ctx
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mc.Insert(docs...)
+}
+
+//RemoveContext - пишет ctx в поле Ctx; возвращает ctx.Err() для отменённого контекста, иначе вызывает Remove
+func (mc *MockCollection) RemoveContext(ctx context.Context, selector interface{}) error {
+	mc.Ctx = ctx
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mc.Remove(selector)
+}
+
+//RemoveAllContext - пишет ctx в поле Ctx; возвращает ctx.Err() для отменённого контекста, иначе вызывает RemoveAll
+func (mc *MockCollection) RemoveAllContext(ctx context.Context, selector interface{}) (num int, err error) {
+	mc.Ctx = ctx
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return mc.RemoveAll(selector)
+}
+
+//UpdateContext - пишет ctx в поле Ctx; возвращает ctx.Err() для отменённого контекста, иначе вызывает Update
+func (mc *MockCollection) UpdateContext(ctx context.Context, selector interface{}, update interface{}) error {
+	mc.Ctx = ctx
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mc.Update(selector, update)
+}
+
+//UpdateAllContext - пишет ctx в поле Ctx; возвращает ctx.Err() для отменённого контекста, иначе вызывает UpdateAll
+func (mc *MockCollection) UpdateAllContext(ctx context.Context, selector interface{}, update interface{}) (num int, err error) {
+	mc.Ctx = ctx
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return mc.UpdateAll(selector, update)
+}
+
+//UpsertContext - пишет ctx в поле Ctx; возвращает ctx.Err() для отменённого контекста, иначе вызывает Upsert
+func (mc *MockCollection) UpsertContext(ctx context.Context, selector interface{}, update interface{}) (num int, err error) {
+	mc.Ctx = ctx
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return mc.Upsert(selector, update)
+}
+
 //Find - возвращает db.Refiner со структурой &MockQuery{}
 func (mc *MockCollection) Find(query interface{}) Refiner {
-	return &MockQuery{}
+	return &MockQuery{name: mc.name, state: mc.state}
+}
+
+//Pipe - возвращает db.Piper со структурой &MockPipe{Pipeline: pipeline}
+func (mc *MockCollection) Pipe(pipeline interface{}) Piper {
+	return &MockPipe{Pipeline: pipeline, name: mc.name, state: mc.state}
+}
+
+//MockPipe - структура для проверки методов db.Piper; конвейер выполняется над фикстурами коллекции,
+//без фикстур - над пустой коллекцией. Правила MockError применяются к методу "Pipe"
+type MockPipe struct {
+	Res      string
+	Pipeline interface{} //аргумент Pipe
+
+	name  string
+	state *mockState
+}
+
+//One - пишет "result" в поле Res; копирует в result первый документ результата конвейера
+func (mp *MockPipe) One(result interface{}) error {
+	if err := mp.state.check("Pipe", mp.name); err != nil {
+		return err
+	}
+	mp.Res = "result"
+	return mp.pipe().One(result)
+}
+
+//All - пишет "results" в поле Res; копирует в results все документы результата конвейера
+func (mp *MockPipe) All(results interface{}) error {
+	if err := mp.state.check("Pipe", mp.name); err != nil {
+		return err
+	}
+	mp.Res = "results"
+	return mp.pipe().All(results)
+}
+
+//Iter - пишет "iter" в поле Res; возвращает итератор по документам результата конвейера
+func (mp *MockPipe) Iter() Iterator {
+	if err := mp.state.check("Pipe", mp.name); err != nil {
+		return &sliceIter{err: err}
+	}
+	mp.Res = "iter"
+	return mp.pipe().Iter()
+}
+
+func (mp *MockPipe) pipe() *pipe {
+	return &pipe{pipeline: mp.Pipeline, source: func() ([]bson.M, error) {
+		fixtures, _ := mp.state.fixturesOf(mp.name)
+		var docs []bson.M
+		for _, f := range fixtures {
+			if doc, ok := docOf(f); ok {
+				docs = append(docs, doc)
+			}
+		}
+		return docs, nil
+	}}
+}
+
+//EnsureIndex - добавляет индекс коллекции, который вернёт Indexes; уникальные индексы проверяются в Insert
+func (mc *MockCollection) EnsureIndex(keys []string, unique, sparse bool, ttl time.Duration) error {
+	if err := mc.state.check("EnsureIndex", mc.name); err != nil {
+		return err
+	}
+	idx, err := newIndex(keys, unique, sparse, ttl)
+	if err != nil {
+		return err
+	}
+	if mc.state == nil { //коллекция не получена от мока, индекс негде хранить
+		return nil
+	}
+
+	mc.state.Lock()
+	defer mc.state.Unlock()
+	if mc.state.indexes == nil {
+		mc.state.indexes = map[string][]mgo.Index{}
+	}
+	for _, other := range mc.state.indexes[mc.name] {
+		if other.Name == idx.Name {
+			if !sameIndex(other, idx) {
+				return fmt.Errorf("Index with name: %s already exists with different options", idx.Name)
+			}
+			return nil
+		}
+	}
+	mc.state.indexes[mc.name] = append(mc.state.indexes[mc.name], idx)
+	return nil
+}
+
+//DropIndex - удаляет индекс коллекции, добавленный EnsureIndex с теми же keys
+func (mc *MockCollection) DropIndex(keys ...string) error {
+	if err := mc.state.check("DropIndex", mc.name); err != nil {
+		return err
+	}
+	name, err := indexName(keys)
+	if err != nil {
+		return err
+	}
+	if mc.state == nil {
+		return fmt.Errorf("index not found with name [%s]", name)
+	}
+
+	mc.state.Lock()
+	defer mc.state.Unlock()
+	indexes := mc.state.indexes[mc.name]
+	for i, idx := range indexes {
+		if idx.Name == name {
+			mc.state.indexes[mc.name] = append(indexes[:i:i], indexes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("index not found with name [%s]", name)
+}
+
+//Indexes - возвращает индекс `_id_` и индексы коллекции, добавленные EnsureIndex, отсортированные по имени
+func (mc *MockCollection) Indexes() (indexes []mgo.Index, err error) {
+	if err := mc.state.check("Indexes", mc.name); err != nil {
+		return nil, err
+	}
+	indexes = append(indexes, idIndex())
+	if mc.state == nil {
+		return indexes, nil
+	}
+
+	mc.state.Lock()
+	defer mc.state.Unlock()
+	indexes = append(indexes, mc.state.indexes[mc.name]...)
+	sortIndexes(indexes)
+	return indexes, nil
+}
+
+//checkUnique - возвращает ошибку дубликата, если документы совпадают по уникальному индексу коллекции
+//между собой или с фикстурами
+func (ms *mockState) checkUnique(collection string, docs []interface{}) error {
+	if ms == nil {
+		return nil
+	}
+	fixtures, _ := ms.fixturesOf(collection)
+	ms.Lock()
+	indexes := ms.indexes[collection]
+	ms.Unlock()
+
+	for _, idx := range indexes {
+		if !idx.Unique {
+			continue
+		}
+		var seen [][]byte
+		for i, d := range append(fixtures, docs...) {
+			doc, ok := docOf(d)
+			if !ok {
+				continue
+			}
+			for _, entry := range indexEntries(doc, idx) {
+				if containsEntry(seen, entry) && i >= len(fixtures) {
+					return dupError(collection, idx.Name, indexValues(doc, idx)...)
+				}
+				seen = append(seen, entry)
+			}
+		}
+	}
+	return nil
 }
 
 //MockQuery - структура для проверки методов db.Refiner
 type MockQuery struct {
 	Res     string
 	DistKey string
+	Ctx     context.Context //контекст последнего вызова метода ...Context
+
+	SortFields []string    //поля последнего вызова Sort
+	LimitN     int         //аргумент последнего вызова Limit
+	SkipN      int         //аргумент последнего вызова Skip
+	Projection interface{} //аргумент последнего вызова Select
+
+	name string
+	state *mockState
+}
+
+//Sort - пишет fields в поле SortFields; фикстуры отдаются без сортировки
+func (mq *MockQuery) Sort(fields ...string) Refiner {
+	mq.SortFields = fields
+	return mq
+}
+
+//Limit - пишет n в поле LimitN
+func (mq *MockQuery) Limit(n int) Refiner {
+	mq.LimitN = n
+	return mq
+}
+
+//Skip - пишет n в поле SkipN
+func (mq *MockQuery) Skip(n int) Refiner {
+	mq.SkipN = n
+	return mq
+}
+
+//Select - пишет projection в поле Projection
+func (mq *MockQuery) Select(projection interface{}) Refiner {
+	mq.Projection = projection
+	return mq
 }
 
-//One - пишет "result" в поле Res
+//Iter - пишет "iter" в поле Res; возвращает итератор по фикстурам коллекции, без фикстур - пустой итератор
+func (mq *MockQuery) Iter() Iterator {
+	if err := mq.state.check("Iter", mq.name); err != nil {
+		return &sliceIter{err: err}
+	}
+	mq.Res = "iter"
+
+	docs, _ := mq.state.fixturesOf(mq.name)
+	return newSliceIter(docs)
+}
+
+//One - пишет "result" в поле Res; при заданных фикстурах копирует в result первый документ коллекции
 func (mq *MockQuery) One(result interface{}) error {
+	if err := mq.state.check("One", mq.name); err != nil {
+		return err
+	}
 	mq.Res = "result"
-	return nil
+
+	docs, ok := mq.state.fixturesOf(mq.name)
+	if !ok {
+		return nil
+	}
+	if len(docs) == 0 {
+		return ErrNotFound
+	}
+	return assign(docs[0], result)
 }
 
-//All - пишет "results" в поле Res
+//All - пишет "results" в поле Res; при заданных фикстурах копирует в results все документы коллекции
 func (mq *MockQuery) All(results interface{}) error {
+	if err := mq.state.check("All", mq.name); err != nil {
+		return err
+	}
 	mq.Res = "results"
-	return nil
+
+	docs, ok := mq.state.fixturesOf(mq.name)
+	if !ok {
+		return nil
+	}
+	return assignSlice(docs, results)
 }
 
-//Distinct - пишет key в поле DistKey
+//Distinct - пишет key в поле DistKey; при заданных фикстурах копирует в result уникальные значения поля key
 func (mq *MockQuery) Distinct(key string, result interface{}) error {
+	if err := mq.state.check("Distinct", mq.name); err != nil {
+		return err
+	}
 	mq.DistKey = key
-	return nil
+
+	docs, ok := mq.state.fixturesOf(mq.name)
+	if !ok {
+		return nil
+	}
+	var values []interface{}
+	for _, d := range docs {
+		doc, ok := docOf(d)
+		if !ok {
+			continue
+		}
+		for _, v := range lookup(doc, key) {
+			values = appendUnique(values, v)
+		}
+	}
+	return unmarshalValues(values, result)
 }
 
-//Count - возвращает 999 и nil в качестве ошибки
+//Count - возвращает 999 и nil в качестве ошибки; при заданных фикстурах - число документов коллекции
 func (mq *MockQuery) Count() (num int, err error) {
-	return 999, nil
+	if err := mq.state.check("Count", mq.name); err != nil {
+		return 0, err
+	}
+
+	docs, ok := mq.state.fixturesOf(mq.name)
+	if !ok {
+		return 999, nil
+	}
+	return len(docs), nil
+}
+
+//OneContext - пишет ctx в поле Ctx; возвращает ctx.Err() для отменённого контекста, иначе вызывает One
+func (mq *MockQuery) OneContext(ctx context.Context, result interface{}) error {
+	mq.Ctx = ctx
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mq.One(result)
+}
+
+//AllContext - пишет ctx в поле Ctx; возвращает ctx.Err() для отменённого контекста, иначе вызывает All
+func (mq *MockQuery) AllContext(ctx context.Context, results interface{}) error {
+	mq.Ctx = ctx
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mq.All(results)
+}
+
+//DistinctContext - пишет ctx в поле Ctx; возвращает ctx.Err() для отменённого контекста, иначе вызывает Distinct
+func (mq *MockQuery) DistinctContext(ctx context.Context, key string, result interface{}) error {
+	mq.Ctx = ctx
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mq.Distinct(key, result)
+}
+
+//CountContext - пишет ctx в поле Ctx; возвращает ctx.Err() для отменённого контекста, иначе вызывает Count
+func (mq *MockQuery) CountContext(ctx context.Context) (num int, err error) {
+	mq.Ctx = ctx
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return mq.Count()
 }
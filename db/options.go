@@ -0,0 +1,309 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/globalsign/mgo"
+)
+
+//Option sets up Connect or CopyWithSettings of any realization instead of the positional resources, e.g.
+//	err := handler.Connect(db.WithDSN("mongodb://localhost:27017"))
+//	copy, err := handler.CopyWithSettings(db.WithMode(mgo.Strong), db.WithRefresh())
+type Option func(o *Options) error
+
+//Options are the settings collected from the options
+type Options struct {
+	DSN         string              //mongo connection string, BoltDB file name, Memory's default database name
+	Buckets     []string            //BoltDB buckets to be created on Connect
+	Collections map[string][]string //BoltDB collection buckets nested in the database buckets to be created on Connect
+	Path        string              //BoltDB file path of a persistent db, it's kept on Close
+	FileMode    os.FileMode         //BoltDB file mode, 0644 if not set
+	Bolt        *bolt.Options       //bolt.Open options: lock timeout, read-only mode...
+	AutoCreate  bool                //BoltDB creates missing buckets on writes and reads them as empty ones
+	NoSync      bool                //BoltDB skips fsync after commits, faster but unsafe on crash
+	Codec       Codec               //BoltDB codec of the values, the one stored in the db or gob if not set
+	BoltMode    BoltMode            //mode of the Bolt session copy, the mode of the original session if not set
+	Mode        mgo.Mode            //consistency mode of the session copy, the mode of the original session if not set
+	Refresh     bool                //refresh the session copy before the mode is changed
+
+	modeSet     bool
+	boltModeSet bool
+	boltSet     []string //names of the BoltDB options given, the other realizations reject them
+}
+
+//WithDSN sets the data source: the mongo connection string or the name of an ephemeral BoltDB file
+func WithDSN(dsn string) Option {
+	return func(o *Options) error {
+		if dsn == "" {
+			return errors.New("Option WithDSN wants a non-empty dsn")
+		}
+		o.DSN = dsn
+		return nil
+	}
+}
+
+//WithBuckets adds the BoltDB buckets to be created on Connect
+func WithBuckets(names ...string) Option {
+	return boltOption("db.WithBuckets", func(o *Options) error {
+		if len(names) == 0 {
+			return errors.New("Option WithBuckets wants at least one bucket name")
+		}
+		for _, name := range names {
+			if name == "" {
+				return errors.New("Option WithBuckets wants non-empty bucket names")
+			}
+		}
+		o.Buckets = append(o.Buckets, names...)
+		return nil
+	})
+}
+
+//WithCollections adds the BoltDB collection buckets nested in the database bucket to be created on Connect,
+//they are used by ExecOn(database, collection)
+func WithCollections(database string, collections ...string) Option {
+	return boltOption("db.WithCollections", func(o *Options) error {
+		if database == "" || len(collections) == 0 {
+			return errors.New("Option WithCollections wants a non-empty database name and at least one collection")
+		}
+		for _, name := range collections {
+			if name == "" {
+				return errors.New("Option WithCollections wants non-empty collection names")
+			}
+		}
+		if o.Collections == nil {
+			o.Collections = map[string][]string{}
+		}
+		o.Collections[database] = append(o.Collections[database], collections...)
+		return nil
+	})
+}
+
+//WithAutoCreate makes BoltDB create the missing buckets, top-level or nested, on the first write like Mongo does,
+//reading a missing bucket gives no records instead of an error
+func WithAutoCreate() Option {
+	return boltOption("db.WithAutoCreate", func(o *Options) error {
+		o.AutoCreate = true
+		return nil
+	})
+}
+
+//WithPath makes BoltDB open a persistent db file at the path instead of an ephemeral one in the temp directory,
+//missing parent directories are created
+func WithPath(path string) Option {
+	return boltOption("db.WithPath", func(o *Options) error {
+		if path == "" {
+			return errors.New("Option WithPath wants a non-empty path")
+		}
+		o.Path = path
+		return nil
+	})
+}
+
+//WithFileMode sets the permissions of a new BoltDB file
+func WithFileMode(mode os.FileMode) Option {
+	return boltOption("db.WithFileMode", func(o *Options) error {
+		if mode == 0 || mode&^os.ModePerm != 0 {
+			return fmt.Errorf("Option WithFileMode wants non-zero permission bits, got %v", mode)
+		}
+		o.FileMode = mode
+		return nil
+	})
+}
+
+//WithBoltOptions sets the options of bolt.Open, e.g. &bolt.Options{Timeout: time.Second, ReadOnly: true}
+func WithBoltOptions(opts *bolt.Options) Option {
+	return boltOption("db.WithBoltOptions", func(o *Options) error {
+		if opts == nil {
+			return errors.New("Option WithBoltOptions wants non-nil options")
+		}
+		if opts.Timeout < 0 {
+			return fmt.Errorf("Option WithBoltOptions wants a non-negative timeout, got %v", opts.Timeout)
+		}
+		o.Bolt = opts
+		return nil
+	})
+}
+
+//WithNoSync makes BoltDB skip fsync after commits, it's for bulk loads which can be repeated after a crash
+func WithNoSync() Option {
+	return boltOption("db.WithNoSync", func(o *Options) error {
+		o.NoSync = true
+		return nil
+	})
+}
+
+//WithCodec sets the codec of the BoltDB values: db.GobCodec{}, db.JSONCodec{}, db.BSONCodec{} or a custom one.
+//The codec name is stored in a new db, a db written with another codec fails to open.
+func WithCodec(c Codec) Option {
+	return boltOption("db.WithCodec", func(o *Options) error {
+		if c == nil || c.Name() == "" {
+			return errors.New("Option WithCodec wants a codec with a non-empty name")
+		}
+		o.Codec = c
+		return nil
+	})
+}
+
+//WithBoltMode sets the mode of the Bolt session copy: BoltDefault, BoltReadOnly, BoltBatch or BoltStrict
+func WithBoltMode(mode BoltMode) Option {
+	return boltOption("db.WithBoltMode", func(o *Options) error {
+		if mode < BoltDefault || mode > BoltStrict {
+			return fmt.Errorf("Option WithBoltMode wants a mode from db.BoltDefault (0) to db.BoltStrict (3), got %d", mode)
+		}
+		o.BoltMode, o.boltModeSet = mode, true
+		return nil
+	})
+}
+
+//WithMode sets the consistency mode of the session copy, one of mgo.Eventual ... mgo.Nearest
+func WithMode(mode mgo.Mode) Option {
+	return func(o *Options) error {
+		if mode < mgo.Eventual || mode > mgo.Nearest {
+			return fmt.Errorf("Option WithMode wants a mode from mgo.Eventual (0) to mgo.Nearest (6), got %d", mode)
+		}
+		o.Mode, o.modeSet = mode, true
+		return nil
+	}
+}
+
+//WithRefresh makes the session copy refreshed when its mode is set
+func WithRefresh() Option {
+	return func(o *Options) error {
+		o.Refresh = true
+		return nil
+	}
+}
+
+//boltOption marks the option as a BoltDB one
+func boltOption(name string, opt Option) Option {
+	return func(o *Options) error {
+		err := opt(o)
+		if err != nil {
+			return err
+		}
+		o.boltSet = append(o.boltSet, name)
+		return nil
+	}
+}
+
+//rejectBolt fails if BoltDB options were given to another realization
+func (o *Options) rejectBolt() error {
+	if len(o.boltSet) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Unexpected options %s, they are for BoltDB only", strings.Join(o.boltSet, ", "))
+}
+
+//applyOptions collects the options, ok is false if args are positional resources, mixing both is an error
+func applyOptions(args []interface{}) (o *Options, ok bool, err error) {
+	o = &Options{}
+	for i, arg := range args {
+		opt, isOption := arg.(Option)
+		if i > 0 && isOption != ok {
+			return nil, false, fmt.Errorf("Unexpected `%T` at position %d, db.Option can't be mixed with positional resources", arg, i)
+		}
+		if !isOption {
+			continue
+		}
+		ok = true
+		if opt == nil {
+			return nil, false, fmt.Errorf("Unexpected nil db.Option at position %d", i)
+		}
+		err := opt(o)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return o, ok, nil
+}
+
+//connectOptions converts the resources of Connect to Options,
+//positional resources are `dsn string, buckets ...string`, non-string buckets are skipped
+func connectOptions(resources []interface{}) (*Options, error) {
+	o, ok, err := applyOptions(resources)
+	if err != nil || ok || len(resources) == 0 {
+		return o, err
+	}
+
+	o.DSN, ok = resources[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected resources set, want db.WithDSN(dsn) or `dsn string` first, got `%T`", resources[0])
+	}
+	for _, r := range resources[1:] {
+		if name, ok := r.(string); ok {
+			o.Buckets = append(o.Buckets, name)
+		}
+	}
+	return o, nil
+}
+
+//requireDSN is connectOptions for the realizations which can't connect without a dsn
+func requireDSN(resources []interface{}) (*Options, error) {
+	o, err := connectOptions(resources)
+	if err != nil {
+		return nil, err
+	}
+	if o.DSN == "" {
+		return nil, errors.New("Unexpected resources set, want a non-empty db.WithDSN(dsn) or `dsn string`")
+	}
+	return o, nil
+}
+
+//settingsOptions converts the settings of CopyWithSettings to Options, positional settings are `mode int, refresh bool`
+func settingsOptions(settings []interface{}) (*Options, error) {
+	o, ok, err := applyOptions(settings)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return o, o.rejectBolt()
+	}
+
+	const want = "want db.WithMode(mode), db.WithRefresh() or `mode int, refresh bool`"
+	if len(settings) != 2 {
+		return nil, fmt.Errorf("Unexpected parameters set, %s, got %d value(s)", want, len(settings))
+	}
+
+	var mode mgo.Mode
+	switch m := settings[0].(type) {
+	case int:
+		mode = mgo.Mode(m)
+	case mgo.Mode:
+		mode = m
+	default:
+		return nil, fmt.Errorf("Unexpected parameters set, %s, got `%T` as a mode", want, settings[0])
+	}
+	refresh, ok := settings[1].(bool)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected parameters set, %s, got `%T` as a refresh", want, settings[1])
+	}
+
+	err = WithMode(mode)(o)
+	if err != nil {
+		return nil, err
+	}
+	o.Refresh = refresh
+	return o, nil
+}
+
+//databaseOf returns the database name of a mongo connection string like "mongodb://host:port/name?options",
+//any other dsn is the database name itself
+func databaseOf(dsn string) string {
+	i := strings.Index(dsn, "://")
+	if i < 0 {
+		return dsn
+	}
+	dsn = dsn[i+3:]
+	if i := strings.IndexByte(dsn, '?'); i >= 0 {
+		dsn = dsn[:i]
+	}
+	i = strings.Index(dsn, "/")
+	if i < 0 {
+		return ""
+	}
+	return dsn[i+1:]
+}
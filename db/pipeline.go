@@ -0,0 +1,546 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+//pipe runs an aggregation pipeline in-process over the documents given by source
+type pipe struct {
+	pipeline interface{}
+	source   func() ([]bson.M, error)
+}
+
+//One unmarshals the first document of the pipeline result into result, returns ErrNotFound if there is none
+func (p *pipe) One(result interface{}) error {
+	docs, err := p.docs()
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return ErrNotFound
+	}
+	return assign(docs[0], result)
+}
+
+//All unmarshals the documents of the pipeline result into the slice pointed by results
+func (p *pipe) All(results interface{}) error {
+	docs, err := p.docs()
+	if err != nil {
+		return err
+	}
+	if docs == nil {
+		docs = []bson.M{}
+	}
+	return assignSlice(docs, results)
+}
+
+//Iter returns an iterator over the documents of the pipeline result
+func (p *pipe) Iter() Iterator {
+	docs, err := p.docs()
+	if err != nil {
+		return &sliceIter{err: err}
+	}
+	return newSliceIter(docs)
+}
+
+func (p *pipe) docs() ([]bson.M, error) {
+	stages, err := stagesOf(p.pipeline)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := p.source()
+	if err != nil {
+		return nil, err
+	}
+	return runPipeline(docs, stages)
+}
+
+//stage is one step of a pipeline like {"$match": {...}}
+type stage struct {
+	op  string
+	arg interface{}
+}
+
+//stagesOf splits a pipeline, a slice of bson.M, bson.D or map[string]interface{}, into the stages
+func stagesOf(pipeline interface{}) ([]stage, error) {
+	v := reflect.ValueOf(pipeline)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("Unexpected pipeline `%T`, want a slice of stages like []bson.M", pipeline)
+	}
+
+	stages := make([]stage, v.Len())
+	for i := range stages {
+		var keys []string
+		var args []interface{}
+		switch s := v.Index(i).Interface().(type) {
+		case bson.M:
+			for key, arg := range s {
+				keys, args = append(keys, key), append(args, arg)
+			}
+		case map[string]interface{}:
+			for key, arg := range s {
+				keys, args = append(keys, key), append(args, arg)
+			}
+		case bson.D:
+			for _, e := range s {
+				keys, args = append(keys, e.Name), append(args, e.Value)
+			}
+		default:
+			return nil, fmt.Errorf("Unexpected pipeline stage `%T` at position %d, want a document like bson.M{\"$match\": ...}", s, i)
+		}
+		if len(keys) != 1 {
+			return nil, fmt.Errorf("Pipeline stage at position %d wants exactly one operator, got %d", i, len(keys))
+		}
+		stages[i] = stage{op: keys[0], arg: args[0]}
+	}
+	return stages, nil
+}
+
+//runPipeline passes the documents through the stages,
+//supported are $match, $project, $group, $sort, $unwind, $skip and $limit
+func runPipeline(docs []bson.M, stages []stage) ([]bson.M, error) {
+	for _, s := range stages {
+		var err error
+		switch s.op {
+		case "$match":
+			docs, err = matchStage(docs, s.arg)
+		case "$project":
+			docs, err = projectStage(docs, s.arg)
+		case "$group":
+			docs, err = groupStage(docs, s.arg)
+		case "$sort":
+			docs, err = sortStage(docs, s.arg)
+		case "$unwind":
+			docs, err = unwindStage(docs, s.arg)
+		case "$skip", "$limit":
+			docs, err = windowStage(docs, s.op, s.arg)
+		default:
+			err = fmt.Errorf("Unsupported pipeline stage `%s`", s.op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+func matchStage(docs []bson.M, arg interface{}) ([]bson.M, error) {
+	selector, ok := selectorOf(arg)
+	if !ok {
+		return nil, fmt.Errorf("Stage $match wants a selector document, got `%T`", arg)
+	}
+	var matched []bson.M
+	for _, doc := range docs {
+		ok, err := match(doc, selector)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, doc)
+		}
+	}
+	return matched, nil
+}
+
+//projectStage keeps the fields set to 1 or true, removes the fields set to 0 or false
+//and sets the other fields to the values of their expressions
+func projectStage(docs []bson.M, arg interface{}) ([]bson.M, error) {
+	spec, ok := selectorOf(arg)
+	if !ok || len(spec) == 0 {
+		return nil, fmt.Errorf("Stage $project wants a non-empty document, got `%v`", arg)
+	}
+
+	var exclusion, inclusion bool
+	for field, v := range spec {
+		switch {
+		case !isFlag(v):
+			inclusion = true
+		case field == "_id":
+		case truthy(v):
+			inclusion = true
+		default:
+			exclusion = true
+		}
+	}
+	if exclusion && inclusion {
+		return nil, errors.New("Stage $project can't mix the exclusion of fields with the inclusion or expressions except `_id`")
+	}
+
+	projected := make([]bson.M, 0, len(docs))
+	for _, doc := range docs {
+		if !inclusion {
+			out := copyDoc(doc)
+			for field := range spec {
+				unsetPath(out, field)
+			}
+			projected = append(projected, out)
+			continue
+		}
+
+		out := bson.M{}
+		if v, ok := spec["_id"]; !ok || (isFlag(v) && truthy(v)) {
+			if id, ok := doc["_id"]; ok {
+				out["_id"] = id
+			}
+		}
+		for field, v := range spec {
+			var value interface{}
+			var found bool
+			switch {
+			case !isFlag(v):
+				var err error
+				value, found, err = evalExpr(doc, v)
+				if err != nil {
+					return nil, err
+				}
+			case field != "_id" && truthy(v):
+				value, found = getPath(doc, field)
+			}
+			if !found {
+				continue
+			}
+			err := setPath(out, field, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		projected = append(projected, out)
+	}
+	return projected, nil
+}
+
+//groupStage groups the documents by the `_id` expression in the order of their first appearance.
+//Supported accumulators are $sum, $avg, $min, $max, $first, $last, $push and $addToSet.
+func groupStage(docs []bson.M, arg interface{}) ([]bson.M, error) {
+	spec, ok := selectorOf(arg)
+	if !ok {
+		return nil, fmt.Errorf("Stage $group wants a document, got `%T`", arg)
+	}
+	idExpr, ok := spec["_id"]
+	if !ok {
+		return nil, errors.New("Stage $group wants an `_id` expression")
+	}
+
+	type accumulator struct {
+		field, op string
+		expr      interface{}
+	}
+	var accs []accumulator
+	for field, v := range spec {
+		if field == "_id" {
+			continue
+		}
+		if strings.Contains(field, ".") {
+			return nil, fmt.Errorf("Stage $group can't use a dotted field name `%s`", field)
+		}
+		op, ok := v.(bson.M)
+		if !ok || len(op) != 1 {
+			return nil, fmt.Errorf("Stage $group wants one accumulator like {\"$sum\": 1} for the field `%s`", field)
+		}
+		for name, expr := range op {
+			accs = append(accs, accumulator{field: field, op: name, expr: expr})
+		}
+	}
+
+	type group struct {
+		id     interface{}
+		values map[string][]interface{} //values of the accumulator expressions, missing ones are skipped
+		first  map[string]interface{}
+		last   map[string]interface{}
+	}
+	var groups []*group
+	for _, doc := range docs {
+		id, _, err := evalExpr(doc, idExpr)
+		if err != nil {
+			return nil, err
+		}
+		var g *group
+		for _, other := range groups {
+			if equal(other.id, id) {
+				g = other
+				break
+			}
+		}
+		if g == nil {
+			g = &group{id: id, values: map[string][]interface{}{}, first: map[string]interface{}{}, last: map[string]interface{}{}}
+			groups = append(groups, g)
+		}
+
+		for _, acc := range accs {
+			value, found, err := evalExpr(doc, acc.expr)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := g.first[acc.field]; !ok {
+				g.first[acc.field] = value
+			}
+			g.last[acc.field] = value
+			if found && value != nil {
+				g.values[acc.field] = append(g.values[acc.field], value)
+			}
+		}
+	}
+
+	grouped := make([]bson.M, 0, len(groups))
+	for _, g := range groups {
+		out := bson.M{"_id": g.id}
+		for _, acc := range accs {
+			values := g.values[acc.field]
+			switch acc.op {
+			case "$sum":
+				out[acc.field] = sumOf(values)
+			case "$avg":
+				out[acc.field] = avgOf(values)
+			case "$min", "$max":
+				var m interface{}
+				for _, v := range values {
+					c := compareSort(v, m)
+					if m == nil || (acc.op == "$min" && c < 0) || (acc.op == "$max" && c > 0) {
+						m = v
+					}
+				}
+				out[acc.field] = m
+			case "$first":
+				out[acc.field] = g.first[acc.field]
+			case "$last":
+				out[acc.field] = g.last[acc.field]
+			case "$push":
+				out[acc.field] = append([]interface{}{}, values...)
+			case "$addToSet":
+				set := []interface{}{}
+				for _, v := range values {
+					if !containsValue(set, v) {
+						set = append(set, v)
+					}
+				}
+				out[acc.field] = set
+			default:
+				return nil, fmt.Errorf("Unsupported group accumulator `%s`", acc.op)
+			}
+		}
+		grouped = append(grouped, out)
+	}
+	return grouped, nil
+}
+
+//sortStage orders the documents like Sort, several fields have to be given as bson.D to keep their order
+func sortStage(docs []bson.M, arg interface{}) ([]bson.M, error) {
+	var fields []string
+	addField := func(name string, dir interface{}) error {
+		rv := reflect.ValueOf(dir)
+		if !isNumber(rv) || (toFloat(rv) != 1 && toFloat(rv) != -1) {
+			return fmt.Errorf("Stage $sort wants 1 or -1 for the field `%s`, got `%v`", name, dir)
+		}
+		if toFloat(rv) < 0 {
+			name = "-" + name
+		}
+		fields = append(fields, name)
+		return nil
+	}
+
+	switch spec := arg.(type) {
+	case bson.D:
+		for _, e := range spec {
+			if err := addField(e.Name, e.Value); err != nil {
+				return nil, err
+			}
+		}
+	case bson.M, map[string]interface{}:
+		doc, _ := docOf(spec)
+		if len(doc) > 1 {
+			return nil, errors.New("Stage $sort wants bson.D for several fields, the order of bson.M keys is random")
+		}
+		for name, dir := range doc {
+			if err := addField(name, dir); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Stage $sort wants a non-empty document like bson.D{{\"age\", -1}}, got `%v`", arg)
+	}
+
+	sorted := append([]bson.M(nil), docs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return lessDoc(sorted[i], sorted[j], fields)
+	})
+	return sorted, nil
+}
+
+//unwindStage outputs a document for each element of an array field,
+//arg is "$field" or {"path": "$field", "includeArrayIndex": "index", "preserveNullAndEmptyArrays": true}
+func unwindStage(docs []bson.M, arg interface{}) ([]bson.M, error) {
+	var path, indexField string
+	var preserve bool
+	switch a := arg.(type) {
+	case string:
+		path = a
+	default:
+		spec, ok := selectorOf(arg)
+		if !ok {
+			return nil, fmt.Errorf("Stage $unwind wants a \"$field\" path or a document, got `%T`", arg)
+		}
+		path, _ = spec["path"].(string)
+		indexField, _ = spec["includeArrayIndex"].(string)
+		preserve = truthy(spec["preserveNullAndEmptyArrays"])
+	}
+	if !strings.HasPrefix(path, "$") || len(path) == 1 {
+		return nil, fmt.Errorf("Stage $unwind wants a path like \"$field\", got `%v`", path)
+	}
+	path = path[1:]
+
+	var unwound []bson.M
+	for _, doc := range docs {
+		value, _ := getPath(doc, path)
+		arr, isArray := value.([]interface{})
+		if !isArray || len(arr) == 0 {
+			if (isArray || value == nil) && !preserve {
+				continue
+			}
+			out := copyDoc(doc)
+			if isArray {
+				unsetPath(out, path)
+			}
+			if indexField != "" {
+				out[indexField] = nil
+			}
+			unwound = append(unwound, out)
+			continue
+		}
+		for i, v := range arr {
+			out := copyDoc(doc)
+			err := setPath(out, path, v)
+			if err != nil {
+				return nil, err
+			}
+			if indexField != "" {
+				out[indexField] = int64(i)
+			}
+			unwound = append(unwound, out)
+		}
+	}
+	return unwound, nil
+}
+
+func windowStage(docs []bson.M, op string, arg interface{}) ([]bson.M, error) {
+	rv := reflect.ValueOf(arg)
+	if !isInt(rv) || toInt(rv) < 0 || (op == "$limit" && toInt(rv) == 0) {
+		return nil, fmt.Errorf("Stage %s wants a positive integer, got `%v`", op, arg)
+	}
+	n := int(toInt(rv))
+	if op == "$skip" {
+		if n >= len(docs) {
+			return nil, nil
+		}
+		return docs[n:], nil
+	}
+	if n < len(docs) {
+		return docs[:n], nil
+	}
+	return docs, nil
+}
+
+//evalExpr evaluates an expression of $project or $group: "$field" paths, "$$ROOT", {"$literal": value},
+//documents and arrays of expressions and constants. found is false for a missing field.
+func evalExpr(doc bson.M, expr interface{}) (value interface{}, found bool, err error) {
+	switch e := expr.(type) {
+	case string:
+		switch {
+		case e == "$$ROOT":
+			return doc, true, nil
+		case strings.HasPrefix(e, "$$"):
+			return nil, false, fmt.Errorf("Unsupported expression variable `%s`", e)
+		case strings.HasPrefix(e, "$"):
+			value, found = getPath(doc, e[1:])
+			return value, found, nil
+		}
+	case bson.M:
+		if literal, ok := e["$literal"]; ok && len(e) == 1 {
+			return literal, true, nil
+		}
+		out := bson.M{}
+		for field, sub := range e {
+			if strings.HasPrefix(field, "$") {
+				return nil, false, fmt.Errorf("Unsupported expression operator `%s`", field)
+			}
+			v, found, err := evalExpr(doc, sub)
+			if err != nil {
+				return nil, false, err
+			}
+			if found {
+				out[field] = v
+			}
+		}
+		return out, true, nil
+	case []interface{}:
+		out := make([]interface{}, len(e))
+		for i, sub := range e {
+			v, _, err := evalExpr(doc, sub)
+			if err != nil {
+				return nil, false, err
+			}
+			out[i] = v
+		}
+		return out, true, nil
+	}
+	return expr, true, nil
+}
+
+//isFlag reports whether a $project value switches a field on or off rather than being an expression
+func isFlag(v interface{}) bool {
+	_, ok := v.(bool)
+	return ok || isNumber(reflect.ValueOf(v))
+}
+
+//sumOf adds up the numbers skipping other values, the sum is an int unless there are floats
+func sumOf(values []interface{}) interface{} {
+	var i int64
+	var f float64
+	floats := false
+	for _, v := range values {
+		rv := reflect.ValueOf(v)
+		switch {
+		case isInt(rv):
+			i += toInt(rv)
+		case isNumber(rv):
+			f += toFloat(rv)
+			floats = true
+		}
+	}
+	if floats {
+		return f + float64(i)
+	}
+	return int(i)
+}
+
+//avgOf averages the numbers skipping other values, it's nil without numbers
+func avgOf(values []interface{}) interface{} {
+	var sum float64
+	n := 0
+	for _, v := range values {
+		rv := reflect.ValueOf(v)
+		if isNumber(rv) {
+			sum += toFloat(rv)
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return sum / float64(n)
+}
+
+func containsValue(set []interface{}, value interface{}) bool {
+	for _, v := range set {
+		if equal(v, value) {
+			return true
+		}
+	}
+	return false
+}
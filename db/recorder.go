@@ -0,0 +1,922 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+//Matcher checks an argument of a recorded call, pass it instead of a value to an expectation
+type Matcher func(arg interface{}) bool
+
+//Any matches every argument
+var Any = Matcher(func(interface{}) bool { return true })
+
+//TestingT is the part of *testing.T used by Recorder
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+//Call describes a call received by Recorder
+type Call struct {
+	Method    string
+	Resources []interface{} //arguments of ExecOn the call was made on
+	Query     interface{}   //argument of Find for the Refiner methods
+	Pipeline  interface{}   //argument of Pipe for the Piper methods
+	Args      []interface{}
+	Context   context.Context //ctx of the ...Context variant of the method, nil for the plain one
+}
+
+func (c Call) String() string {
+	var s string
+	if c.Resources != nil {
+		s = fmt.Sprintf("ExecOn(%s).", formatArgs(c.Resources))
+	}
+	switch {
+	case c.Pipeline != nil:
+		s += fmt.Sprintf("Pipe(%s).", formatArgs([]interface{}{c.Pipeline}))
+	case c.Method == "One", c.Method == "All", c.Method == "Distinct", c.Method == "Count", c.Method == "Iter",
+		c.Method == "Sort", c.Method == "Limit", c.Method == "Skip", c.Method == "Select":
+		s += fmt.Sprintf("Find(%s).", formatArgs([]interface{}{c.Query}))
+	}
+	return s + fmt.Sprintf("%s(%s)", c.Method, formatArgs(c.Args))
+}
+
+/*
+Recorder is a mock recording calls and verifying them against the expectations, e.g.
+
+	rec := &db.Recorder{}
+	rec.ExpectExecOn("users").Find(bson.M{"_id": id}).One().Return(bson.M{"_id": id, "name": "ann"}, nil)
+	rec.ExpectExecOn("users").Insert(db.Any).Return(nil).Times(2)
+
+	...code under test using db.New(rec)...
+
+	rec.AssertExpectations(t)
+
+Calls of the Querier, Refiner and Piper methods without a matching expectation return an error and fail AssertExpectations.
+Calls of the Handler methods are recorded and succeed unless ExpectConnect, ExpectCopyWithSettings
+or ExpectWithTransaction say otherwise. Sort, Limit, Skip and Select are recorded and never fail.
+Copies of the Recorder are the Recorder itself.
+The ...Context variants of the methods are recorded and matched as the plain ones with Call.Context set,
+a call with a cancelled or expired ctx returns ctx.Err() without using up an expectation.
+*/
+type Recorder struct {
+	mu           sync.Mutex
+	expectations []*Expectation
+	calls        []Call
+	failures     []string
+}
+
+//Expectation describes an expected call and the values it returns
+type Expectation struct {
+	call    Call
+	refiner bool
+	returns []interface{}
+	times   int //-1 for any number of calls
+	calls   int
+	after   []*Expectation
+}
+
+//ExpectedCollection creates expectations for the Querier methods called on ExecOn(resources...)
+type ExpectedCollection struct {
+	rec       *Recorder
+	resources []interface{}
+}
+
+//ExpectedQuery creates expectations for the Refiner methods called on Find(query)
+type ExpectedQuery struct {
+	rec       *Recorder
+	resources []interface{}
+	query     interface{}
+}
+
+//ExpectedPipe creates expectations for the Piper methods called on Pipe(pipeline)
+type ExpectedPipe struct {
+	rec       *Recorder
+	resources []interface{}
+	pipeline  interface{}
+}
+
+//ExpectConnect sets the result of Connect called with matching resources
+func (r *Recorder) ExpectConnect(resources ...interface{}) *Expectation {
+	return r.expect(Call{Method: "Connect", Args: resources}, false)
+}
+
+//ExpectCopyWithSettings sets the result of CopyWithSettings called with matching settings
+func (r *Recorder) ExpectCopyWithSettings(settings ...interface{}) *Expectation {
+	return r.expect(Call{Method: "CopyWithSettings", Args: settings}, false)
+}
+
+//ExpectWithTransaction sets the result of WithTransaction, an error is returned without calling fn
+func (r *Recorder) ExpectWithTransaction() *Expectation {
+	return r.expect(Call{Method: "WithTransaction"}, false)
+}
+
+//ExpectExecOn starts expectations for the calls made on ExecOn with matching resources
+func (r *Recorder) ExpectExecOn(resources ...interface{}) *ExpectedCollection {
+	if resources == nil {
+		resources = []interface{}{}
+	}
+	return &ExpectedCollection{rec: r, resources: resources}
+}
+
+//InOrder makes each expectation wait for the previous one to get all of its calls
+func (r *Recorder) InOrder(exps ...*Expectation) {
+	for i := 1; i < len(exps); i++ {
+		exps[i].After(exps[i-1])
+	}
+}
+
+//Calls returns the calls received so far
+func (r *Recorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call(nil), r.calls...)
+}
+
+//AssertExpectations reports unexpected calls, calls made out of order and expectations with a wrong number of calls
+func (r *Recorder) AssertExpectations(t TestingT) bool {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ok := len(r.failures) == 0
+	for _, f := range r.failures {
+		t.Errorf("%s", f)
+	}
+	for _, e := range r.expectations {
+		if e.times >= 0 && e.calls != e.times {
+			t.Errorf("Expected %s to be called %d time(s), got %d", e.call, e.times, e.calls)
+			ok = false
+		}
+	}
+	return ok
+}
+
+//Connect records the call
+func (r *Recorder) Connect(resources ...interface{}) error {
+	e, _ := r.handle(Call{Method: "Connect", Args: resources})
+	return e.err(0)
+}
+
+//ConnectContext records the call, a done ctx gives its error
+func (r *Recorder) ConnectContext(ctx context.Context, resources ...interface{}) error {
+	e, err := r.handle(Call{Method: "Connect", Args: resources, Context: ctx})
+	if err != nil {
+		return err
+	}
+	return e.err(0)
+}
+
+//Copy records the call and returns the Recorder
+func (r *Recorder) Copy() Handler {
+	r.handle(Call{Method: "Copy"})
+	return r
+}
+
+//CopyWithSettings records the call and returns the Recorder
+func (r *Recorder) CopyWithSettings(settings ...interface{}) (Handler, error) {
+	e, _ := r.handle(Call{Method: "CopyWithSettings", Args: settings})
+	if err := e.err(0); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//Close records the call
+func (r *Recorder) Close() {
+	r.handle(Call{Method: "Close"})
+}
+
+//WithTransaction records the call and calls fn with the Recorder as tx,
+//then records "Commit" if fn returned nil or "Rollback" otherwise
+func (r *Recorder) WithTransaction(fn func(tx Tx) error) error {
+	e, _ := r.handle(Call{Method: "WithTransaction"})
+	if err := e.err(0); err != nil {
+		return err
+	}
+	if err := fn(r); err != nil {
+		r.handle(Call{Method: "Rollback"})
+		return err
+	}
+	r.handle(Call{Method: "Commit"})
+	return nil
+}
+
+//ExecOn records the call and returns a Querier checking the calls against the expectations
+func (r *Recorder) ExecOn(resources ...interface{}) Querier {
+	if resources == nil {
+		resources = []interface{}{}
+	}
+	r.handle(Call{Method: "ExecOn", Args: resources})
+	return &RecorderCollection{rec: r, resources: resources}
+}
+
+func (r *Recorder) expect(call Call, refiner bool) *Expectation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e := &Expectation{call: call, refiner: refiner, times: 1}
+	r.expectations = append(r.expectations, e)
+	return e
+}
+
+//handle records a Handler call, such calls never fail as unexpected, only a done ctx gives an error
+func (r *Recorder) handle(call Call) (*Expectation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = append(r.calls, call)
+	if call.Context != nil && call.Context.Err() != nil {
+		return nil, call.Context.Err()
+	}
+	for _, e := range r.expectations {
+		if e.call.Method == call.Method && e.matches(call) {
+			e.calls++
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+//check records a call and finds the expectation for it
+func (r *Recorder) check(call Call) (*Expectation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = append(r.calls, call)
+	if call.Context != nil && call.Context.Err() != nil {
+		return nil, call.Context.Err()
+	}
+
+	var matched, exhausted *Expectation
+	for _, e := range r.expectations {
+		if !e.matches(call) {
+			continue
+		}
+		if e.times >= 0 && e.calls >= e.times {
+			exhausted = e
+			continue
+		}
+		matched = e
+		break
+	}
+
+	if matched == nil {
+		msg := fmt.Sprintf("Unexpected call %s", call)
+		if exhausted != nil {
+			msg = fmt.Sprintf("Call %s made more than %d time(s)", call, exhausted.times)
+		}
+		r.failures = append(r.failures, msg)
+		return nil, errors.New(msg)
+	}
+
+	for _, prev := range matched.after {
+		if !prev.done() {
+			msg := fmt.Sprintf("Call %s made before %s", call, prev.call)
+			r.failures = append(r.failures, msg)
+			return nil, errors.New(msg)
+		}
+	}
+
+	matched.calls++
+	return matched, nil
+}
+
+//Return sets the values returned by the call, they follow the method's signature:
+//an error for Insert, Remove, Update, EnsureIndex and DropIndex, a number and an error for RemoveAll, UpdateAll, Upsert and Count,
+//a document (or a slice of them) and an error for One, All, Distinct and Iter of a query or a pipeline,
+//a []mgo.Index and an error for Indexes
+func (e *Expectation) Return(values ...interface{}) *Expectation {
+	e.returns = values
+	return e
+}
+
+//Times sets the exact number of calls, it's 1 by default
+func (e *Expectation) Times(n int) *Expectation {
+	e.times = n
+	return e
+}
+
+//Once expects exactly one call
+func (e *Expectation) Once() *Expectation {
+	return e.Times(1)
+}
+
+//AnyTimes allows any number of calls including none
+func (e *Expectation) AnyTimes() *Expectation {
+	return e.Times(-1)
+}
+
+//After makes the expectation wait for others to get all of their calls
+func (e *Expectation) After(prev ...*Expectation) *Expectation {
+	e.after = append(e.after, prev...)
+	return e
+}
+
+func (e *Expectation) done() bool {
+	return e.times < 0 || e.calls >= e.times
+}
+
+func (e *Expectation) matches(call Call) bool {
+	if e.call.Method != call.Method {
+		return false
+	}
+	if e.call.Resources != nil && !argsMatch(e.call.Resources, call.Resources) {
+		return false
+	}
+	if e.refiner && (!argMatch(e.call.Query, call.Query) || !argMatch(e.call.Pipeline, call.Pipeline)) {
+		return false
+	}
+	return argsMatch(e.call.Args, call.Args)
+}
+
+func (e *Expectation) value(i int) interface{} {
+	if e == nil || i >= len(e.returns) {
+		return nil
+	}
+	return e.returns[i]
+}
+
+func (e *Expectation) err(i int) error {
+	err, _ := e.value(i).(error)
+	return err
+}
+
+func (e *Expectation) num(i int) int {
+	num, _ := e.value(i).(int)
+	return num
+}
+
+func (ec *ExpectedCollection) expect(method string, args ...interface{}) *Expectation {
+	return ec.rec.expect(Call{Method: method, Resources: ec.resources, Args: args}, false)
+}
+
+//Insert expects Insert with matching docs
+func (ec *ExpectedCollection) Insert(docs ...interface{}) *Expectation {
+	return ec.expect("Insert", docs...)
+}
+
+//Remove expects Remove with a matching selector
+func (ec *ExpectedCollection) Remove(selector interface{}) *Expectation {
+	return ec.expect("Remove", selector)
+}
+
+//RemoveAll expects RemoveAll with a matching selector
+func (ec *ExpectedCollection) RemoveAll(selector interface{}) *Expectation {
+	return ec.expect("RemoveAll", selector)
+}
+
+//Update expects Update with matching selector and update
+func (ec *ExpectedCollection) Update(selector interface{}, update interface{}) *Expectation {
+	return ec.expect("Update", selector, update)
+}
+
+//UpdateAll expects UpdateAll with matching selector and update
+func (ec *ExpectedCollection) UpdateAll(selector interface{}, update interface{}) *Expectation {
+	return ec.expect("UpdateAll", selector, update)
+}
+
+//Upsert expects Upsert with matching selector and update
+func (ec *ExpectedCollection) Upsert(selector interface{}, update interface{}) *Expectation {
+	return ec.expect("Upsert", selector, update)
+}
+
+//EnsureIndex expects EnsureIndex with matching arguments
+func (ec *ExpectedCollection) EnsureIndex(keys, unique, sparse, ttl interface{}) *Expectation {
+	return ec.expect("EnsureIndex", keys, unique, sparse, ttl)
+}
+
+//DropIndex expects DropIndex with matching keys
+func (ec *ExpectedCollection) DropIndex(keys ...interface{}) *Expectation {
+	return ec.expect("DropIndex", keys...)
+}
+
+//Indexes expects Indexes, the returned []mgo.Index is the result
+func (ec *ExpectedCollection) Indexes() *Expectation {
+	return ec.expect("Indexes")
+}
+
+//Find starts expectations for the Refiner methods called on Find with a matching query
+func (ec *ExpectedCollection) Find(query interface{}) *ExpectedQuery {
+	return &ExpectedQuery{rec: ec.rec, resources: ec.resources, query: query}
+}
+
+func (eq *ExpectedQuery) expect(method string, args ...interface{}) *Expectation {
+	return eq.rec.expect(Call{Method: method, Resources: eq.resources, Query: eq.query, Args: args}, true)
+}
+
+//One expects One, the returned document is copied into the result
+func (eq *ExpectedQuery) One() *Expectation {
+	return eq.expect("One")
+}
+
+//All expects All, the returned slice is copied into the results
+func (eq *ExpectedQuery) All() *Expectation {
+	return eq.expect("All")
+}
+
+//Distinct expects Distinct with a matching key, the returned slice is copied into the result
+func (eq *ExpectedQuery) Distinct(key interface{}) *Expectation {
+	return eq.expect("Distinct", key)
+}
+
+//Count expects Count
+func (eq *ExpectedQuery) Count() *Expectation {
+	return eq.expect("Count")
+}
+
+//Iter expects Iter, the iterator goes over the returned slice and ends with the returned error
+func (eq *ExpectedQuery) Iter() *Expectation {
+	return eq.expect("Iter")
+}
+
+//Pipe starts expectations for the Piper methods called on Pipe with a matching pipeline
+func (ec *ExpectedCollection) Pipe(pipeline interface{}) *ExpectedPipe {
+	if pipeline == nil {
+		pipeline = []interface{}{}
+	}
+	return &ExpectedPipe{rec: ec.rec, resources: ec.resources, pipeline: pipeline}
+}
+
+func (ep *ExpectedPipe) expect(method string) *Expectation {
+	return ep.rec.expect(Call{Method: method, Resources: ep.resources, Pipeline: ep.pipeline}, true)
+}
+
+//One expects One, the returned document is copied into the result
+func (ep *ExpectedPipe) One() *Expectation {
+	return ep.expect("One")
+}
+
+//All expects All, the returned slice is copied into the results
+func (ep *ExpectedPipe) All() *Expectation {
+	return ep.expect("All")
+}
+
+//Iter expects Iter, the iterator goes over the returned slice and ends with the returned error
+func (ep *ExpectedPipe) Iter() *Expectation {
+	return ep.expect("Iter")
+}
+
+//RecorderCollection checks the Querier calls against the expectations
+type RecorderCollection struct {
+	rec       *Recorder
+	resources []interface{}
+}
+
+func (rc *RecorderCollection) check(ctx context.Context, method string, args ...interface{}) (*Expectation, error) {
+	return rc.rec.check(Call{Method: method, Resources: rc.resources, Args: args, Context: ctx})
+}
+
+//Insert returns the error set by the expectation
+func (rc *RecorderCollection) Insert(docs ...interface{}) error {
+	return rc.insert(nil, docs...)
+}
+
+//InsertContext is Insert, a done ctx gives its error
+func (rc *RecorderCollection) InsertContext(ctx context.Context, docs ...interface{}) error {
+	return rc.insert(ctx, docs...)
+}
+
+func (rc *RecorderCollection) insert(ctx context.Context, docs ...interface{}) error {
+	e, err := rc.check(ctx, "Insert", docs...)
+	if err != nil {
+		return err
+	}
+	return e.err(0)
+}
+
+//Remove returns the error set by the expectation
+func (rc *RecorderCollection) Remove(selector interface{}) error {
+	return rc.remove(nil, selector)
+}
+
+//RemoveContext is Remove, a done ctx gives its error
+func (rc *RecorderCollection) RemoveContext(ctx context.Context, selector interface{}) error {
+	return rc.remove(ctx, selector)
+}
+
+func (rc *RecorderCollection) remove(ctx context.Context, selector interface{}) error {
+	e, err := rc.check(ctx, "Remove", selector)
+	if err != nil {
+		return err
+	}
+	return e.err(0)
+}
+
+//RemoveAll returns the number and the error set by the expectation
+func (rc *RecorderCollection) RemoveAll(selector interface{}) (num int, err error) {
+	return rc.removeAll(nil, selector)
+}
+
+//RemoveAllContext is RemoveAll, a done ctx gives its error
+func (rc *RecorderCollection) RemoveAllContext(ctx context.Context, selector interface{}) (num int, err error) {
+	return rc.removeAll(ctx, selector)
+}
+
+func (rc *RecorderCollection) removeAll(ctx context.Context, selector interface{}) (num int, err error) {
+	e, err := rc.check(ctx, "RemoveAll", selector)
+	if err != nil {
+		return 0, err
+	}
+	return e.num(0), e.err(1)
+}
+
+//Update returns the error set by the expectation
+func (rc *RecorderCollection) Update(selector interface{}, update interface{}) error {
+	return rc.update(nil, selector, update)
+}
+
+//UpdateContext is Update, a done ctx gives its error
+func (rc *RecorderCollection) UpdateContext(ctx context.Context, selector interface{}, update interface{}) error {
+	return rc.update(ctx, selector, update)
+}
+
+func (rc *RecorderCollection) update(ctx context.Context, selector interface{}, update interface{}) error {
+	e, err := rc.check(ctx, "Update", selector, update)
+	if err != nil {
+		return err
+	}
+	return e.err(0)
+}
+
+//UpdateAll returns the number and the error set by the expectation
+func (rc *RecorderCollection) UpdateAll(selector interface{}, update interface{}) (num int, err error) {
+	return rc.updateAll(nil, selector, update)
+}
+
+//UpdateAllContext is UpdateAll, a done ctx gives its error
+func (rc *RecorderCollection) UpdateAllContext(ctx context.Context, selector interface{}, update interface{}) (num int, err error) {
+	return rc.updateAll(ctx, selector, update)
+}
+
+func (rc *RecorderCollection) updateAll(ctx context.Context, selector interface{}, update interface{}) (num int, err error) {
+	e, err := rc.check(ctx, "UpdateAll", selector, update)
+	if err != nil {
+		return 0, err
+	}
+	return e.num(0), e.err(1)
+}
+
+//Upsert returns the number and the error set by the expectation
+func (rc *RecorderCollection) Upsert(selector interface{}, update interface{}) (num int, err error) {
+	return rc.upsert(nil, selector, update)
+}
+
+//UpsertContext is Upsert, a done ctx gives its error
+func (rc *RecorderCollection) UpsertContext(ctx context.Context, selector interface{}, update interface{}) (num int, err error) {
+	return rc.upsert(ctx, selector, update)
+}
+
+func (rc *RecorderCollection) upsert(ctx context.Context, selector interface{}, update interface{}) (num int, err error) {
+	e, err := rc.check(ctx, "Upsert", selector, update)
+	if err != nil {
+		return 0, err
+	}
+	return e.num(0), e.err(1)
+}
+
+//EnsureIndex returns the error set by the expectation
+func (rc *RecorderCollection) EnsureIndex(keys []string, unique, sparse bool, ttl time.Duration) error {
+	e, err := rc.check(nil, "EnsureIndex", keys, unique, sparse, ttl)
+	if err != nil {
+		return err
+	}
+	return e.err(0)
+}
+
+//DropIndex returns the error set by the expectation
+func (rc *RecorderCollection) DropIndex(keys ...string) error {
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	e, err := rc.check(nil, "DropIndex", args...)
+	if err != nil {
+		return err
+	}
+	return e.err(0)
+}
+
+//Indexes returns the indexes and the error set by the expectation
+func (rc *RecorderCollection) Indexes() (indexes []mgo.Index, err error) {
+	e, err := rc.check(nil, "Indexes")
+	if err != nil {
+		return nil, err
+	}
+	indexes, _ = e.value(0).([]mgo.Index)
+	return indexes, e.err(1)
+}
+
+//Find returns a Refiner checking its calls against the expectations set for the query
+func (rc *RecorderCollection) Find(query interface{}) Refiner {
+	return &RecorderQuery{rec: rc.rec, resources: rc.resources, query: query}
+}
+
+//Pipe returns a Piper checking its calls against the expectations set for the pipeline
+func (rc *RecorderCollection) Pipe(pipeline interface{}) Piper {
+	if pipeline == nil {
+		pipeline = []interface{}{}
+	}
+	return &RecorderPipe{rec: rc.rec, resources: rc.resources, pipeline: pipeline}
+}
+
+//RecorderPipe checks the Piper calls against the expectations
+type RecorderPipe struct {
+	rec       *Recorder
+	resources []interface{}
+	pipeline  interface{}
+}
+
+func (rp *RecorderPipe) check(method string) (*Expectation, error) {
+	return rp.rec.check(Call{Method: method, Resources: rp.resources, Pipeline: rp.pipeline})
+}
+
+//One copies the document set by the expectation into result
+func (rp *RecorderPipe) One(result interface{}) error {
+	e, err := rp.check("One")
+	if err != nil {
+		return err
+	}
+	if doc := e.value(0); doc != nil {
+		err := assign(doc, result)
+		if err != nil {
+			return err
+		}
+	}
+	return e.err(1)
+}
+
+//All copies the documents set by the expectation into results
+func (rp *RecorderPipe) All(results interface{}) error {
+	e, err := rp.check("All")
+	if err != nil {
+		return err
+	}
+	if docs := e.value(0); docs != nil {
+		err := assignSlice(docs, results)
+		if err != nil {
+			return err
+		}
+	}
+	return e.err(1)
+}
+
+//Iter returns an iterator over the documents set by the expectation
+func (rp *RecorderPipe) Iter() Iterator {
+	e, err := rp.check("Iter")
+	if err != nil {
+		return &sliceIter{err: err}
+	}
+	it := newSliceIter(e.value(0))
+	it.tail = e.err(1)
+	return it
+}
+
+//RecorderQuery checks the Refiner calls against the expectations
+type RecorderQuery struct {
+	rec       *Recorder
+	resources []interface{}
+	query     interface{}
+}
+
+func (rq *RecorderQuery) check(ctx context.Context, method string, args ...interface{}) (*Expectation, error) {
+	return rq.rec.check(Call{Method: method, Resources: rq.resources, Query: rq.query, Args: args, Context: ctx})
+}
+
+//Iter returns an iterator over the documents set by the expectation
+func (rq *RecorderQuery) Iter() Iterator {
+	e, err := rq.check(nil, "Iter")
+	if err != nil {
+		return &sliceIter{err: err}
+	}
+	it := newSliceIter(e.value(0))
+	it.tail = e.err(1)
+	return it
+}
+
+//Sort records the call like the Handler methods, it never fails
+func (rq *RecorderQuery) Sort(fields ...string) Refiner {
+	args := make([]interface{}, len(fields))
+	for i, f := range fields {
+		args[i] = f
+	}
+	return rq.refine("Sort", args...)
+}
+
+//Limit records the call like the Handler methods, it never fails
+func (rq *RecorderQuery) Limit(n int) Refiner {
+	return rq.refine("Limit", n)
+}
+
+//Skip records the call like the Handler methods, it never fails
+func (rq *RecorderQuery) Skip(n int) Refiner {
+	return rq.refine("Skip", n)
+}
+
+//Select records the call like the Handler methods, it never fails
+func (rq *RecorderQuery) Select(projection interface{}) Refiner {
+	return rq.refine("Select", projection)
+}
+
+func (rq *RecorderQuery) refine(method string, args ...interface{}) Refiner {
+	rq.rec.handle(Call{Method: method, Resources: rq.resources, Query: rq.query, Args: args})
+	return rq
+}
+
+//One copies the document set by the expectation into result
+func (rq *RecorderQuery) One(result interface{}) error {
+	return rq.one(nil, result)
+}
+
+//OneContext is One, a done ctx gives its error
+func (rq *RecorderQuery) OneContext(ctx context.Context, result interface{}) error {
+	return rq.one(ctx, result)
+}
+
+func (rq *RecorderQuery) one(ctx context.Context, result interface{}) error {
+	e, err := rq.check(ctx, "One")
+	if err != nil {
+		return err
+	}
+	if doc := e.value(0); doc != nil {
+		err := assign(doc, result)
+		if err != nil {
+			return err
+		}
+	}
+	return e.err(1)
+}
+
+//All copies the documents set by the expectation into results
+func (rq *RecorderQuery) All(results interface{}) error {
+	return rq.all(nil, results)
+}
+
+//AllContext is All, a done ctx gives its error
+func (rq *RecorderQuery) AllContext(ctx context.Context, results interface{}) error {
+	return rq.all(ctx, results)
+}
+
+func (rq *RecorderQuery) all(ctx context.Context, results interface{}) error {
+	e, err := rq.check(ctx, "All")
+	if err != nil {
+		return err
+	}
+	if docs := e.value(0); docs != nil {
+		err := assignSlice(docs, results)
+		if err != nil {
+			return err
+		}
+	}
+	return e.err(1)
+}
+
+//Distinct copies the values set by the expectation into result
+func (rq *RecorderQuery) Distinct(key string, result interface{}) error {
+	return rq.distinct(nil, key, result)
+}
+
+//DistinctContext is Distinct, a done ctx gives its error
+func (rq *RecorderQuery) DistinctContext(ctx context.Context, key string, result interface{}) error {
+	return rq.distinct(ctx, key, result)
+}
+
+func (rq *RecorderQuery) distinct(ctx context.Context, key string, result interface{}) error {
+	e, err := rq.check(ctx, "Distinct", key)
+	if err != nil {
+		return err
+	}
+	if values := e.value(0); values != nil {
+		err := assignSlice(values, result)
+		if err != nil {
+			return err
+		}
+	}
+	return e.err(1)
+}
+
+//Count returns the number and the error set by the expectation
+func (rq *RecorderQuery) Count() (num int, err error) {
+	return rq.count(nil)
+}
+
+//CountContext is Count, a done ctx gives its error
+func (rq *RecorderQuery) CountContext(ctx context.Context) (num int, err error) {
+	return rq.count(ctx)
+}
+
+func (rq *RecorderQuery) count(ctx context.Context) (num int, err error) {
+	e, err := rq.check(ctx, "Count")
+	if err != nil {
+		return 0, err
+	}
+	return e.num(0), e.err(1)
+}
+
+//argsMatch compares arguments of a call with the expected ones
+func argsMatch(expected, actual []interface{}) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+	for i := range expected {
+		if !argMatch(expected[i], actual[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+//argMatch compares an argument with the expected value or Matcher, documents are compared by their bson form
+func argMatch(expected, actual interface{}) bool {
+	if m, ok := expected.(Matcher); ok {
+		return m(actual)
+	}
+	if opt, ok := expected.(Option); ok { //options are funcs, so the settings made by them are compared
+		actOpt, ok := actual.(Option)
+		return ok && reflect.DeepEqual(optionsOf(opt), optionsOf(actOpt))
+	}
+	if expDoc, ok := docOf(expected); ok {
+		actDoc, ok := docOf(actual)
+		return ok && equal(expDoc, actDoc)
+	}
+	if expArr, ok := arrayOf(expected); ok { //pipelines and other arrays of documents
+		actArr, ok := arrayOf(actual)
+		return ok && equal(expArr, actArr)
+	}
+	return equal(expected, actual)
+}
+
+//assignSlice puts a slice into the slice pointed by result using the bson conversion rules if needed
+func assignSlice(src interface{}, result interface{}) error {
+	sv := reflect.ValueOf(src)
+	rv := reflect.ValueOf(result)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("Unexpected result type, want a pointer to a slice, got `%T`", result)
+	}
+	if sv.Type().AssignableTo(rv.Elem().Type()) {
+		rv.Elem().Set(sv)
+		return nil
+	}
+	if sv.Kind() != reflect.Slice && sv.Kind() != reflect.Array {
+		return fmt.Errorf("Failed to assign `%T` to `%T`, want a slice", src, result)
+	}
+
+	values := make([]interface{}, sv.Len())
+	for i := range values {
+		values[i] = sv.Index(i).Interface()
+	}
+	return unmarshalValues(values, result)
+}
+
+//arrayOf returns a slice in its bson form, []byte isn't an array
+func arrayOf(v interface{}) ([]interface{}, bool) {
+	rv := reflect.ValueOf(v)
+	if (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) || rv.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	doc, ok := docOf(bson.M{"array": v})
+	if !ok {
+		return nil, false
+	}
+	arr, ok := doc["array"].([]interface{})
+	return arr, ok
+}
+
+func formatArgs(args []interface{}) string {
+	s := make([]string, len(args))
+	for i, arg := range args {
+		if _, ok := arg.(Matcher); ok {
+			s[i] = "<matcher>"
+			continue
+		}
+		if opt, ok := arg.(Option); ok {
+			s[i] = fmt.Sprintf("db.Option%+v", optionsOf(opt))
+			continue
+		}
+		s[i] = fmt.Sprintf("%#v", arg)
+	}
+	return strings.Join(s, ", ")
+}
+
+//optionsOf returns the settings made by the option, an invalid option gives its error instead
+func optionsOf(opt Option) interface{} {
+	var o Options
+	if opt == nil {
+		return nil
+	}
+	if err := opt(&o); err != nil {
+		return err.Error()
+	}
+	return o
+}
@@ -0,0 +1,229 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+//refinement keeps Sort, Skip, Limit and Select of the in-process queries
+type refinement struct {
+	sort       []string
+	skip       int
+	limit      int
+	projection bson.M
+	err        error
+}
+
+func (r *refinement) setSort(fields []string) {
+	for _, f := range fields {
+		if strings.TrimPrefix(strings.TrimPrefix(f, "+"), "-") == "" {
+			r.err = errors.New("Sort: empty field name")
+			return
+		}
+	}
+	r.sort = fields
+}
+
+func (r *refinement) setSkip(n int) {
+	if n < 0 {
+		n = 0
+	}
+	r.skip = n
+}
+
+//setLimit sets the maximum number of documents, zero means no limit and a negative n is the same as -n like in mgo
+func (r *refinement) setLimit(n int) {
+	if n < 0 {
+		n = -n
+	}
+	r.limit = n
+}
+
+func (r *refinement) setProjection(projection interface{}) {
+	if projection == nil {
+		r.projection = nil
+		return
+	}
+	doc, ok := selectorOf(projection)
+	if !ok {
+		r.err = fmt.Errorf("Select wants a document like bson.M{\"field\": 1}, got `%T`", projection)
+		return
+	}
+	var include, exclude int
+	for field, v := range doc {
+		switch {
+		case field == "_id":
+		case truthy(v):
+			include++
+		default:
+			exclude++
+		}
+	}
+	if include > 0 && exclude > 0 {
+		r.err = errors.New("Select can't mix the inclusion and the exclusion of fields except `_id`")
+		return
+	}
+	r.projection = doc
+}
+
+//active reports whether the refinement changes the set or the order of the documents or has failed
+func (r *refinement) active() bool {
+	return len(r.sort) > 0 || r.skip > 0 || r.limit > 0 || r.projection != nil || r.err != nil
+}
+
+//count returns the number of documents left by Skip and Limit out of n
+func (r *refinement) count(n int) int {
+	n -= r.skip
+	if n < 0 {
+		return 0
+	}
+	if r.limit > 0 && r.limit < n {
+		return r.limit
+	}
+	return n
+}
+
+//order returns the indexes of the documents sorted, skipped and limited by the refinement
+func (r *refinement) order(docs []bson.M) []int {
+	idx := make([]int, len(docs))
+	for i := range idx {
+		idx[i] = i
+	}
+
+	if len(r.sort) > 0 {
+		sort.SliceStable(idx, func(i, j int) bool {
+			return lessDoc(docs[idx[i]], docs[idx[j]], r.sort)
+		})
+	}
+
+	if r.skip >= len(idx) {
+		return nil
+	}
+	idx = idx[r.skip:]
+	if r.limit > 0 && r.limit < len(idx) {
+		idx = idx[:r.limit]
+	}
+	return idx
+}
+
+//project returns the document with the fields chosen by Select, without Select it's the document itself
+func (r *refinement) project(doc bson.M) (bson.M, error) {
+	if r.projection == nil {
+		return doc, nil
+	}
+
+	inclusion := false
+	for field, v := range r.projection {
+		if field != "_id" && truthy(v) {
+			inclusion = true
+		}
+	}
+
+	if !inclusion {
+		projected := copyDoc(doc)
+		for field := range r.projection {
+			unsetPath(projected, field)
+		}
+		return projected, nil
+	}
+
+	projected := bson.M{}
+	if v, ok := r.projection["_id"]; !ok || truthy(v) {
+		if id, ok := doc["_id"]; ok {
+			projected["_id"] = id
+		}
+	}
+	for field, v := range r.projection {
+		if field == "_id" || !truthy(v) {
+			continue
+		}
+		value, ok := getPath(doc, field)
+		if !ok {
+			continue
+		}
+		err := setPath(projected, field, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return projected, nil
+}
+
+//lessDoc orders documents by the fields, "-field" sorts in the descending order
+func lessDoc(a, b bson.M, fields []string) bool {
+	for _, f := range fields {
+		desc := strings.HasPrefix(f, "-")
+		path := strings.TrimPrefix(strings.TrimPrefix(f, "+"), "-")
+
+		x, _ := getPath(a, path)
+		y, _ := getPath(b, path)
+		c := compareSort(x, y)
+		if c == 0 {
+			continue
+		}
+		if desc {
+			return c > 0
+		}
+		return c < 0
+	}
+	return false
+}
+
+//compareSort orders any values, values of different kinds are ordered like in Mongo:
+//missing and null, numbers, strings, documents, arrays, ObjectIds, booleans, times
+func compareSort(a, b interface{}) int {
+	if c, ok := compare(a, b); ok {
+		return c
+	}
+	ra, rb := sortRank(a), sortRank(b)
+	switch {
+	case ra < rb:
+		return -1
+	case ra > rb:
+		return 1
+	}
+
+	switch x := a.(type) {
+	case bson.ObjectId:
+		return strings.Compare(string(x), string(b.(bson.ObjectId)))
+	case bool:
+		y := b.(bool)
+		switch {
+		case x == y:
+			return 0
+		case y:
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func sortRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case string:
+		return 2
+	case bson.M:
+		return 3
+	case []interface{}:
+		return 4
+	case bson.ObjectId:
+		return 5
+	case bool:
+		return 6
+	case time.Time:
+		return 7
+	}
+	if isNumber(reflect.ValueOf(v)) {
+		return 1
+	}
+	return 8
+}
@@ -0,0 +1,332 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+//selectorOf returns the query as a normalized bson document if it's a Mongo-style selector
+//(bson.M, bson.D or map[string]interface{}), any other value is treated by Bolt as a key
+func selectorOf(query interface{}) (bson.M, bool) {
+	switch query.(type) {
+	case bson.M, bson.D, map[string]interface{}:
+		return docOf(query)
+	}
+	return nil, false
+}
+
+//match reports whether the document satisfies the selector.
+//Supported are field equality, dotted paths, $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists, $and and $or.
+func match(doc bson.M, selector bson.M) (bool, error) {
+	for key, cond := range selector {
+		var ok bool
+		var err error
+
+		switch key {
+		case "$and", "$or":
+			ok, err = matchLogical(doc, key, cond)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return false, fmt.Errorf("Unsupported query operator `%s`", key)
+			}
+			values := lookup(doc, key)
+			ok, err = matchField(values, cond)
+		}
+
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+//matchLogical evaluates $and and $or, cond has to be an array of selectors
+func matchLogical(doc bson.M, op string, cond interface{}) (bool, error) {
+	selectors, ok := cond.([]interface{})
+	if !ok || len(selectors) == 0 {
+		return false, fmt.Errorf("Operator `%s` wants a non-empty array of selectors", op)
+	}
+
+	for _, s := range selectors {
+		selector, ok := s.(bson.M)
+		if !ok {
+			return false, fmt.Errorf("Operator `%s` wants a non-empty array of selectors", op)
+		}
+		ok, err := match(doc, selector)
+		if err != nil {
+			return false, err
+		}
+		if op == "$or" && ok {
+			return true, nil
+		}
+		if op == "$and" && !ok {
+			return false, nil
+		}
+	}
+	return op == "$and", nil
+}
+
+//matchField checks the values found by a path against the condition,
+//which is either an operators document like {"$gt": 1} or a value to compare with
+func matchField(values []interface{}, cond interface{}) (bool, error) {
+	//a missing field equals null in Mongo, so the equality operators see it as a single nil value
+	equals := values
+	if len(values) == 0 {
+		equals = []interface{}{nil}
+	}
+
+	ops, ok := cond.(bson.M)
+	if !ok || !isOperators(ops) {
+		return anyValue(equals, func(v interface{}) bool { return equal(v, cond) }), nil
+	}
+
+	for op, arg := range ops {
+		var ok bool
+
+		switch op {
+		case "$eq":
+			ok = anyValue(equals, func(v interface{}) bool { return equal(v, arg) })
+		case "$ne":
+			ok = !anyValue(equals, func(v interface{}) bool { return equal(v, arg) })
+		case "$gt", "$gte", "$lt", "$lte":
+			ok = anyValue(values, func(v interface{}) bool { return compareOp(op, v, arg) })
+		case "$in", "$nin":
+			args, isArray := arg.([]interface{})
+			if !isArray {
+				return false, fmt.Errorf("Operator `%s` wants an array", op)
+			}
+			ok = anyValue(equals, func(v interface{}) bool {
+				for _, a := range args {
+					if equal(v, a) {
+						return true
+					}
+				}
+				return false
+			})
+			if op == "$nin" {
+				ok = !ok
+			}
+		case "$exists":
+			ok = (len(values) > 0) == truthy(arg)
+		default:
+			return false, fmt.Errorf("Unsupported query operator `%s`", op)
+		}
+
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+//isOperators reports whether the document consists of query operators only
+func isOperators(doc bson.M) bool {
+	if len(doc) == 0 {
+		return false
+	}
+	for key := range doc {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+//anyValue reports whether fn holds for any of the values or for an element of an array value,
+//that's how Mongo matches arrays against scalar conditions
+func anyValue(values []interface{}, fn func(v interface{}) bool) bool {
+	for _, v := range values {
+		if fn(v) {
+			return true
+		}
+		if arr, ok := v.([]interface{}); ok {
+			for _, elem := range arr {
+				if fn(elem) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+//lookup returns all values placed at the dotted path of the document, e.g. "address.city" or "tags.0".
+//A path going through an array of documents gives a value for every element, just like in Mongo.
+func lookup(doc bson.M, path string) []interface{} {
+	return lookupParts(doc, strings.Split(path, "."))
+}
+
+func lookupParts(v interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		return []interface{}{v}
+	}
+
+	switch cur := v.(type) {
+	case bson.M:
+		value, ok := cur[parts[0]]
+		if !ok {
+			return nil
+		}
+		return lookupParts(value, parts[1:])
+	case []interface{}:
+		if i, err := strconv.Atoi(parts[0]); err == nil {
+			if i < 0 || i >= len(cur) {
+				return nil
+			}
+			return lookupParts(cur[i], parts[1:])
+		}
+		var values []interface{}
+		for _, elem := range cur {
+			if _, ok := elem.(bson.M); ok {
+				values = append(values, lookupParts(elem, parts)...)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+//equal compares values, numbers of different types are compared by their values
+//including the ones nested in documents and arrays
+func equal(a, b interface{}) bool {
+	if c, ok := compare(a, b); ok {
+		return c == 0
+	}
+
+	switch x := a.(type) {
+	case bson.M:
+		y, ok := b.(bson.M)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for key, v := range x {
+			w, ok := y[key]
+			if !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+//compareOp applies one of the $gt, $gte, $lt, $lte operators, values of different kinds never match
+func compareOp(op string, a, b interface{}) bool {
+	c, ok := compare(a, b)
+	if !ok {
+		return false
+	}
+	switch op {
+	case "$gt":
+		return c > 0
+	case "$gte":
+		return c >= 0
+	case "$lt":
+		return c < 0
+	default:
+		return c <= 0
+	}
+}
+
+//compare orders numbers, strings and times, ok is false if the values can't be ordered
+func compare(a, b interface{}) (c int, ok bool) {
+	if x, ok := a.(time.Time); ok {
+		y, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x.Before(y):
+			return -1, true
+		case x.After(y):
+			return 1, true
+		}
+		return 0, true
+	}
+
+	av, bv := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !av.IsValid() || !bv.IsValid() {
+		return 0, false
+	}
+
+	switch {
+	case av.Kind() == reflect.String && bv.Kind() == reflect.String:
+		return strings.Compare(av.String(), bv.String()), true
+	case isInt(av) && isInt(bv):
+		x, y := toInt(av), toInt(bv)
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case isNumber(av) && isNumber(bv):
+		x, y := toFloat(av), toFloat(bv)
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func isInt(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return true
+	}
+	return false
+}
+
+func isNumber(v reflect.Value) bool {
+	return isInt(v) || v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64
+}
+
+func toInt(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return int64(v.Uint())
+	}
+	return v.Int()
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	}
+	return float64(toInt(v))
+}
+
+//truthy converts an argument of operators like $exists to bool
+func truthy(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	rv := reflect.ValueOf(v)
+	if isNumber(rv) {
+		return toFloat(rv) != 0
+	}
+	return v != nil
+}
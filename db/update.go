@@ -0,0 +1,333 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+//updateOperators returns the update as a normalized bson document if it consists of update operators,
+//a replacement document or value gives false
+func updateOperators(update interface{}) (bson.M, bool, error) {
+	doc, ok := selectorOf(update)
+	if !ok || len(doc) == 0 {
+		return nil, false, nil
+	}
+
+	var ops, fields int
+	for key := range doc {
+		if strings.HasPrefix(key, "$") {
+			ops++
+		} else {
+			fields++
+		}
+	}
+	switch {
+	case ops > 0 && fields > 0:
+		return nil, false, errors.New("Failed to update, update operators can't be mixed with fields")
+	case ops > 0:
+		return doc, true, nil
+	}
+	return nil, false, nil
+}
+
+//updateValue applies the update operators to a copy of value and returns it with the type of value
+//if the type holds the whole result, otherwise the result is returned as a bson.M document,
+//so the fields the type lacks or can't keep aren't lost
+func updateValue(value interface{}, ops bson.M) (interface{}, error) {
+	doc, ok := docOf(value)
+	if !ok {
+		return nil, fmt.Errorf("Failed to apply update operators to `%T`, want a document", value)
+	}
+
+	err := applyUpdate(doc, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := reflect.New(reflect.TypeOf(value))
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	if bson.Unmarshal(data, updated.Interface()) != nil {
+		return doc, nil
+	}
+	if kept, ok := docOf(updated.Elem().Interface()); !ok || !equal(kept, doc) {
+		return doc, nil
+	}
+	return updated.Elem().Interface(), nil
+}
+
+//upsertDoc builds a new document for Upsert from the equality conditions of the selector
+func upsertDoc(selector bson.M) (bson.M, error) {
+	doc := bson.M{}
+	for key, cond := range selector {
+		if strings.HasPrefix(key, "$") {
+			continue
+		}
+		if ops, ok := cond.(bson.M); ok && isOperators(ops) {
+			eq, ok := ops["$eq"]
+			if !ok {
+				continue
+			}
+			cond = eq
+		}
+		err := setPath(doc, key, cond)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+//applyUpdate modifies the document with the update operators
+//$set, $unset, $inc, $mul, $min, $max, $push, $addToSet, $pull and $rename
+func applyUpdate(doc bson.M, ops bson.M) error {
+	for op, arg := range ops {
+		fields, ok := arg.(bson.M)
+		if !ok {
+			return fmt.Errorf("Operator `%s` wants a document, got `%T`", op, arg)
+		}
+
+		for path, value := range fields {
+			var err error
+
+			switch op {
+			case "$set":
+				err = setPath(doc, path, value)
+			case "$unset":
+				unsetPath(doc, path)
+			case "$inc", "$mul":
+				err = updateNumber(doc, op, path, value)
+			case "$min", "$max":
+				cur, ok := getPath(doc, path)
+				c, comparable := compare(value, cur)
+				if !ok || (comparable && ((op == "$min" && c < 0) || (op == "$max" && c > 0))) {
+					err = setPath(doc, path, value)
+				}
+			case "$push", "$addToSet":
+				err = pushValues(doc, op, path, value)
+			case "$pull":
+				err = pullValues(doc, path, value)
+			case "$rename":
+				err = renamePath(doc, path, value)
+			default:
+				err = fmt.Errorf("Unsupported update operator `%s`", op)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//updateNumber applies $inc or $mul, a missing field is set to the argument or to zero respectively
+func updateNumber(doc bson.M, op, path string, arg interface{}) error {
+	argv := reflect.ValueOf(arg)
+	if !isNumber(argv) {
+		return fmt.Errorf("Operator `%s` wants a number for `%s`, got `%T`", op, path, arg)
+	}
+
+	cur, ok := getPath(doc, path)
+	if !ok {
+		if op == "$mul" {
+			return setPath(doc, path, reflect.Zero(argv.Type()).Interface())
+		}
+		return setPath(doc, path, arg)
+	}
+	curv := reflect.ValueOf(cur)
+	if !isNumber(curv) {
+		return fmt.Errorf("Operator `%s` can't modify non-numeric field `%s`", op, path)
+	}
+
+	if isInt(curv) && isInt(argv) {
+		x, y := toInt(curv), toInt(argv)
+		res := x + y
+		if op == "$mul" {
+			res = x * y
+		}
+		return setPath(doc, path, reflect.ValueOf(res).Convert(curv.Type()).Interface())
+	}
+
+	x, y := toFloat(curv), toFloat(argv)
+	res := x + y
+	if op == "$mul" {
+		res = x * y
+	}
+	return setPath(doc, path, res)
+}
+
+//pushValues applies $push or $addToSet, both accept {"$each": [...]} to add several values
+func pushValues(doc bson.M, op, path string, arg interface{}) error {
+	values := []interface{}{arg}
+	if each, ok := arg.(bson.M); ok {
+		if v, ok := each["$each"]; ok {
+			values, ok = v.([]interface{})
+			if !ok {
+				return fmt.Errorf("Modifier `$each` of `%s` wants an array", op)
+			}
+		}
+	}
+
+	var arr []interface{}
+	if cur, ok := getPath(doc, path); ok {
+		arr, ok = cur.([]interface{})
+		if !ok {
+			return fmt.Errorf("Operator `%s` can't modify non-array field `%s`", op, path)
+		}
+	}
+
+	for _, v := range values {
+		if op == "$addToSet" && hasValue(arr, v) {
+			continue
+		}
+		arr = append(arr, v)
+	}
+	return setPath(doc, path, arr)
+}
+
+//hasValue reports whether an element of the array equals v, an array v is compared with the elements, not the whole array
+func hasValue(arr []interface{}, v interface{}) bool {
+	for _, elem := range arr {
+		if equal(elem, v) {
+			return true
+		}
+	}
+	return false
+}
+
+//pullValues applies $pull, the argument is a value, a condition like {"$gte": 5} or a selector for nested documents
+func pullValues(doc bson.M, path string, arg interface{}) error {
+	cur, ok := getPath(doc, path)
+	if !ok {
+		return nil
+	}
+	arr, ok := cur.([]interface{})
+	if !ok {
+		return fmt.Errorf("Operator `$pull` can't modify non-array field `%s`", path)
+	}
+
+	kept := []interface{}{}
+	for _, elem := range arr {
+		pulled := equal(elem, arg)
+		if cond, ok := arg.(bson.M); ok {
+			var err error
+			if isOperators(cond) {
+				pulled, err = matchField([]interface{}{elem}, cond)
+			} else if elemDoc, ok := elem.(bson.M); ok {
+				pulled, err = match(elemDoc, cond)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if !pulled {
+			kept = append(kept, elem)
+		}
+	}
+	return setPath(doc, path, kept)
+}
+
+//renamePath applies $rename, a missing field is left as is
+func renamePath(doc bson.M, path string, arg interface{}) error {
+	newPath, ok := arg.(string)
+	if !ok || newPath == "" {
+		return fmt.Errorf("Operator `$rename` wants a new field name for `%s`", path)
+	}
+	value, ok := getPath(doc, path)
+	if !ok {
+		return nil
+	}
+	unsetPath(doc, path)
+	return setPath(doc, newPath, value)
+}
+
+//getPath returns the value placed at the dotted path, arrays are accessed by index
+func getPath(doc bson.M, path string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		switch c := cur.(type) {
+		case bson.M:
+			v, ok := c[part]
+			if !ok {
+				return nil, false
+			}
+			cur = v
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, false
+			}
+			cur = c[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+//setPath puts the value at the dotted path creating missing embedded documents
+func setPath(doc bson.M, path string, value interface{}) error {
+	parts := strings.Split(path, ".")
+	var cur interface{} = doc
+
+	for i, part := range parts {
+		last := i == len(parts)-1
+
+		switch c := cur.(type) {
+		case bson.M:
+			if last {
+				c[part] = value
+				return nil
+			}
+			next, ok := c[part]
+			if !ok || next == nil {
+				next = bson.M{}
+				c[part] = next
+			}
+			cur = next
+		case []interface{}:
+			idx, err := strconv.Atoi(part)
+			if err != nil || idx < 0 || idx >= len(c) {
+				return fmt.Errorf("Failed to set `%s`, no array element `%s`", path, part)
+			}
+			if last {
+				c[idx] = value
+				return nil
+			}
+			cur = c[idx]
+		default:
+			return fmt.Errorf("Failed to set `%s`, `%s` is not a document", path, strings.Join(parts[:i], "."))
+		}
+	}
+	return nil
+}
+
+//unsetPath removes the field placed at the dotted path, array elements are set to nil like in Mongo
+func unsetPath(doc bson.M, path string) {
+	parts := strings.Split(path, ".")
+	parent, ok := getPath(doc, strings.Join(parts[:len(parts)-1], "."))
+	if len(parts) == 1 {
+		parent, ok = doc, true
+	}
+	if !ok {
+		return
+	}
+
+	last := parts[len(parts)-1]
+	switch p := parent.(type) {
+	case bson.M:
+		delete(p, last)
+	case []interface{}:
+		if i, err := strconv.Atoi(last); err == nil && i >= 0 && i < len(p) {
+			p[i] = nil
+		}
+	}
+}